@@ -8,31 +8,33 @@ import (
 )
 
 func main() {
-	host := os.Args[0]
-	port := os.Args[1]
-	conn, err := net.Dial(host, string(port))
+	host := os.Args[1]
+	port := os.Args[2]
+	conn, err := net.Dial("tcp", host+":"+port)
 	if err != nil {
 		fmt.Println("Connect failed.")
 		os.Exit(0)
 	}
 
 	reader := bufio.NewReader(os.Stdin)
+	results := bufio.NewReader(conn)
 
 	for {
 		sql, err := reader.ReadString('\n')
 		if err != nil {
 			fmt.Println("Fail to read sql.")
+			return
 		}
 
 		if _, err := conn.Write([]byte(sql)); err != nil {
 			fmt.Println("Fail to send sql.")
 		}
 
-		var buf []byte
-		n, err := conn.Read(buf)
+		result, err := results.ReadString('\n')
 		if err != nil {
 			fmt.Println("Fail to read result.")
+			return
 		}
-		fmt.Println(string(buf[:n]))
+		fmt.Print(result)
 	}
 }
@@ -0,0 +1,129 @@
+package dm
+
+import (
+	"errors"
+	"math"
+)
+
+// 算术：INT、DOUBLE的+ - * / %和负号。INT与INT得INT，除法取整，遇到DOUBLE
+// 就得DOUBLE；有NULL的算式得NULL。
+// 写回列时INT列只收0到65535的INT，DOUBLE列也收INT。
+
+var (
+	ErrNotNumber      = errors.New("Only numbers can be computed.")
+	ErrDivisionByZero = errors.New("Division by zero.")
+)
+
+func isNumber(tp string) bool {
+	return tp == "INT" || tp == "DOUBLE"
+}
+
+func compute(op string, a interface{}, b interface{}) (interface{}, error) {
+	x, xInt := a.(int64)
+	y, yInt := b.(int64)
+
+	if xInt && yInt {
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		}
+
+		if y == 0 {
+			return nil, ErrDivisionByZero
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	}
+
+	f, ok := toDouble(a)
+	if !ok {
+		return nil, ErrNotNumber
+	}
+	g, ok := toDouble(b)
+	if !ok {
+		return nil, ErrNotNumber
+	}
+
+	switch op {
+	case "+":
+		return f + g, nil
+	case "-":
+		return f - g, nil
+	case "*":
+		return f * g, nil
+	}
+
+	if g == 0 {
+		return nil, ErrDivisionByZero
+	}
+	if op == "/" {
+		return f / g, nil
+	}
+	return math.Mod(f, g), nil
+}
+
+func toDouble(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// Fits reports whether a value of the type TypeOf returned can be written
+// to the column i.
+func (md *MetaData) Fits(i int, tp string) bool {
+	if tp == "NULL" {
+		return true
+	}
+
+	switch md.Types[i] {
+	case "INT":
+		return tp == "INT"
+	case "DOUBLE":
+		return isNumber(tp)
+	case "BLOB":
+		return isText(tp) || tp == "BLOB"
+	}
+	return isText(tp)
+}
+
+// Assign returns a value computed as it is written to the column i.
+func (md *MetaData) Assign(i int, v interface{}) (interface{}, error) {
+	col := md.Cols[i]
+
+	if v == nil {
+		if !md.Nullables[i] {
+			return nil, errors.New("The col " + col + " is not nullable.")
+		}
+		return nil, nil
+	}
+
+	switch md.Types[i] {
+	case "INT":
+		integer, ok := v.(int64)
+		if !ok {
+			return nil, errors.New("Wrong type for " + col)
+		}
+		if !IsInt(integer) {
+			return nil, errors.New("Out of range for col " + col + ", an INT is 0 to 65535.")
+		}
+	case "DOUBLE":
+		if x, ok := v.(int64); ok {
+			return float64(x), nil
+		}
+	case "STRING":
+		if s, ok := v.(string); ok && len(s) > int(md.Lens[i]) {
+			return nil, errors.New("Too long for col " + col)
+		}
+	}
+	return v, nil
+}
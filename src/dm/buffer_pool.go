@@ -0,0 +1,490 @@
+package dm
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	POOL_BUDGET    = 1 << 23 // default bytes of pages kept in memory
+	MIN_POOL_PAGES = 16
+)
+
+var ErrPoolExhausted = errors.New("Every page in the buffer pool is pinned.")
+
+// pageKey names a page of any table.
+type pageKey struct {
+	path string
+	pgNo uint64
+}
+
+// poolStats counts what the buffer pool did for one table.
+type poolStats struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	flushes   uint64
+	flushTime time.Duration
+	maxFlush  time.Duration
+}
+
+// BufferStat is a snapshot of the buffer pool counters of one table, or of
+// one of its indexes.
+type BufferStat struct {
+	Table      string
+	Index      string // empty for the records of the table
+	Pages      int    // pages of the file in the pool
+	DirtyPages int
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	Flushes    uint64
+	AvgFlush   time.Duration
+	MaxFlush   time.Duration
+}
+
+// owner names the table a page file belongs to, and the index it holds.
+type owner struct {
+	table string
+	index string
+}
+
+// bufferPool caches pages of every table in frames keyed by file and page
+// number, within one memory budget. Pinned pages stay in memory, the others
+// are evicted as the replacer decides, and only dirty pages are written back.
+// Pages are read and written back without mu held, a frame being loaded or
+// written back is closed to others until the disk is done with it.
+type bufferPool struct {
+	frames   map[pageKey]*Pge
+	files    map[string]map[uint64]*Pge // the same frames, by table file
+	loading  map[pageKey]chan struct{}  // frames reserved for a page being read
+	writing  map[pageKey]chan struct{}  // evicted pages being written back
+	stats    map[string]*poolStats
+	owners   map[string]owner // the table and index of a page file, by path
+	capacity int
+	replacer replacer
+	mu       sync.Mutex
+}
+
+var sharedPool = newBufferPool(POOL_BUDGET/PAGE_SIZE, POLICY_LRU_K)
+
+func newBufferPool(capacity int, policy string) *bufferPool {
+	return &bufferPool{
+		frames:   make(map[pageKey]*Pge),
+		files:    make(map[string]map[uint64]*Pge),
+		loading:  make(map[pageKey]chan struct{}),
+		writing:  make(map[pageKey]chan struct{}),
+		stats:    make(map[string]*poolStats),
+		owners:   make(map[string]owner),
+		capacity: capacity,
+		replacer: newReplacer(policy),
+	}
+}
+
+// SetPoolBudget limits the pages kept in memory to budget bytes. A smaller
+// budget takes effect as pages get evicted.
+func SetPoolBudget(budget int64) error {
+	if budget/PAGE_SIZE < MIN_POOL_PAGES {
+		return ErrMemTooSmall
+	}
+
+	sharedPool.mu.Lock()
+	sharedPool.capacity = int(budget / PAGE_SIZE)
+	sharedPool.mu.Unlock()
+	return nil
+}
+
+// SetReplacePolicy chooses how the buffer pool picks pages to evict.
+func SetReplacePolicy(policy string) error {
+	if policy != POLICY_LRU_K && policy != POLICY_CLOCK {
+		return ErrUnknownPolicy
+	}
+
+	sharedPool.mu.Lock()
+	defer sharedPool.mu.Unlock()
+
+	sharedPool.replacer = newReplacer(policy)
+	for key, page := range sharedPool.frames {
+		sharedPool.replacer.recordAccess(key)
+		sharedPool.replacer.setEvictable(key, page.pins == 0)
+	}
+	return nil
+}
+
+// fetch returns the page pinned, reading it with load if it is not cached.
+func (pool *bufferPool) fetch(path string, pgNo uint64, load func(uint64) (*Pge, error)) (*Pge, error) {
+	key := pageKey{path, pgNo}
+
+	pool.mu.Lock()
+	pool.settle(func(k pageKey) bool { return k == key })
+
+	if page := pool.frames[key]; page != nil {
+		pool.statsOf(path).hits++
+		pool.pin(path, page)
+		pool.mu.Unlock()
+		return page, nil
+	}
+
+	victims, err := pool.reserve(key)
+	pool.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pool.writeBack(victims)
+	var page *Pge
+	if err == nil {
+		page, err = load(pgNo)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.release(key)
+	if err != nil {
+		return nil, err
+	}
+	pool.put(path, page)
+	pool.statsOf(path).misses++
+	pool.pin(path, page)
+	return page, nil
+}
+
+// add writes a newly allocated page and puts it into the pool, pinned.
+// Writing it at once keeps numOfBlocks pages in the file.
+func (pool *bufferPool) add(path string, page *Pge) error {
+	key := pageKey{path, page.index}
+
+	pool.mu.Lock()
+	victims, err := pool.reserve(key)
+	pool.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = pool.writeBack(victims)
+	var elapsed time.Duration
+	if err == nil {
+		elapsed, err = timedFlush(page)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.release(key)
+	if err != nil {
+		return err
+	}
+	pool.count(path, elapsed)
+	pool.put(path, page)
+	pool.pin(path, page)
+	return nil
+}
+
+func (pool *bufferPool) put(path string, page *Pge) {
+	pool.frames[pageKey{path, page.index}] = page
+
+	if pool.files[path] == nil {
+		pool.files[path] = make(map[uint64]*Pge)
+	}
+	pool.files[path][page.index] = page
+}
+
+func (pool *bufferPool) pin(path string, page *Pge) {
+	key := pageKey{path, page.index}
+
+	page.pins++
+	pool.replacer.recordAccess(key)
+	pool.replacer.setEvictable(key, false)
+}
+
+func (pool *bufferPool) unpin(path string, page *Pge) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	page.pins--
+	if page.pins == 0 {
+		pool.replacer.setEvictable(pageKey{path, page.index}, true)
+	}
+}
+
+// reserve evicts pages until a frame is free and holds it for the page of
+// key, which must be released when the page is in. The dirty pages evicted
+// are returned to be written back. mu must be held.
+func (pool *bufferPool) reserve(key pageKey) (map[pageKey]*Pge, error) {
+	victims := make(map[pageKey]*Pge)
+	for len(pool.frames)+len(pool.loading) >= pool.capacity {
+		victim, ok := pool.replacer.victim()
+		if !ok {
+			// the pages evicted so far are still good.
+			for k, page := range victims {
+				pool.put(k.path, page)
+				pool.statsOf(k.path).evictions--
+				pool.replacer.recordAccess(k)
+				pool.replacer.setEvictable(k, true)
+				close(pool.writing[k])
+				delete(pool.writing, k)
+			}
+			return nil, ErrPoolExhausted
+		}
+
+		page := pool.frames[victim]
+		if page.dirty {
+			victims[victim] = page
+			pool.writing[victim] = make(chan struct{})
+		}
+
+		delete(pool.frames, victim)
+		delete(pool.files[victim.path], victim.pgNo)
+		pool.statsOf(victim.path).evictions++
+	}
+
+	pool.loading[key] = make(chan struct{})
+	return victims, nil
+}
+
+// release gives up the frame reserved for key. mu must be held.
+func (pool *bufferPool) release(key pageKey) {
+	close(pool.loading[key])
+	delete(pool.loading, key)
+}
+
+// writeBack writes the pages reserve evicted back, without mu held. A page
+// that fails to be written goes back into the pool.
+func (pool *bufferPool) writeBack(victims map[pageKey]*Pge) error {
+	var failed error
+	for key, page := range victims {
+		elapsed, err := timedFlush(page)
+
+		pool.mu.Lock()
+		if err == nil {
+			pool.count(key.path, elapsed)
+		} else {
+			pool.put(key.path, page)
+			pool.replacer.recordAccess(key)
+			pool.replacer.setEvictable(key, true)
+			failed = err
+		}
+		close(pool.writing[key])
+		delete(pool.writing, key)
+		pool.mu.Unlock()
+	}
+	return failed
+}
+
+// settle waits until no page of a key matching is being loaded or written
+// back. mu must be held, it is let go while waiting.
+func (pool *bufferPool) settle(matching func(pageKey) bool) {
+	for {
+		var busy chan struct{}
+		for key, done := range pool.writing {
+			if matching(key) {
+				busy = done
+			}
+		}
+		for key, done := range pool.loading {
+			if matching(key) {
+				busy = done
+			}
+		}
+		if busy == nil {
+			return
+		}
+
+		pool.mu.Unlock()
+		<-busy
+		pool.mu.Lock()
+	}
+}
+
+// flush writes the page back and times it. mu must be held.
+func (pool *bufferPool) flush(path string, page *Pge) error {
+	elapsed, err := timedFlush(page)
+	if err != nil {
+		return err
+	}
+	pool.count(path, elapsed)
+	return nil
+}
+
+func timedFlush(page *Pge) (time.Duration, error) {
+	start := time.Now()
+	if err := page.Flush(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// count adds a write back taking elapsed to the counters of a table. mu must
+// be held.
+func (pool *bufferPool) count(path string, elapsed time.Duration) {
+	stats := pool.statsOf(path)
+	stats.flushes++
+	stats.flushTime += elapsed
+	if elapsed > stats.maxFlush {
+		stats.maxFlush = elapsed
+	}
+}
+
+// statsOf returns the counters of a table. mu must be held.
+func (pool *bufferPool) statsOf(path string) *poolStats {
+	stats := pool.stats[path]
+	if stats == nil {
+		stats = &poolStats{}
+		pool.stats[path] = stats
+	}
+	return stats
+}
+
+// own tells the pool the table and index the page file at path holds.
+func (pool *bufferPool) own(path string, table string, index string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.owners[path] = owner{table, index}
+}
+
+// BufferStats returns the buffer pool counters of every table and index used
+// since the server started, ordered by table, the records of a table first.
+func BufferStats() []BufferStat {
+	pool := sharedPool
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	ret := make([]BufferStat, 0, len(pool.stats))
+	for path, stats := range pool.stats {
+		table, index := strings.TrimSuffix(path, SUFFIX_DB), ""
+		if o, ok := pool.owners[path]; ok {
+			table, index = o.table, o.index
+		}
+
+		stat := BufferStat{
+			Table:     table,
+			Index:     index,
+			Pages:     len(pool.files[path]),
+			Hits:      stats.hits,
+			Misses:    stats.misses,
+			Evictions: stats.evictions,
+			Flushes:   stats.flushes,
+			MaxFlush:  stats.maxFlush,
+		}
+		if stats.flushes > 0 {
+			stat.AvgFlush = stats.flushTime / time.Duration(stats.flushes)
+		}
+
+		for _, page := range pool.files[path] {
+			page.latch.RLock()
+			if page.dirty {
+				stat.DirtyPages++
+			}
+			page.latch.RUnlock()
+		}
+
+		ret = append(ret, stat)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Table != ret[j].Table {
+			return ret[i].Table < ret[j].Table
+		}
+		return ret[i].Index < ret[j].Index
+	})
+	return ret
+}
+
+// flushAll writes every dirty page back. Readers may keep their pins.
+func (pool *bufferPool) flushAll() error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.settle(func(pageKey) bool { return true })
+
+	for key, page := range pool.frames {
+		page.latch.RLock()
+
+		var err error
+		if page.dirty {
+			err = pool.flush(key.path, page)
+		}
+
+		page.latch.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readThrough reads a page from disk past the pool. Holding mu, once the
+// page is not being evicted, keeps it from seeing a page in the middle of
+// being written back.
+func (pool *bufferPool) readThrough(file *os.File, pgNo uint64) ([]byte, error) {
+	key := pageKey{file.Name(), pgNo}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.settle(func(k pageKey) bool { return k == key })
+
+	return readPage(file, pgNo)
+}
+
+// flushFile writes the dirty pages of one table back.
+func (pool *bufferPool) flushFile(path string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.settle(func(key pageKey) bool { return key.path == path })
+
+	for _, page := range pool.files[path] {
+		page.latch.RLock()
+
+		var err error
+		if page.dirty {
+			err = pool.flush(path, page)
+		}
+
+		page.latch.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardFrom forgets the pages of a table from pgNo on, which are cut off
+// its file.
+func (pool *bufferPool) discardFrom(path string, pgNo uint64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.settle(func(key pageKey) bool { return key.path == path })
+
+	for n := range pool.files[path] {
+		if n < pgNo {
+			continue
+		}
+		key := pageKey{path, n}
+
+		pool.replacer.remove(key)
+		delete(pool.frames, key)
+		delete(pool.files[path], n)
+	}
+}
+
+// discard forgets the pages of a table without writing anything back.
+func (pool *bufferPool) discard(path string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.settle(func(key pageKey) bool { return key.path == path })
+
+	for pgNo := range pool.files[path] {
+		key := pageKey{path, pgNo}
+
+		pool.replacer.remove(key)
+		delete(pool.frames, key)
+	}
+	delete(pool.files, path)
+	delete(pool.stats, path)
+}
@@ -1,133 +1,162 @@
 package dm
 
 import (
-	"bytes"
-	"container/list"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 )
 
 type MetaData struct {
-	NumOfBlocks  uint16
+	Magic        string
+	Version      uint16 // format of the .db file, see FORMAT_VERSION
+	NumOfBlocks  uint64
 	SizeOfRecord uint16
 	Cols         []string
 	Types        []string
 	Lens         []uint16
-	Offsets      []uint16
 	Nullables    []bool
-	Indexes      []bool
+	Indexes      []bool     // indexes declared with the table before they had names
+	IndexDefs    []IndexDef `json:",omitempty"`
+
+	ForeignKeys []ForeignKey `json:",omitempty"`
+	Children    []string     `json:",omitempty"` // tables with a FOREIGN KEY to this one
+
+	Defaults []string `json:",omitempty"` // the text of the DEFAULT of each col, see DefaultOf
+	Checks   []Check  `json:",omitempty"`
+}
+
+// IndexDef names an index of a table and the columns it is on. The index
+// lives in the file tableName_Name.index.
+type IndexDef struct {
+	Name   string
+	Cols   []string
+	Unique bool
+	Using  string `json:",omitempty"` // HASH, or empty for a B+tree
+
+	// PRIMARY KEY or UNIQUE if the index backs a constraint of the table.
+	Constraint string `json:",omitempty"`
 }
 
 const (
-	MEM_LIT   = 1000
 	PAGE_SIZE = 1 << 12
 
+	SIZE_OF_VERSION    = 16 // xmin + xmax of every record
+	MAX_SIZE_OF_RECORD = PAGE_SIZE - SIZE_OF_PAGE_HEAD - SIZE_OF_SLOT - SIZE_OF_VERSION
+
 	SUFFIX_DB   = ".db"
 	SUFFIX_META = ".meta"
+	SUFFIX_NEW  = ".new"
+
+	FORMAT_VERSION = 4 // see upgrade.go for older versions
 )
 
 type Cacher interface {
-	NewPage() (uint16, error)
-	GetPage(p uint16) *Pge
+	GetPage(pgNo uint64) (*Pge, error)
+	GetPageFor(size int) (*Pge, error)
+	Unpin(page *Pge)
+	NumOfBlocks() uint64
 }
 
+// Locks are taken in this order, never one while holding a later one:
+// txnLock, the moving of a table, the mu of its cacher, the mu of the buffer
+// pool, the latch of a page, then the mu of a free-space map or of the log.
+// So a page is fetched, allocated or given back with no latch held, and a
+// cacher keeps its mu only for its own fields and to append a page.
 type cacher struct {
-	dbFile       *os.File   // file to store data
-	numOfBlocks  uint16    // block is like page in cache.
-	pages        *list.List // pages are stored in cache.
-	cacheLimit   uint16    // max pages to keep in cache
-	sizeOfRecord uint16     // every record's size
-	Metadata     *MetaData  // metadata which is stored in .meta file
+	dbFile       *os.File     // file to store data
+	numOfBlocks  uint64       // block is like page in cache.
+	sizeOfRecord uint16       // size of the largest record
+	Metadata     *MetaData    // metadata which is stored in .meta file
+	slotsPerPage uint16       // most records a page may hold
+	fsm          *fsm         // room left in every data page, see fsm.go
+	moving       sync.RWMutex // held by readers, alone by vacuum moving records
+	watcher      Watcher      // told about records coming, moving and going
+	garbage      int          // versions deleted since the last sweep
+	sweptAt      uint64       // horizon of the last sweep
+	mu           sync.Mutex   // guards numOfBlocks
 }
 
-var ErrMemTooSmall = errors.New("Mem too small.")
-
-func NewCacher(dbFile *os.File,
-	metaFile *os.File,
-	mem uint16,
-	cols []string,
-	types []string,
-	lens []uint16,
-	nullables []bool,
-	indexes []bool) (*cacher, error) {
-	if mem > MEM_LIT {
-		return nil, ErrMemTooSmall
-	}
-
-	size := getSizeOfFile(dbFile)
-	numOfPages := size / PAGE_SIZE
-	_, sizeOfRecord := calcuOffsetsAndSizeOfRecord(lens)
+var (
+	ErrMemTooSmall = errors.New("Mem too small.")
+	ErrNoSuchPage  = errors.New("The page is not existed.")
+)
 
-	if size == 0 { // no record in dbFile
-		flushInitMetaData(metaFile, cols, types, lens, nullables, indexes)
+// CreateCacher lays the files of a new table out and opens them.
+func CreateCacher(dbFile *os.File, metaFile *os.File, md *MetaData) (*cacher, error) {
+	if err := writeFileHeader(dbFile, DB_MAGIC); err != nil {
+		return nil, err
 	}
 
+	flushInitMetaData(metaFile, md)
+	return NewCacher(dbFile, metaFile)
+}
+
+// NewCacher opens the files of a table, refusing those this build can not
+// read.
+func NewCacher(dbFile *os.File, metaFile *os.File) (*cacher, error) {
 	md, err := getMetaData(metaFile)
 	if err != nil {
 		return nil, errors.New("Failed to Get metadata.")
 	}
 
-	return &cacher{
-		dbFile,
-		uint16(numOfPages),
-		list.New(),
-		mem,
-		sizeOfRecord,
-		md,
-	}, nil
-
-}
+	if err := checkMetaData(metaFile, md); err != nil {
+		return nil, err
+	}
+	if err := checkFileHeader(dbFile, DB_MAGIC, md); err != nil {
+		return nil, err
+	}
 
-func (kacher *cacher) NewPage() (*Pge, error) {
-	maxNumOfRecord := MaxNumOfRecord(kacher.sizeOfRecord)
+	numOfPages := getSizeOfFile(dbFile) / PAGE_SIZE
+	kacher := newCacher(dbFile, md, uint64(numOfPages))
 
-	freeList := list.New()
+	path := strings.TrimSuffix(dbFile.Name(), SUFFIX_DB) + SUFFIX_FSM
+	if kacher.fsm, err = openFSM(path, kacher); err != nil {
+		return nil, err
+	}
+	return kacher, nil
+}
 
-	for i := uint16(0); i < maxNumOfRecord; i++ {
-		freeList.PushBack(i)
+func newCacher(dbFile *os.File, md *MetaData, numOfBlocks uint64) *cacher {
+	return &cacher{
+		dbFile:       dbFile,
+		numOfBlocks:  numOfBlocks,
+		sizeOfRecord: md.SizeOfRecord,
+		Metadata:     md,
+		slotsPerPage: SlotsPerPage(minSizeOfRecord(md.Types, md.Nullables)),
+		fsm:          newFSM(nil),
 	}
+}
 
+func (kacher *cacher) NewPage() (*Pge, error) {
 	neoPage := &Pge{
-		uint16(kacher.numOfBlocks),
-		serializeTheBlockHead(prepareBlockHead(kacher.sizeOfRecord)),
-		maxNumOfRecord,
-		freeList,
-		kacher,
-		0,
+		index:  kacher.numOfBlocks,
+		data:   make([]byte, PAGE_SIZE),
+		kacher: kacher,
 	}
+	neoPage.format()
+	neoPage.syncBlockHead()
 
 	return neoPage, nil
 }
 
-func flushInitMetaData(metaFile *os.File, cols []string,
-	types []string,
-	lens []uint16,
-	nullables []bool,
-	indexes []bool) {
-	offsets, sizeOfRecord := calcuOffsetsAndSizeOfRecord(lens)
-	writeThrough(metaFile,
-		prepareMetaData(cols, lens, types, offsets, nullables, sizeOfRecord, indexes))
+func flushInitMetaData(metaFile *os.File, md *MetaData) {
+	writeThrough(metaFile, prepareMetaData(md))
 }
 
-func prepareMetaData(cols []string,
-	lens []uint16,
-	types []string,
-	offsets []uint16,
-	nullables []bool,
-	sizeOfRecord uint16,
-	indexes []bool) []byte {
-	metaData, err := json.Marshal(&MetaData{
-		0,
-		sizeOfRecord,
-		cols,
-		types,
-		lens,
-		offsets,
-		nullables,
-		indexes,
-	})
+// prepareMetaData returns the .meta of a new table, as md describes it.
+func prepareMetaData(md *MetaData) []byte {
+	created := *md
+	created.Magic = META_MAGIC
+	created.Version = FORMAT_VERSION
+	created.NumOfBlocks = 0
+	created.SizeOfRecord = uint16(sizeOfRecord(md.Types, md.Lens))
+	created.Indexes = make([]bool, len(md.Cols))
+
+	metaData, err := json.Marshal(&created)
 
 	if err != nil {
 		panic(err)
@@ -145,71 +174,10 @@ func getSizeOfFile(file *os.File) int64 {
 
 }
 
-func calcuOffsetsAndSizeOfRecord(lens []uint16) ([]uint16, uint16) {
-	offsets := make([]uint16, len(lens))
-
-	markAndNulls := 1 + uint16(len(lens)) // delete mark and null marks
-	var sizeOfRecord uint16
-
-	if markAndNulls%8 == 0 {
-		sizeOfRecord = markAndNulls % 8
-	} else {
-		sizeOfRecord = markAndNulls/8 + 1
-	}
-
-	if sizeOfRecord%4 != 0 {
-		tmp := sizeOfRecord / 4
-		sizeOfRecord = tmp*4 + 4
-	}
-
-	for i := 0; i < len(lens); i++ {
-		offsets[i] = sizeOfRecord
-
-		if lens[i]%4 == 0 {
-			sizeOfRecord += lens[i]
-		} else {
-			tmp := lens[i] / 4 // remember the padding
-			sizeOfRecord += tmp*4 + 4
-		}
-	}
-
-	return offsets, sizeOfRecord
-}
-
-//func appendFirstBlock(dataFile *os.File, sizeOfRecord uint16) {
-//    writeThrough(dataFile, serializeTheBlockHead(prepareBlockHead(sizeOfRecord)))
-//}
-
-func prepareBlockHead(sizeOfRecord uint16) []uint16 {
-	// NX + 2X + 2 == 4Ki  ==>  X == (4Ki - 2) / (N + 2), Where N is the sizeOfRecord.
-	var MAX_NUM_OF_RECORDS uint16 = MaxNumOfRecord(sizeOfRecord)
-
-	blockHead := make([]uint16, PAGE_SIZE/2)
-	// At first, freelist of block is full.
-	blockHead[0] = uint16(MAX_NUM_OF_RECORDS)
-
-	// build the freelist
-	for i := uint16(0); i < MAX_NUM_OF_RECORDS; i++ {
-		blockHead[i+1] = i
-	}
-
-	return blockHead
-}
-
-func MaxNumOfRecord(sizeOfRecord uint16) uint16 {
-	return (PAGE_SIZE - 2) / (sizeOfRecord + 2)
-}
-
-func serializeTheBlockHead(blockHead []uint16) []byte {
-	buf := new(bytes.Buffer)
-
-	for i := 0; i < len(blockHead); i++ { // serialization
-		if err := binary.Write(buf, binary.LittleEndian, blockHead[i]); err != nil {
-			panic(err)
-		}
-	}
-
-	return buf.Bytes()
+// SlotsPerPage returns how many records of minSize bytes a page holds at
+// most. Record positions are numbered with it.
+func SlotsPerPage(minSize int) uint16 {
+	return uint16((PAGE_SIZE - SIZE_OF_PAGE_HEAD) / (SIZE_OF_SLOT + SIZE_OF_VERSION + minSize))
 }
 
 func writeThrough(file *os.File, byteArr []byte) {
@@ -222,21 +190,32 @@ func writeThrough(file *os.File, byteArr []byte) {
 	}
 }
 
-func writeThroughAt(file *os.File, index uint16, byteArr []byte) {
-	if _, err := file.WriteAt(byteArr, int64(index*PAGE_SIZE)); err != nil {
-		panic(err)
+func writeThroughAt(file *os.File, index uint64, byteArr []byte) error {
+	if _, err := file.WriteAt(byteArr, int64(index)*PAGE_SIZE); err != nil {
+		return err
 	}
 
-	if err := file.Sync(); err != nil {
-		panic(err)
+	return file.Sync()
+}
+
+// readPage reads a page from disk, refusing it if its checksum is wrong.
+func readPage(file *os.File, index uint64) ([]byte, error) {
+	data := make([]byte, PAGE_SIZE)
+	if _, err := file.ReadAt(data, int64(index)*PAGE_SIZE); err != nil {
+		return nil, &CorruptionError{file.Name(), index, err.Error()}
 	}
+
+	if !validChecksum(data) {
+		return nil, &CorruptionError{file.Name(), index, "checksum mismatch"}
+	}
+	return data, nil
 }
 
 func getMetaData(metaDataFile *os.File) (*MetaData, error) {
 	var metaData MetaData
-	var bys []byte
 
-	if _, err := metaDataFile.Read(bys); err != nil {
+	bys, err := ioutil.ReadAll(io.NewSectionReader(metaDataFile, 0, getSizeOfFile(metaDataFile)))
+	if err != nil {
 		return &metaData,
 			errors.New("metaDatafile read failed")
 	}
@@ -246,148 +225,179 @@ func getMetaData(metaDataFile *os.File) (*MetaData, error) {
 			errors.New("Deserialization MetaDataFile failed")
 	}
 
-	return &metaData, nil
-}
-
-func (kacher *cacher) GetPage(pageIndex int16) *Pge {
-	if pageIndex >= int16(kacher.numOfBlocks) {
-		return nil
+	// an index declared with the table is named after its column.
+	for i, index := range metaData.Indexes {
+		if index && metaData.IndexDef(metaData.Cols[i]) == nil {
+			metaData.IndexDefs = append(metaData.IndexDefs,
+				IndexDef{Name: metaData.Cols[i], Cols: []string{metaData.Cols[i]}})
+		}
+		metaData.Indexes[i] = false
 	}
 
-	if pageIndex < 0 {
-		return kacher.selectFromPageList()
-	}
-	return kacher.getSpecificPage(pageIndex)
+	return &metaData, nil
 }
 
-func (kacher *cacher) selectFromPageList() *Pge {
-	// if no Pge exists...
-	if kacher.pages.Len() == 0 {
-		// if no block now...
-		if kacher.numOfBlocks == 0 {
-			page, err := kacher.NewPage()
-			if err != nil {
-				panic(err)
-			}
-
-			kacher.pages.PushBack(page)
-			kacher.numOfBlocks++
-			page.Flush()
-		} else {
-			numOfBlockToFill := kacher.numOfBlocksToFill()
-			for i := 0; i < int(numOfBlockToFill); i++ {
-				page := kacher.loadPageAt(uint16(i))
-				kacher.pages.PushBack(page)
-			}
-		}
+// saveMetaData replaces the .meta file of the table at once.
+func saveMetaData(tableName string, md *MetaData) error {
+	metaData, err := json.Marshal(md)
+	if err != nil {
+		return err
 	}
 
-	maxNumOfFreeList, pgIndex := kacher.choosePage()
-
-	if maxNumOfFreeList != 0 {
-		return kacher.GetPage(int16(pgIndex))
-	}
+	path := tableName + SUFFIX_META
+	os.Remove(path + SUFFIX_NEW)
 
-	page, err := kacher.NewPage()
+	metaFile, err := createFile(path + SUFFIX_NEW)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if uint16(kacher.pages.Len()) == kacher.cacheLimit {
-		page := kacher.pages.Front().Value.(*Pge)
-		page.Flush()
-		kacher.pages.Remove(kacher.pages.Front())
+	if _, err := metaFile.Write(metaData); err != nil {
+		metaFile.Close()
+		return err
 	}
+	if err := metaFile.Sync(); err != nil {
+		metaFile.Close()
+		return err
+	}
+	metaFile.Close()
 
-	kacher.pages.PushBack(page)
-	kacher.numOfBlocks++
-
-	page.Flush()
-	return page
-
+	return os.Rename(path+SUFFIX_NEW, path)
 }
 
-func (kacher *cacher) choosePage() (uint16, uint16) {
-	maxNumOfFreeList := uint16(0)
-	pgIndex := uint16(0)
-	for page := kacher.pages.Front(); page != nil; page = page.Next() {
-		pageInCache := page.Value.(*Pge)
-		if pageInCache.numOfFreeList > maxNumOfFreeList {
-			maxNumOfFreeList = pageInCache.numOfFreeList
-			pgIndex = pageInCache.index
-		}
+// GetPage returns the page pinned, the caller must Unpin it when done.
+func (kacher *cacher) GetPage(pgNo uint64) (*Pge, error) {
+	if pgNo < FIRST_PAGE || pgNo >= kacher.NumOfBlocks() {
+		return nil, ErrNoSuchPage
 	}
 
-	return maxNumOfFreeList, pgIndex
+	return sharedPool.fetch(kacher.dbFile.Name(), pgNo, kacher.loadPageAt)
 }
 
-func (kacher *cacher) numOfBlocksToFill() uint16 {
-	if kacher.numOfBlocks > kacher.cacheLimit {
-		return uint16(kacher.cacheLimit)
-	}
+func (kacher *cacher) Unpin(page *Pge) {
+	sharedPool.unpin(kacher.dbFile.Name(), page)
+}
+
+func (kacher *cacher) NumOfBlocks() uint64 {
+	kacher.mu.Lock()
+	defer kacher.mu.Unlock()
 
-	return uint16(kacher.numOfBlocks)
+	return kacher.numOfBlocks
 }
 
-func (kacher *cacher) loadPageAt(index uint16) *Pge {
-	data := make([]byte, PAGE_SIZE)
-	kacher.dbFile.ReadAt(data, int64(index)*PAGE_SIZE)
-	buf := bytes.NewReader(data)
+// hasRoom reports whether the free-space map knows a page with room for a
+// tuple of size bytes.
+func (kacher *cacher) hasRoom(size int) bool {
+	_, ok := kacher.fsm.find(size)
+	return ok
+}
 
-	var numOfFreeList uint16
-	binary.Read(buf, binary.BigEndian, &numOfFreeList)
+// GetPageFor returns a page with room for a tuple of size bytes pinned,
+// allocating one if no page has enough. An entry of the free-space map found
+// wrong on the page is put right.
+func (kacher *cacher) GetPageFor(size int) (*Pge, error) {
+	path := kacher.dbFile.Name()
+
+	for {
+		pgNo, ok := kacher.fsm.find(size)
+		if !ok {
+			kacher.mu.Lock()
+			defer kacher.mu.Unlock()
+			return kacher.appendPage()
+		}
 
-	freeList := list.New()
-	for i := 0; i < int(numOfFreeList); i++ {
-		var item uint16
-		binary.Read(buf, binary.BigEndian, &item)
-		freeList.PushBack(item)
-	}
+		page, err := sharedPool.fetch(path, pgNo, kacher.loadPageAt)
+		if err != nil {
+			return nil, err
+		}
 
-	return &Pge{
-		index:         index,
-		data:          data,
-		numOfFreeList: numOfFreeList,
-		freeList:      freeList,
-		kacher:        kacher,
+		page.latch.RLock()
+		room := page.room()
+		page.latch.RUnlock()
+
+		if size <= room {
+			return page, nil
+		}
+		kacher.fsm.set(pgNo, room)
+		sharedPool.unpin(path, page)
 	}
 }
 
-func (kacher *cacher) getSpecificPage(pageIndex int16) *Pge {
-	if kacher.pages.Len() == 0 { // if there is no Pge in cache
+// allocPage returns an empty page pinned, for an overflow chain. A page
+// given back before is reused if it is still free.
+func (kacher *cacher) allocPage() (*Pge, error) {
+	page, err := kacher.freePageBefore(NO_PAGE)
+	if err != nil || page != nil {
+		return page, err
+	}
+
+	kacher.mu.Lock()
+	defer kacher.mu.Unlock()
+	return kacher.appendPage()
+}
 
-		numOfBlockToFill := kacher.numOfBlocksToFill()
+// freePageBefore takes the first page before end given back by an overflow
+// chain, pinned, or nil if there is none.
+func (kacher *cacher) freePageBefore(end uint64) (*Pge, error) {
+	path := kacher.dbFile.Name()
 
-		for i := 0; i < int(numOfBlockToFill); i++ {
-			page := kacher.loadPageAt(uint16(i))
-			kacher.pages.PushBack(page)
+	for {
+		pgNo, ok := kacher.fsm.takeFree(end)
+		if !ok {
+			return nil, nil
 		}
-	}
 
-	// if Pge is already in cache.
-	for e := kacher.pages.Front(); e != nil; e = e.Next() {
+		page, err := sharedPool.fetch(path, pgNo, kacher.loadPageAt)
+		if err != nil {
+			return nil, err
+		}
 
-		pageInCache := e.Value.(*Pge)
+		// a rollback may have taken the page back.
+		page.latch.RLock()
+		free := page.kind() == PAGE_FREE
+		page.latch.RUnlock()
 
-		if int16(pageInCache.index) == pageIndex {
-			kacher.pages.MoveToBack(e)
+		if free {
+			return page, nil
 		}
+		sharedPool.unpin(path, page)
+	}
+}
 
-		return e.Value.(*Pge)
+// giveBackPage keeps a page an overflow chain gave back for the next one,
+// in the free-space map so that it outlives a restart.
+func (kacher *cacher) giveBackPage(pgNo uint64) {
+	kacher.fsm.giveBack(pgNo)
+}
+
+// appendPage adds an empty page to the end of the file and returns it
+// pinned. mu must be held.
+func (kacher *cacher) appendPage() (*Pge, error) {
+	page, err := kacher.NewPage()
+	if err != nil {
+		return nil, err
 	}
 
-	// add the Page into lru cache.
-	if uint16(kacher.pages.Len()) == kacher.cacheLimit {
+	if err := sharedPool.add(kacher.dbFile.Name(), page); err != nil {
+		return nil, err
+	}
 
-		leastUsed := kacher.pages.Front().Value.(*Pge)
-		leastUsed.Flush()
+	kacher.numOfBlocks++
+	return page, nil
+}
 
-		kacher.pages.Remove(kacher.pages.Front())
+// loadPageAt reads a page from disk for the pool, which holds its mu.
+func (kacher *cacher) loadPageAt(index uint64) (*Pge, error) {
+	data, err := readPage(kacher.dbFile, index)
+	if err != nil {
+		return nil, err
 	}
 
-	page := kacher.loadPageAt(uint16(pageIndex))
-	kacher.pages.PushBack(page)
-	page.Flush()
+	page := &Pge{
+		index:  index,
+		kacher: kacher,
+	}
+	page.load(data)
 
-	return page
+	return page, nil
 }
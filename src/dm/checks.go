@@ -0,0 +1,29 @@
+package dm
+
+import "../sql/parser/statements"
+
+// CHECK与DEFAULT：.meta中记着各列DEFAULT的文本和各CHECK的表达式文本，
+// 打开表时由ds解析。CHECK的表达式与WHERE一样求值，只有为假时才不成立，
+// 不真也不假时仍然成立。
+
+// Check keeps the records of a table to those for which Expr, written as in
+// a WHERE, is not false.
+type Check struct {
+	Name string
+	Expr string
+}
+
+// DefaultOf returns the text of the DEFAULT of the column i, empty if it
+// has none.
+func (md *MetaData) DefaultOf(i int) string {
+	if i >= len(md.Defaults) {
+		return ""
+	}
+	return md.Defaults[i]
+}
+
+// Satisfies reports whether the values of a record don't make expr false.
+func (md *MetaData) Satisfies(values []interface{}, expr statements.Expr) (bool, error) {
+	v, err := md.Eval(values, expr)
+	return v != false, err
+}
@@ -1,24 +1,21 @@
 package dm
 
 import (
-	"../sql/lexer"
 	"../sql/parser/statements"
 	"encoding/binary"
 	"errors"
-	"math"
 	"os"
 )
 
-// 早期为了简化设计，使用定长记录。
-// 文件头目前只存储块数。
-// 块头目前只存放Freelist。
+// 记录按变长编码存放在分槽页中，见page.go和record.go。
+// 文件头页见header.go。
 
 type (
 	DataManager interface {
-		Insert(data []byte) error
-		Update(data []byte, uniPos uint) error
-		Delete(uniPos uint) error
-		Retrieve(uniPos uint) ([]byte, error)
+		Insert(txn *Txn, data []byte) (RID, error)
+		Update(txn *Txn, data []byte, rid RID) (RID, error)
+		Delete(txn *Txn, rid RID) error
+		Retrieve(txn *Txn, rid RID) ([]byte, error)
 		Boom() error
 	}
 
@@ -26,9 +23,39 @@ type (
 		TableName string
 		Kacher    *cacher
 	}
+
+	// Watcher follows the records of a table as they come, move or go away
+	// for good, as an index does. data is the record with its values in line.
+	// Deleted is told of a record txn deleted, with the new version if it was
+	// updated, or nil.
+	Watcher interface {
+		Inserted(txn *Txn, data []byte, rid RID) error
+		Deleted(txn *Txn, data []byte, rid RID, replacement []byte) error
+		Moved(txn *Txn, data []byte, from RID, to RID) error
+		Reclaimed(txn *Txn, data []byte, rid RID) error
+	}
 )
 
-func Create(tableName string, cols []string, types []string, lens []uint16, nullables []bool, indexes []bool) (*DM, error) {
+var ErrNoSuchTable = errors.New("No Such Table.")
+
+// Create lays a new table out as md describes it: its cols, their types,
+// lens and nullables, its indexes, FOREIGN KEYs, DEFAULTs and CHECKs. The
+// rest of md is filled in.
+func Create(tableName string, md *MetaData) (*DM, error) {
+	if err := openLog(); err != nil {
+		return nil, err
+	}
+
+	n := len(md.Cols)
+	if len(md.Types) != n || len(md.Lens) != n || len(md.Nullables) != n ||
+		len(md.Defaults) != 0 && len(md.Defaults) != n {
+		return nil, ErrWrongValues
+	}
+
+	if sizeOfRecord(md.Types, md.Lens) > MAX_SIZE_OF_RECORD {
+		return nil, ErrRecordTooLarge
+	}
+
 	metaDataFile, err := createFile(tableName + SUFFIX_META)
 	if err != nil {
 		return nil, errors.New("Failed to create mdFile.")
@@ -39,14 +66,7 @@ func Create(tableName string, cols []string, types []string, lens []uint16, null
 		return nil, errors.New("Failed to create dataFile.")
 	}
 
-	kacher, err := NewCacher(dataFile,
-		metaDataFile,
-		50,
-		cols,
-		types,
-		lens,
-		nullables,
-		indexes)
+	kacher, err := CreateCacher(dataFile, metaDataFile, md)
 	if err != nil {
 		return nil, errors.New("Failed to create db.")
 	}
@@ -58,18 +78,26 @@ func Create(tableName string, cols []string, types []string, lens []uint16, null
 }
 
 func Open(tableName string) (*DM, error) {
+	if err := openLog(); err != nil {
+		return nil, err
+	}
+
+	if err := upgrade(tableName); err != nil {
+		return nil, err
+	}
+
 	metaDataFile, err := openFile(tableName + SUFFIX_META)
 	if err != nil {
-		return nil, errors.New("Unable to Open mdFile.")
+		return nil, ErrNoSuchTable
 	}
 	dataFile, err := openFile(tableName + SUFFIX_DB)
 	if err != nil {
 		return nil, errors.New("Unable to Open dataFile")
 	}
 
-	kacher, err := NewCacher(dataFile, metaDataFile, 50, nil, nil, nil, nil, nil)
+	kacher, err := NewCacher(dataFile, metaDataFile)
 	if err != nil {
-		return nil, errors.New("Unable to New Cacher")
+		return nil, err
 	}
 
 	return &DM{
@@ -78,378 +106,574 @@ func Open(tableName string) (*DM, error) {
 	}, nil
 }
 
+// Watch makes w follow the records of the table.
+func (dm DM) Watch(w Watcher) {
+	dm.Kacher.watcher = w
+}
+
 func (dm DM) Boom() error {
+	sharedPool.discard(dm.Kacher.dbFile.Name())
+
+	dm.Kacher.fsm.close()
+	if err := os.Remove(dm.TableName + SUFFIX_FSM); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	if err := os.Remove(dm.TableName + SUFFIX_DB); err != nil {
 		return err
 	}
 
-	return os.Remove(dm.TableName + SUFFIX_DB)
+	return os.Remove(dm.TableName + SUFFIX_META)
 }
 
-func (dm DM) Insert(data []byte) (uint16, error) {
-	if uint16(len(data)) != dm.Kacher.sizeOfRecord {
-		return 0, errors.New("data to insert has a wrong format.")
+func (dm DM) Insert(txn *Txn, data []byte) (RID, error) {
+	if err := txn.LockForWrite(); err != nil {
+		return RID{}, err
 	}
+	return dm.insert(txn, data)
+}
 
-	page := dm.Kacher.GetPage(-1)
-	defer page.Flush()
+// InsertAll inserts the records of one statement, all of them or none.
+func (dm DM) InsertAll(txn *Txn, records [][]byte) ([]RID, error) {
+	if err := txn.LockForWrite(); err != nil {
+		return nil, err
+	}
 
-	freelist := page.FreeList()
-	pos := freelist.Front()
+	savepoint := txn.Savepoint()
+	rids := make([]RID, 0, len(records))
+	for _, data := range records {
+		rid, err := dm.insert(txn, data)
+		if err != nil {
+			txn.RollbackTo(savepoint)
+			return nil, err
+		}
+		rids = append(rids, rid)
+	}
+	return rids, nil
+}
+
+// insert stores data as a record of txn, which holds the write lock.
+func (dm DM) insert(txn *Txn, data []byte) (RID, error) {
+	// sweep dead versions before the table grows.
+	grows := len(data) > TOAST_THRESHOLD || !dm.Kacher.hasRoom(SIZE_OF_VERSION+len(data))
+	if dm.Kacher.garbage > 0 && grows && horizon() > dm.Kacher.sweptAt {
+		if _, err := dm.CollectGarbage(txn); err != nil {
+			return RID{}, err
+		}
+	}
 
-	if pos.Value.(uint16) > page.maxPos {
-		page.maxPos = pos.Value.(uint16)
+	toasted, err := dm.toast(txn, data)
+	if err != nil {
+		return RID{}, err
 	}
 
-	page.numOfFreeList--
-	page.freeList.Remove(freelist.Front())
+	tuple := make([]byte, SIZE_OF_VERSION+len(toasted))
+	binary.BigEndian.PutUint64(tuple[0:], txn.id)
+	copy(tuple[SIZE_OF_VERSION:], toasted)
 
-	page.UpdateWith(data, pos.Value.(uint16))
-	maxRecordOfPage := (PAGE_SIZE - 2) / (dm.Kacher.sizeOfRecord + 2)
-	return page.index*maxRecordOfPage + pos.Value.(uint16), nil
+	rid, err := dm.place(txn, tuple)
+	if err != nil {
+		return RID{}, err
+	}
+
+	if w := dm.Kacher.watcher; w != nil {
+		if err := w.Inserted(txn, data, rid); err != nil {
+			return RID{}, err
+		}
+	}
+	return rid, nil
 }
 
-func (dm DM) Update(data []byte, uniPos uint16) error {
-	if uint16(len(data)) != dm.Kacher.sizeOfRecord {
-		return errors.New("data to update has a wrong format.")
+// place stores the tuple in a page with room for it.
+func (dm DM) place(txn *Txn, tuple []byte) (RID, error) {
+	page, err := dm.Kacher.GetPageFor(len(tuple))
+	if err != nil {
+		return RID{}, err
+	}
+	defer dm.Kacher.Unpin(page)
+
+	page.latch.Lock()
+	defer page.latch.Unlock()
+
+	before := page.image()
+
+	slot, ok := page.insert(tuple)
+	if !ok {
+		return RID{}, errors.New("No room for the record.")
 	}
 
-	pgNo := uniPos / MaxNumOfRecord(dm.Kacher.sizeOfRecord)
-	relativePos := uniPos % MaxNumOfRecord(dm.Kacher.sizeOfRecord)
-	page := dm.Kacher.GetPage(int16(pgNo))
+	if err := txn.write(page, before); err != nil {
+		return RID{}, err
+	}
 
-	for e := page.freeList.Front(); e != nil; e = e.Next() {
-		if e.Value == relativePos {
-			return errors.New("The Pos to update is deleted.")
-		}
+	return RID{page.index, slot}, nil
+}
+
+// Update writes data as a new version of the record and returns its RID.
+func (dm DM) Update(txn *Txn, data []byte, rid RID) (RID, error) {
+	old, err := dm.stamp(txn, rid)
+	if err != nil {
+		return RID{}, err
 	}
 
-	defer page.Flush()
-	page.UpdateWith(data, relativePos)
-	return nil
+	to, err := dm.Insert(txn, data)
+	if err != nil {
+		return RID{}, err
+	}
+
+	if w := dm.Kacher.watcher; w != nil {
+		if err := w.Deleted(txn, old, rid, data); err != nil {
+			return RID{}, err
+		}
+	}
+	return to, nil
 }
 
-func (dm DM) UpdateBy(where *statements.Where, col string, value interface{}) string {
+// UpdateBy gives the records where selects the values of sets, computed on
+// each record as it was.
+func (dm DM) UpdateBy(txn *Txn, where *statements.Where, sets []statements.Assignment) string {
 	md := dm.Kacher.Metadata
 
-	index := -1
-	for i, c := range md.Cols {
-		if c == col {
-			index = i
+	cols := make([]int, len(sets))
+	for k, set := range sets {
+		index := -1
+		for i, c := range md.Cols {
+			if c == set.Col {
+				index = i
+			}
+		}
+
+		if index == -1 {
+			return "No such col"
+		}
+		for _, other := range cols[:k] {
+			if other == index {
+				return "The col " + set.Col + " is set twice."
+			}
+		}
+		cols[k] = index
+
+		tp, err := md.TypeOf(set.Value)
+		if err != nil {
+			return err.Error()
+		}
+		if !md.Fits(index, tp) {
+			return "Wrong type for " + set.Col
 		}
 	}
 
-	if index == -1 {
-		return "No such col"
+	if err := md.CheckWhere(where); err != nil {
+		return err.Error()
 	}
 
-	numOfBlocks := dm.Kacher.numOfBlocks
+	if err := txn.LockForWrite(); err != nil {
+		return err.Error()
+	}
 
-	for i := 0; i < int(numOfBlocks); i++ {
-		page := dm.Kacher.GetPage(int16(i))
+	// collect first, the new versions must not be visited again.
+	rids, records := make([]RID, 0), make([][]byte, 0)
+	var failed error
+	err := dm.scan(txn, func(rid RID, data []byte) {
+		if where != nil {
+			ok, err := dm.valid(data, *where)
+			if err != nil {
+				failed = err
+			}
+			if !ok {
+				return
+			}
+		}
+		rids = append(rids, rid)
+		records = append(records, data)
+	})
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		return err.Error()
+	}
 
-		for pos := 0; pos < int(page.maxPos); i++ {
-			begin := int(page.SizeOfBlockHead()) + pos*int(page.kacher.sizeOfRecord)
-			data := page.data[begin : begin+int(page.kacher.sizeOfRecord)]
+	for i, data := range records {
+		values, err := md.DecodeRecord(data)
+		if err != nil {
+			return err.Error()
+		}
 
-			if data[0]&0x80 != 0 {
-				tok := value.(lexer.Token)
-				switch tok.TypeInfo {
-				case "INT":
-					bts := make([]byte, 2)
-					binary.BigEndian.PutUint16(bts, tok.Value.(uint16))
-					copy(data[int(md.Offsets[i]):], bts)
-				case "DOUBLE":
-					bts := make([]byte, 4)
-					binary.BigEndian.PutUint64(bts, math.Float64bits(tok.Value.(float64)))
-					copy(data[int(md.Offsets[i]):], bts)
-				case "STRING":
-					bts := make([]byte, int(md.Lens[i]))
-					copy(bts[:],tok.Value.(string))
-					copy(data[int(md.Offsets[i]):], bts)
-				}
-				dm.Update(data, page.index * MaxNumOfRecord(md.SizeOfRecord) + uint16(pos))
+		// every value is computed before any is written.
+		computed := make([]interface{}, len(sets))
+		for k, set := range sets {
+			if computed[k], err = md.Eval(values, set.Value); err != nil {
+				return err.Error()
 			}
 		}
+		for k, index := range cols {
+			if values[index], err = md.Assign(index, computed[k]); err != nil {
+				return err.Error()
+			}
+		}
+
+		if data, err = md.EncodeRecord(values); err != nil {
+			return err.Error()
+		}
+
+		if _, err := dm.Update(txn, data, rids[i]); err != nil {
+			return err.Error()
+		}
 	}
 
 	return "OK!"
 
 }
 
-func (dm DM) Delete(uniPos uint16) error {
-	pgNo := uniPos / MaxNumOfRecord(dm.Kacher.sizeOfRecord)
+var ErrDeleted = errors.New("The Pos to deleted has been deleted.")
 
-	if uint16(pgNo) >= dm.Kacher.numOfBlocks {
-		return errors.New("The pos is not existed")
+// Delete stamps the record as deleted by txn. The slot is given back by
+// CollectGarbage once no snapshot can see the record anymore.
+func (dm DM) Delete(txn *Txn, rid RID) error {
+	data, err := dm.stamp(txn, rid)
+	if err != nil {
+		return err
 	}
 
-	page := dm.Kacher.GetPage(int16(pgNo))
+	if w := dm.Kacher.watcher; w != nil {
+		return w.Deleted(txn, data, rid, nil)
+	}
+	return nil
+}
 
-	relativePos := uniPos % MaxNumOfRecord(page.kacher.sizeOfRecord)
+// stamp marks the record as deleted by txn and returns it.
+func (dm DM) stamp(txn *Txn, rid RID) ([]byte, error) {
+	if rid.PgNo >= dm.Kacher.NumOfBlocks() {
+		return nil, errors.New("The pos is not existed")
+	}
 
-	// check if pos is in freelist
-	for e := page.freeList.Front(); e != nil; e = e.Next() {
-		if e.Value == relativePos {
-			return errors.New("The Pos to deleted has been deleted.")
-		}
+	if err := txn.LockForWrite(); err != nil {
+		return nil, err
 	}
 
-	defer page.Flush()
+	page, err := dm.Kacher.GetPage(rid.PgNo)
+	if err != nil {
+		return nil, err
+	}
+	defer dm.Kacher.Unpin(page)
 
-	page.MarkDeleteOn(relativePos)
+	page.latch.Lock()
 
-	page.freeList.PushBack(relativePos)
-	return nil
-}
+	if page.IsFree(rid.Slot) || !txn.sees(page.versionOf(rid.Slot)) {
+		page.latch.Unlock()
+		return nil, ErrDeleted
+	}
 
-func (dm DM) DeleteBy(where statements.Where) error {
-	numOfBlocks := dm.Kacher.numOfBlocks
+	record := page.record(rid.Slot)
+	data := make([]byte, len(record))
+	copy(data, record)
 
-	for i := 0; i < int(numOfBlocks); i++ {
-		page := dm.Kacher.GetPage(int16(i))
+	before := page.image()
 
-		for pos := 0; pos < int(page.maxPos); i++ {
-			begin := int(page.SizeOfBlockHead()) + pos*int(page.kacher.sizeOfRecord)
-			data := page.data[begin : begin+int(page.kacher.sizeOfRecord)]
+	page.stampXmax(rid.Slot, txn.id)
+	dm.Kacher.garbage++
+	err = txn.write(page, before)
+	page.latch.Unlock()
 
-			if data[0]&0x80 != 0 {
-				if dm.valid(data, where) {
-					pos := page.index *
-						MaxNumOfRecord(dm.Kacher.Metadata.SizeOfRecord)
+	if err != nil {
+		return nil, err
+	}
+	return dm.detoast(data)
+}
 
-					if err := dm.Delete(pos); err != nil {
-						return errors.New("")
-					}
-				}
+func (dm DM) DeleteBy(txn *Txn, where *statements.Where) error {
+	if err := dm.Kacher.Metadata.CheckWhere(where); err != nil {
+		return err
+	}
+
+	if err := txn.LockForWrite(); err != nil {
+		return err
+	}
 
+	rids := make([]RID, 0)
+	var failed error
+	err := dm.scan(txn, func(rid RID, data []byte) {
+		if where != nil {
+			ok, err := dm.valid(data, *where)
+			if err != nil {
+				failed = err
+			}
+			if !ok {
+				return
 			}
 		}
+		rids = append(rids, rid)
+	})
+	if err == nil {
+		err = failed
 	}
-	return nil
-}
-
-func DeleteAll(dm DM) error {
-	os.Remove(dm.TableName + SUFFIX_DB)
-	os.Remove(dm.TableName + SUFFIX_META)
-	md := dm.Kacher.Metadata
-	d, err := Create(dm.TableName, md.Cols, md.Types, md.Lens, md.Nullables, md.Indexes)
-	dm = *d
 	if err != nil {
-		return errors.New("Unable to Create Table.")
+		return err
+	}
+
+	// a FOREIGN KEY may have deleted some of them already.
+	for _, rid := range rids {
+		if err := dm.Delete(txn, rid); err != nil && err != ErrDeleted {
+			return err
+		}
 	}
 	return nil
 }
 
-func (dm DM) RetrieveAll() [][]byte {
-	arrs := make([][]byte, 0)
+// CollectGarbage gives back the slots and overflow pages of versions deleted
+// by a committed transaction which no snapshot can see anymore.
+func (dm DM) CollectGarbage(txn *Txn) (int, error) {
+	if err := txn.LockForWrite(); err != nil {
+		return 0, err
+	}
+
+	oldest := horizon()
+	reclaimed := 0
+
+	numOfBlocks := dm.Kacher.NumOfBlocks()
+	for i := uint64(FIRST_PAGE); i < numOfBlocks; i++ {
+		page, err := dm.Kacher.GetPage(i)
+		if err != nil {
+			return reclaimed, err
+		}
+		page.latch.Lock()
 
-	numOfBlocks := dm.Kacher.numOfBlocks
-	for i := 0; i < int(numOfBlocks); i++ {
-		page := dm.Kacher.GetPage(int16(i))
+		free := page.kind() == PAGE_FREE
 
-		for pos := 0; pos < int(page.maxPos); pos++ {
-			begin := int(page.SizeOfBlockHead()) + pos*int(page.kacher.sizeOfRecord)
-			data := page.data[begin : begin+int(page.kacher.sizeOfRecord)]
+		before := page.image()
+		dead := 0
+		overflows := make([]uint64, 0)
+		rids, records := make([]RID, 0), make([][]byte, 0)
 
-			if data[0]&0x80 != 0 {
-				arrs = append(arrs, data)
+		for pos := page.numOfSlots(); pos > 0; pos-- {
+			if page.IsFree(pos - 1) {
+				continue
 			}
-		}
-	}
 
-	return arrs
-}
+			_, xmax := page.versionOf(pos - 1)
+			if xmax == 0 || xmax >= oldest || xmax == txn.id {
+				continue
+			}
 
-func (dm DM) RetrieveBy(where statements.Where) [][]byte {
-	arrs := make([][]byte, 0)
+			firsts, err := dm.Kacher.Metadata.overflowsOf(page.record(pos - 1))
+			if err == nil {
+				overflows = append(overflows, firsts...)
+			}
+
+			if dm.Kacher.watcher != nil {
+				record := make([]byte, len(page.record(pos-1)))
+				copy(record, page.record(pos-1))
+				rids, records = append(rids, RID{i, pos - 1}), append(records, record)
+			}
+
+			page.free(pos - 1)
+			dead++
+		}
+
+		if dead > 0 {
+			err = txn.write(page, before)
+		}
 
-	numOfBlocks := dm.Kacher.numOfBlocks
+		page.latch.Unlock()
+		dm.Kacher.Unpin(page)
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += dead
 
-	for i := 0; i < int(numOfBlocks); i++ {
-		page := dm.Kacher.GetPage(int16(i))
+		if free {
+			dm.Kacher.giveBackPage(i)
+		}
 
-		for pos := 0; pos < int(page.maxPos); i++ {
-			begin := int(page.SizeOfBlockHead()) + pos*int(page.kacher.sizeOfRecord)
-			data := page.data[begin : begin+int(page.kacher.sizeOfRecord)]
+		// the values kept out of line are still there to be read.
+		for j, record := range records {
+			data, err := dm.detoast(record)
+			if err == nil {
+				err = dm.Kacher.watcher.Reclaimed(txn, data, rids[j])
+			}
+			if err != nil {
+				return reclaimed, err
+			}
+		}
 
-			if data[0]&0x80 != 0 {
-				if dm.valid(data, where) {
-					arrs = append(arrs, data)
-				}
+		for _, first := range overflows {
+			if err := dm.freeOverflow(txn, first); err != nil {
+				return reclaimed, err
 			}
 		}
 	}
 
-	return arrs
+	dm.Kacher.garbage -= reclaimed
+	if dm.Kacher.garbage < 0 {
+		dm.Kacher.garbage = 0
+	}
+	dm.Kacher.sweptAt = oldest
+	return reclaimed, nil
 }
 
-func (dm DM) valid(data []byte, where statements.Where) bool {
-	conds := where.Expr.Conditions
-	md := dm.Kacher.Metadata
+// scan calls fn with a copy of every record visible to txn. fn runs without
+// any latch held, so it may change the table.
+func (dm DM) scan(txn *Txn, fn func(rid RID, data []byte)) error {
+	return dm.scanVersions(txn.sees, func(rid RID, data []byte) error {
+		fn(rid, data)
+		return nil
+	})
+}
 
-	for _, cond := range conds {
-		var col string
-		var val uint16
-		var fval float64
-		var sval string
+// scanVersions calls fn with a copy of every version keep accepts.
+func (dm DM) scanVersions(keep func(xmin uint64, xmax uint64) bool, fn func(rid RID, data []byte) error) error {
+	dm.Kacher.moving.RLock()
+	defer dm.Kacher.moving.RUnlock()
 
-		lVal := cond.LVal.Value.(lexer.Token)
-		rVal := cond.RVal.Value.(lexer.Token)
+	numOfBlocks := dm.Kacher.NumOfBlocks()
 
-		if lVal.TypeInfo != "IDENTIFIER" || rVal.TypeInfo != "IDENTIFIER" {
-			return false
+	for i := uint64(FIRST_PAGE); i < numOfBlocks; i++ {
+		page, err := dm.Kacher.GetPage(i)
+		if err != nil {
+			return err
 		}
 
-		if !IsValue(lVal.Value.(string)) && !IsValue(rVal.Value.(string)) {
-			return false
-		}
+		rids, records := make([]RID, 0), make([][]byte, 0)
 
-		if lVal.TypeInfo == "IDENTIFIER" {
-			col = lVal.Value.(string)
-			switch rVal.TypeInfo {
-			case "INT":
-				val = rVal.Value.(uint16)
-			case "DOUBLE":
-				fval = rVal.Value.(float64)
-			case "STRING":
-				sval = rVal.Value.(string)
-			}
-		} else {
-			col = rVal.Value.(string)
-			switch lVal.TypeInfo {
-			case "INT":
-				val = lVal.Value.(uint16)
-			case "DOUBLE":
-				fval = lVal.Value.(float64)
-			case "STRING":
-				sval = lVal.Value.(string)
+		page.latch.RLock()
+		for pos := uint16(0); pos < page.numOfSlots(); pos++ {
+			if page.IsFree(pos) || !keep(page.versionOf(pos)) {
+				continue
 			}
+
+			record := page.record(pos)
+			data := make([]byte, len(record))
+			copy(data, record)
+
+			rids = append(rids, RID{page.index, pos})
+			records = append(records, data)
 		}
+		page.latch.RUnlock()
+		dm.Kacher.Unpin(page)
 
-		var index int
-		for i, c := range md.Cols {
-			if c == col {
-				index = i
-				break
+		for j, data := range records {
+			if data, err = dm.detoast(data); err != nil {
+				return err
+			}
+			if err := fn(rids[j], data); err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
 
-		tp := md.Types[index]
-
-		if tp == "INT" {
-			parsedVal := binary.BigEndian.Uint16(data[md.Offsets[index] : md.Offsets[index]+2])
-			switch cond.Op.Op {
-			case "==":
-				if parsedVal != val {
-					return false
-				}
-
-			case ">=":
-				if lVal.TypeInfo == "INT" && val < parsedVal {
-					return false
-				} else if parsedVal < val {
-					return false
-				}
-			case "<=":
-				if lVal.TypeInfo == "INT" && val > parsedVal {
-					return false
-				} else if parsedVal > val {
-					return false
-				}
-
-			case ">":
-				if lVal.TypeInfo == "INT" && val <= parsedVal {
-					return false
-				} else if parsedVal < val {
-					return false
-				}
-			case "<":
-				if lVal.TypeInfo == "INT" && val >= parsedVal {
-					return false
-				} else if parsedVal >= val {
-					return false
-				}
-			}
+func DeleteAll(dm DM) error {
+	os.Remove(dm.TableName + SUFFIX_DB)
+	os.Remove(dm.TableName + SUFFIX_META)
+	d, err := Create(dm.TableName, dm.Kacher.Metadata)
+	if err != nil {
+		return errors.New("Unable to Create Table.")
+	}
+	dm = *d
+	return nil
+}
 
-		} else if tp == "DOUBLE" {
-			parsedVal := float64(binary.BigEndian.Uint64(data[md.Offsets[index] : md.Offsets[index]+4]))
-
-			switch cond.Op.Op {
-			case "==":
-				if parsedVal != fval {
-					return false
-				}
-
-			case ">=":
-				if lVal.TypeInfo == "DOUBLE" && fval < parsedVal {
-					return false
-				} else if parsedVal < fval {
-					return false
-				}
-			case "<=":
-				if lVal.TypeInfo == "DOUBLE" && fval > parsedVal {
-					return false
-				} else if parsedVal > fval {
-					return false
-				}
-
-			case ">":
-				if lVal.TypeInfo == "DOUBLE" && fval <= parsedVal {
-					return false
-				} else if parsedVal < fval {
-					return false
-				}
-			case "<":
-				if lVal.TypeInfo == "DOUBLE" && fval >= parsedVal {
-					return false
-				} else if parsedVal >= fval {
-					return false
-				}
-			}
+func (dm DM) RetrieveAll(txn *Txn) ([][]byte, error) {
+	arrs := make([][]byte, 0)
 
-		} else {
-			parsedVal := string(data[md.Offsets[index] : md.Offsets[index]+md.Lens[index]])
+	err := dm.scan(txn, func(rid RID, data []byte) {
+		arrs = append(arrs, data)
+	})
 
-			if cond.Op.Op != "==" {
-				return false
-			}
+	return arrs, err
+}
 
-			if parsedVal != sval {
-				return false
-			}
+func (dm DM) RetrieveBy(txn *Txn, where statements.Where) ([][]byte, error) {
+	arrs := make([][]byte, 0)
+
+	var failed error
+	err := dm.scan(txn, func(rid RID, data []byte) {
+		ok, err := dm.valid(data, where)
+		if err != nil {
+			failed = err
+		}
+		if ok {
+			arrs = append(arrs, data)
+		}
+	})
+	if err == nil {
+		err = failed
+	}
+
+	return arrs, err
+}
+
+// RetrieveFound returns the records at the positions find gives, which are
+// visible to txn and satisfy where. The records can't move in between, find
+// may look the positions up in an index.
+func (dm DM) RetrieveFound(txn *Txn, find func() ([]RID, error), where statements.Where) ([][]byte, error) {
+	dm.Kacher.moving.RLock()
+	defer dm.Kacher.moving.RUnlock()
+
+	rids, err := find()
+	if err != nil {
+		return nil, err
+	}
+
+	arrs := make([][]byte, 0)
+	for _, rid := range rids {
+		data, err := dm.fetch(txn, rid)
+		if err == errInvisible {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
 
+		ok, err := dm.valid(data, where)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			arrs = append(arrs, data)
+		}
 	}
-	return true
+	return arrs, nil
 }
 
-func IsValue(s string) bool {
-	return s == "INT" || s == "DOUBLE" || s == "STRING"
+func (dm DM) Retrieve(txn *Txn, rid RID) ([]byte, error) {
+	dm.Kacher.moving.RLock()
+	defer dm.Kacher.moving.RUnlock()
+
+	data, err := dm.fetch(txn, rid)
+	if err == errInvisible {
+		return nil, errors.New("The Pos to Retrieve has been deleted.")
+	}
+	return data, err
 }
 
-func (dm DM) Retrieve(uniPos uint16) ([]byte, error) {
-	pgNo := uniPos / MaxNumOfRecord(dm.Kacher.sizeOfRecord)
-	if uint16(pgNo) >= dm.Kacher.numOfBlocks {
+var errInvisible = errors.New("The record is not visible.")
+
+// fetch returns the record at rid, if txn sees it. moving must be held.
+func (dm DM) fetch(txn *Txn, rid RID) ([]byte, error) {
+	if rid.PgNo >= dm.Kacher.NumOfBlocks() {
 		return nil, errors.New("The pos is not existed")
 	}
 
-	page := dm.Kacher.GetPage(int16(pgNo))
+	page, err := dm.Kacher.GetPage(rid.PgNo)
+	if err != nil {
+		return nil, err
+	}
+	defer dm.Kacher.Unpin(page)
 
-	relativePos := uniPos % MaxNumOfRecord(page.kacher.sizeOfRecord)
+	page.latch.RLock()
 
-	// check if pos is in freelist
-	for e := page.freeList.Front(); e != nil; e = e.Next() {
-		if e.Value == relativePos {
-			return nil,
-				errors.New("The Pos to Retrieve has been deleted.")
-		}
+	if page.kind() != PAGE_DATA || page.IsFree(rid.Slot) || !txn.sees(page.versionOf(rid.Slot)) {
+		page.latch.RUnlock()
+		return nil, errInvisible
 	}
 
-	begin := page.SizeOfBlockHead() +
-		relativePos*page.kacher.sizeOfRecord
+	record := page.record(rid.Slot)
+	data := make([]byte, len(record))
+	copy(data, record)
+	page.latch.RUnlock()
 
-	return page.data[begin : begin+page.kacher.sizeOfRecord], nil
+	return dm.detoast(data)
 }
 
 func createFile(path string) (*os.File, error) {
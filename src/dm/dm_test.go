@@ -0,0 +1,1064 @@
+package dm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testDir string
+
+// The tests run in a directory of their own, as the server runs in that of
+// its database.
+func TestMain(m *testing.M) {
+	var err error
+	if testDir, err = ioutil.TempDir("", "dm"); err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(testDir); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+func testMetaData() *MetaData {
+	return &MetaData{
+		Cols:      []string{"a", "b", "c"},
+		Types:     []string{"INT", "STRING", "TEXT"},
+		Lens:      []uint16{0, 16, 0},
+		Nullables: []bool{false, true, true},
+	}
+}
+
+func insertRows(t *testing.T, table *DM, txn *Txn, rows ...[]interface{}) []RID {
+	rids := make([]RID, 0, len(rows))
+	for _, row := range rows {
+		data, err := table.Kacher.Metadata.EncodeRecord(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rid, err := table.Insert(txn, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rids = append(rids, rid)
+	}
+	return rids
+}
+
+// rowsOf returns the rows of the table txn sees, ordered by their first col.
+func rowsOf(t *testing.T, table *DM, txn *Txn) [][]interface{} {
+	records, err := table.RetrieveAll(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make([][]interface{}, 0, len(records))
+	for _, data := range records {
+		row, err := table.Kacher.Metadata.DecodeRecord(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0].(int64) < rows[j][0].(int64) })
+	return rows
+}
+
+func commit(t *testing.T, txn *Txn) {
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crash copies the files of the database to a new directory, as a process
+// killed now leaves them: the pages only the pool holds are lost.
+func crash(t *testing.T) string {
+	dir, err := ioutil.TempDir(testDir, "crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if info, err := os.Stat(name); err != nil || info.IsDir() {
+			continue
+		}
+		bts, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), bts, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// restart runs the database crash left in dir, with the log and the pool
+// started over. Tables must be opened again.
+func restart(t *testing.T, dir string) {
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	wal, walOnce, walErr = nil, sync.Once{}, nil
+	sharedPool = newBufferPool(POOL_BUDGET/PAGE_SIZE, POLICY_LRU_K)
+}
+
+func TestRecoverUnflushed(t *testing.T) {
+	table, err := Create("recover", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := Begin()
+	insertRows(t, table, txn,
+		[]interface{}{int64(1), "one", nil},
+		[]interface{}{int64(2), nil, "two"})
+	commit(t, txn)
+
+	want := [][]interface{}{{int64(1), "one", nil}, {int64(2), nil, "two"}}
+
+	// the commit is in the log only, redo brings it back.
+	restart(t, crash(t))
+	if table, err = Open("recover"); err != nil {
+		t.Fatal(err)
+	}
+	txn, _ = Begin()
+	if rows := rowsOf(t, table, txn); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("after redo got %v, want %v", rows, want)
+	}
+	commit(t, txn)
+
+	// the pages of a transaction cut short are on disk, undo takes them back.
+	loser, _ := Begin()
+	insertRows(t, table, loser, []interface{}{int64(3), "three", nil})
+	if err := sharedPool.flushFile(table.Kacher.dbFile.Name()); err != nil {
+		t.Fatal(err)
+	}
+	dir := crash(t)
+	if err := loser.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	restart(t, dir)
+	if table, err = Open("recover"); err != nil {
+		t.Fatal(err)
+	}
+	txn, _ = Begin()
+	if rows := rowsOf(t, table, txn); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("after undo got %v, want %v", rows, want)
+	}
+	commit(t, txn)
+}
+
+func TestReadLogTornTail(t *testing.T) {
+	file, err := os.Create("torn.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rec := &logRecord{lsn: 1, txn: 1, kind: LOG_COMMIT}
+	bts := append(make([]byte, WAL_HEAD_SIZE), encodeLogRecord(rec)...)
+
+	// the head of the next record claims almost 4 GiB.
+	torn := make([]byte, 8+16)
+	binary.BigEndian.PutUint32(torn, 0xFFFFFFF0)
+	bts = append(bts, torn...)
+
+	if _, err := file.Write(bts); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	records := readLog(file, int64(len(bts)), WAL_VERSION)
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("reading the log allocated %d bytes", allocated)
+	}
+	if len(records) != 1 || records[0].lsn != 1 || records[0].kind != LOG_COMMIT {
+		t.Fatalf("read %d records, want the intact one", len(records))
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	lockTimeout = 50 * time.Millisecond
+	defer func() { lockTimeout = LOCK_TIMEOUT }()
+
+	holder, _ := Begin()
+	if err := holder.LockForWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	waiter, _ := Begin()
+	start := time.Now()
+	if err := waiter.LockForWrite(); err != ErrSerialization {
+		t.Fatalf("a writer kept waiting got %v, want ErrSerialization", err)
+	}
+	if waited := time.Since(start); waited < lockTimeout {
+		t.Fatalf("gave up after %v, before the timeout", waited)
+	}
+	commit(t, waiter)
+	commit(t, holder)
+
+	waiter, _ = Begin()
+	if err := waiter.LockForWrite(); err != nil {
+		t.Fatalf("the lock is free again, got %v", err)
+	}
+	commit(t, waiter)
+}
+
+func TestRollback(t *testing.T) {
+	table, err := Create("rollback", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := Begin()
+	insertRows(t, table, txn, []interface{}{int64(1), "one", nil})
+	savepoint := txn.Savepoint()
+	insertRows(t, table, txn, []interface{}{int64(2), "two", nil})
+	if err := txn.RollbackTo(savepoint); err != nil {
+		t.Fatal(err)
+	}
+	if rows := rowsOf(t, table, txn); len(rows) != 1 {
+		t.Fatalf("after rolling back to the savepoint got %d rows, want 1", len(rows))
+	}
+	commit(t, txn)
+
+	txn, _ = Begin()
+	insertRows(t, table, txn, []interface{}{int64(3), "three", nil})
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ = Begin()
+	want := [][]interface{}{{int64(1), "one", nil}}
+	if rows := rowsOf(t, table, txn); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, want %v", rows, want)
+	}
+	commit(t, txn)
+}
+
+func TestSnapshotVisibility(t *testing.T) {
+	table, err := Create("snapshot", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := Begin()
+	insertRows(t, table, txn, []interface{}{int64(1), "one", nil})
+	commit(t, txn)
+
+	reader, _ := Begin()
+	if rows := rowsOf(t, table, reader); len(rows) != 1 {
+		t.Fatalf("the reader sees %d rows, want 1", len(rows))
+	}
+
+	// neither the writer in progress nor the writers committing after the
+	// snapshot was taken show.
+	writer, _ := Begin()
+	insertRows(t, table, writer, []interface{}{int64(2), "two", nil})
+	if rows := rowsOf(t, table, reader); len(rows) != 1 {
+		t.Fatalf("the reader sees %d rows while a writer is in progress, want 1", len(rows))
+	}
+	if rows := rowsOf(t, table, writer); len(rows) != 2 {
+		t.Fatalf("the writer sees %d rows, want 2", len(rows))
+	}
+	commit(t, writer)
+
+	var wg sync.WaitGroup
+	for i := 3; i < 8; i++ {
+		wg.Add(1)
+		go func(a int64) {
+			defer wg.Done()
+			txn, _ := Begin()
+			data, _ := table.Kacher.Metadata.EncodeRecord([]interface{}{a, nil, nil})
+			if _, err := table.Insert(txn, data); err != nil {
+				t.Error(err)
+			}
+			if err := txn.Commit(); err != nil {
+				t.Error(err)
+			}
+		}(int64(i))
+	}
+	for i := 0; i < 5; i++ {
+		if rows := rowsOf(t, table, reader); len(rows) != 1 {
+			t.Fatalf("the reader sees %d rows while writers commit, want 1", len(rows))
+		}
+	}
+	wg.Wait()
+
+	if rows := rowsOf(t, table, reader); len(rows) != 1 {
+		t.Fatalf("the reader sees %d rows after the writers committed, want 1", len(rows))
+	}
+	if _, err := table.Insert(reader, nil); err != ErrSerialization {
+		t.Fatalf("a reader that missed commits wrote, got %v", err)
+	}
+	if err := reader.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ = Begin()
+	if rows := rowsOf(t, table, txn); len(rows) != 7 {
+		t.Fatalf("a new transaction sees %d rows, want 7", len(rows))
+	}
+	commit(t, txn)
+}
+
+// A reader that began while a delete was in progress keeps its row through
+// a garbage collection after the delete commits.
+func TestCollectGarbageKeepsSnapshot(t *testing.T) {
+	table, err := Create("horizon", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := Begin()
+	rids := insertRows(t, table, txn,
+		[]interface{}{int64(1), "one", nil},
+		[]interface{}{int64(2), "two", nil})
+	commit(t, txn)
+
+	deleter, _ := Begin()
+	if err := table.Delete(deleter, rids[0]); err != nil {
+		t.Fatal(err)
+	}
+	reader, _ := Begin()
+	if rows := rowsOf(t, table, reader); len(rows) != 2 {
+		t.Fatalf("the reader sees %d rows, want 2", len(rows))
+	}
+	commit(t, deleter)
+
+	vacuum, _ := Begin()
+	if _, err := table.CollectGarbage(vacuum); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, vacuum)
+
+	want := [][]interface{}{{int64(1), "one", nil}, {int64(2), "two", nil}}
+	if rows := rowsOf(t, table, reader); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("after collecting garbage the reader sees %v, want %v", rows, want)
+	}
+	commit(t, reader)
+
+	// once the reader is gone the deleted version is garbage.
+	vacuum, _ = Begin()
+	if n, err := table.CollectGarbage(vacuum); err != nil || n != 1 {
+		t.Fatalf("collected %d versions, %v, want 1", n, err)
+	}
+	commit(t, vacuum)
+}
+
+// loadBare loads a clean page holding nothing, which is never written back.
+func loadBare(pgNo uint64) (*Pge, error) {
+	return &Pge{index: pgNo}, nil
+}
+
+// touch fetches and unpins each page.
+func touch(t *testing.T, pool *bufferPool, pgNos ...uint64) {
+	for _, pgNo := range pgNos {
+		page, err := pool.fetch("pool", pgNo, loadBare)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.unpin("pool", page)
+	}
+}
+
+// cached returns the pages of the pool in order.
+func cached(pool *bufferPool) []uint64 {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pgNos := make([]uint64, 0, len(pool.frames))
+	for key := range pool.frames {
+		pgNos = append(pgNos, key.pgNo)
+	}
+	sort.Slice(pgNos, func(i, j int) bool { return pgNos[i] < pgNos[j] })
+	return pgNos
+}
+
+func TestReplacePolicies(t *testing.T) {
+	// pages read twice outlive those read once, of which the least recently
+	// used goes first.
+	pool := newBufferPool(4, POLICY_LRU_K)
+	touch(t, pool, 0, 1, 2, 3, 0, 1, 4)
+	if got, want := cached(pool), []uint64{0, 1, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("LRU-K kept %v, want %v", got, want)
+	}
+	touch(t, pool, 5)
+	if got, want := cached(pool), []uint64{0, 1, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("LRU-K kept %v, want %v", got, want)
+	}
+
+	// the hand clears every reference bit before taking page 0, then gives
+	// page 1, read since, a second chance.
+	pool = newBufferPool(4, POLICY_CLOCK)
+	touch(t, pool, 0, 1, 2, 3, 4)
+	if got, want := cached(pool), []uint64{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("CLOCK kept %v, want %v", got, want)
+	}
+	touch(t, pool, 1, 5)
+	if got, want := cached(pool), []uint64{1, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("CLOCK kept %v, want %v", got, want)
+	}
+}
+
+func TestPoolPinning(t *testing.T) {
+	for _, policy := range []string{POLICY_LRU_K, POLICY_CLOCK} {
+		pool := newBufferPool(4, policy)
+
+		pinned := make([]*Pge, 0, 4)
+		for pgNo := uint64(0); pgNo < 4; pgNo++ {
+			page, err := pool.fetch("pool", pgNo, loadBare)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pinned = append(pinned, page)
+		}
+
+		if _, err := pool.fetch("pool", 4, loadBare); err != ErrPoolExhausted {
+			t.Fatalf("%s: with every page pinned got %v, want ErrPoolExhausted", policy, err)
+		}
+
+		// only the page let go may be evicted, however long ago the others
+		// were read.
+		pool.unpin("pool", pinned[3])
+		touch(t, pool, 4)
+		if got, want := cached(pool), []uint64{0, 1, 2, 4}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: kept %v, want %v", policy, got, want)
+		}
+		for _, page := range pinned[:3] {
+			pool.unpin("pool", page)
+		}
+	}
+}
+
+// A page read from disk holds up only those who want the same page.
+func TestPoolLoadsOutsideLock(t *testing.T) {
+	pool := newBufferPool(4, POLICY_LRU_K)
+	touch(t, pool, 0)
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	slowLoad := func(pgNo uint64) (*Pge, error) {
+		close(started)
+		<-finish
+		return loadBare(pgNo)
+	}
+
+	loaded := make(chan *Pge, 2)
+	go func() {
+		page, _ := pool.fetch("pool", 1, slowLoad)
+		loaded <- page
+	}()
+	<-started
+	go func() {
+		page, _ := pool.fetch("pool", 1, loadBare)
+		loaded <- page
+	}()
+
+	hit := make(chan error, 1)
+	go func() {
+		page, err := pool.fetch("pool", 0, loadBare)
+		if err == nil {
+			pool.unpin("pool", page)
+		}
+		hit <- err
+	}()
+	select {
+	case err := <-hit:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a cached page waited for another being read")
+	}
+
+	close(finish)
+	first, second := <-loaded, <-loaded
+	if first == nil || first != second {
+		t.Fatal("the page was read twice")
+	}
+}
+
+// Tables share the one pool, which keeps to its budget by writing pages back
+// and reading them again.
+func TestSharedPoolBudget(t *testing.T) {
+	if err := SetPoolBudget((MIN_POOL_PAGES - 1) * PAGE_SIZE); err != ErrMemTooSmall {
+		t.Fatalf("a budget below %d pages got %v", MIN_POOL_PAGES, err)
+	}
+	if err := SetPoolBudget(MIN_POOL_PAGES * PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPoolBudget(POOL_BUDGET)
+
+	tables := make([]*DM, 2)
+	for i := range tables {
+		table, err := Create(fmt.Sprintf("budget%d", i), testMetaData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[i] = table
+	}
+
+	// each row takes a page of its own, the tables need twice the pool.
+	text := strings.Repeat("x", PAGE_SIZE/2)
+	txn, _ := Begin()
+	for a := int64(0); a < MIN_POOL_PAGES; a++ {
+		for _, table := range tables {
+			insertRows(t, table, txn, []interface{}{a, nil, text})
+		}
+	}
+	commit(t, txn)
+
+	var wg sync.WaitGroup
+	for _, table := range tables {
+		wg.Add(1)
+		go func(table *DM) {
+			defer wg.Done()
+			txn, _ := Begin()
+			for i := 0; i < 3; i++ {
+				rows := rowsOf(t, table, txn)
+				if len(rows) != MIN_POOL_PAGES || rows[MIN_POOL_PAGES-1][2] != text {
+					t.Errorf("read %d rows back", len(rows))
+				}
+			}
+			txn.Commit()
+		}(table)
+	}
+	wg.Wait()
+
+	sharedPool.mu.Lock()
+	if len(sharedPool.frames) > MIN_POOL_PAGES {
+		t.Errorf("the pool holds %d pages, over its budget", len(sharedPool.frames))
+	}
+	sharedPool.mu.Unlock()
+
+	for _, stat := range BufferStats() {
+		if strings.HasPrefix(stat.Table, "budget") && (stat.Evictions == 0 || stat.Flushes == 0) {
+			t.Errorf("%s: %d evictions, %d flushes", stat.Table, stat.Evictions, stat.Flushes)
+		}
+	}
+}
+
+func TestOverflowRoundTrip(t *testing.T) {
+	table, err := Create("overflow", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("0123456789", 3*PAGE_SIZE/10)
+	longer := strings.Repeat("abcdefghij", 5*PAGE_SIZE/10)
+
+	txn, _ := Begin()
+	rids := insertRows(t, table, txn, []interface{}{int64(1), "one", long})
+	commit(t, txn)
+
+	txn, _ = Begin()
+	data, err := table.Retrieve(txn, rids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := table.Kacher.Metadata.DecodeRecord(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row[2] != long {
+		t.Fatalf("read back %d bytes, want %d", len(row[2].(string)), len(long))
+	}
+
+	data, _ = table.Kacher.Metadata.EncodeRecord([]interface{}{int64(1), "one", longer})
+	if _, err := table.Update(txn, data, rids[0]); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, txn)
+
+	txn, _ = Begin()
+	rows := rowsOf(t, table, txn)
+	if len(rows) != 1 || rows[0][2] != longer {
+		t.Fatalf("after the update got %d rows, want the longer value", len(rows))
+	}
+	commit(t, txn)
+}
+
+// oldFormatPage lays out a page of a format before version 4: lsn(8) kind(1)
+// pad(1) slots(2) used(2), then the slots, with the tuples at the end.
+func oldFormatPage(kind uint8, tuples [][]byte) []byte {
+	page := make([]byte, PAGE_SIZE)
+	page[SIZE_OF_LSN] = kind
+	binary.BigEndian.PutUint16(page[SIZE_OF_LSN+2:], uint16(len(tuples)))
+
+	end := PAGE_SIZE
+	for i, tuple := range tuples {
+		end -= len(tuple)
+		copy(page[end:], tuple)
+
+		entry := SIZE_OF_PAGE_HEAD_V3 + SIZE_OF_SLOT*i
+		binary.BigEndian.PutUint16(page[entry:], uint16(end))
+		binary.BigEndian.PutUint16(page[entry+2:], uint16(len(tuple)))
+	}
+	return page
+}
+
+// oldOverflowPage holds part of a value of a format before version 4, and
+// the number of the page holding the rest.
+func oldOverflowPage(version uint16, part []byte, next uint64) []byte {
+	page := make([]byte, PAGE_SIZE)
+	page[SIZE_OF_LSN] = PAGE_OVERFLOW
+	binary.BigEndian.PutUint16(page[SIZE_OF_LSN+4:], uint16(len(part)))
+
+	if version == 1 {
+		binary.BigEndian.PutUint16(page[SIZE_OF_LSN+2:], uint16(next))
+		copy(page[SIZE_OF_PAGE_HEAD_V3:], part)
+	} else {
+		binary.BigEndian.PutUint64(page[SIZE_OF_PAGE_HEAD_V3:], next)
+		copy(page[SIZE_OF_PAGE_HEAD_V3+SIZE_OF_PGNO:], part)
+	}
+	return page
+}
+
+func oldTuple(xmin uint64, xmax uint64, record []byte) []byte {
+	tuple := make([]byte, SIZE_OF_VERSION, SIZE_OF_VERSION+len(record))
+	binary.BigEndian.PutUint64(tuple[0:], xmin)
+	binary.BigEndian.PutUint64(tuple[8:], xmax)
+	return append(tuple, record...)
+}
+
+// writeOldTable writes a table of the format version holding the rows
+// (1, "one", long) with long in overflow pages, (2, "two", "short"), and a
+// deleted (3, "three", NULL).
+func writeOldTable(t *testing.T, name string, version uint16, long string) {
+	md := testMetaData()
+	md.Indexes = make([]bool, len(md.Cols))
+	md.SizeOfRecord = uint16(sizeOfRecord(md.Types, md.Lens))
+	if version > 1 {
+		md.Version = version
+	}
+
+	first := uint64(0)
+	if version >= 3 {
+		first = FIRST_PAGE
+	}
+	noPage := uint64(NO_PAGE)
+	if version == 1 {
+		noPage = NO_PAGE_V1
+	}
+
+	// a long value keeps its length, flagged, then the first of its pages.
+	pointer := make([]byte, SIZE_OF_LENGTH)
+	binary.BigEndian.PutUint32(pointer, uint32(len(long))|OVERFLOW_FLAG)
+	if version == 1 {
+		pointer = append(pointer, 0, 0)
+		binary.BigEndian.PutUint16(pointer[SIZE_OF_LENGTH:], uint16(first+1))
+	} else {
+		pointer = append(pointer, make([]byte, SIZE_OF_PGNO)...)
+		binary.BigEndian.PutUint64(pointer[SIZE_OF_LENGTH:], first+1)
+	}
+	one, _ := md.EncodeRecord([]interface{}{int64(1), "one", ""})
+	one = append(one[:len(one)-SIZE_OF_LENGTH], pointer...)
+
+	two, _ := md.EncodeRecord([]interface{}{int64(2), "two", "short"})
+	three, _ := md.EncodeRecord([]interface{}{int64(3), "three", nil})
+
+	pages := make([][]byte, first)
+	for i := range pages {
+		pages[i] = make([]byte, PAGE_SIZE)
+	}
+	pages = append(pages, oldFormatPage(PAGE_DATA, [][]byte{
+		oldTuple(1, 0, one), oldTuple(1, 0, two), oldTuple(1, 1, three)}))
+
+	room := PAGE_SIZE - SIZE_OF_PAGE_HEAD_V3 - SIZE_OF_PGNO
+	for rest, pgNo := []byte(long), first+1; len(rest) > 0; pgNo++ {
+		part, next := rest, noPage
+		if len(part) > room {
+			part, next = rest[:room], pgNo+1
+		}
+		pages = append(pages, oldOverflowPage(version, part, next))
+		rest = rest[len(part):]
+	}
+
+	metaData, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == 1 { // it had no version
+		metaData = bytes.Replace(metaData, []byte(`"Version":0,`), nil, 1)
+	}
+	if err := ioutil.WriteFile(name+SUFFIX_META, metaData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+SUFFIX_DB, bytes.Join(pages, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	// the old records were written by transaction 1, which has to be over.
+	txn, _ := Begin()
+	if err := txn.LockForWrite(); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, txn)
+
+	long := strings.Repeat("0123456789", PAGE_SIZE/5)
+	want := [][]interface{}{{int64(1), "one", long}, {int64(2), "two", "short"}}
+
+	for _, version := range []uint16{1, 2, 3} {
+		name := "upgrade" + string(rune('0'+version))
+		writeOldTable(t, name, version, long)
+
+		table, err := Open(name)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if v := table.Kacher.Metadata.Version; v != FORMAT_VERSION {
+			t.Fatalf("version %d: upgraded to %d, want %d", version, v, FORMAT_VERSION)
+		}
+
+		txn, _ := Begin()
+		rows := rowsOf(t, table, txn)
+		if !reflect.DeepEqual(rows, want) {
+			t.Fatalf("version %d: got %d rows, want the 2 live ones", version, len(rows))
+		}
+		commit(t, txn)
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	if _, err := Create("newer", testMetaData()); err != nil {
+		t.Fatal(err)
+	}
+
+	metaData, err := ioutil.ReadFile("newer" + SUFFIX_META)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md map[string]interface{}
+	if err := json.Unmarshal(metaData, &md); err != nil {
+		t.Fatal(err)
+	}
+	md["Version"] = FORMAT_VERSION + 1
+	if metaData, err = json.Marshal(md); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("newer"+SUFFIX_META, metaData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a table written by a later build is left alone, not upgraded.
+	_, err = Open("newer")
+	if err == nil || !strings.Contains(err.Error(), "this build reads up to version") {
+		t.Fatalf("opening a table of a newer format got %v", err)
+	}
+}
+
+// corruptPage changes a page of a file on disk.
+func corruptPage(t *testing.T, path string, pgNo uint64, change func(page []byte)) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	page := make([]byte, PAGE_SIZE)
+	if _, err := file.ReadAt(page, int64(pgNo)*PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	change(page)
+	if _, err := file.WriteAt(page, int64(pgNo)*PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptPage(t *testing.T) {
+	table, err := Create("corrupt", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn, _ := Begin()
+	rids := insertRows(t, table, txn, []interface{}{int64(1), "one", nil})
+	commit(t, txn)
+
+	path := table.Kacher.dbFile.Name()
+	if err := sharedPool.flushFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if damaged, _ := table.Verify(); len(damaged) != 0 {
+		t.Fatalf("a sound table has damaged pages: %v", damaged[0])
+	}
+
+	// a bit flipped on disk fails the checksum once the page is read again.
+	sharedPool.discard(path)
+	corruptPage(t, path, FIRST_PAGE, func(page []byte) { page[PAGE_SIZE-1] ^= 1 })
+
+	txn, _ = Begin()
+	_, err = table.Retrieve(txn, rids[0])
+	if e, ok := err.(*CorruptionError); !ok || e.PgNo != FIRST_PAGE || e.Reason != "checksum mismatch" {
+		t.Fatalf("reading the flipped page got %v", err)
+	}
+	commit(t, txn)
+
+	damaged, _ := table.Verify()
+	if len(damaged) != 1 || damaged[0].PgNo != FIRST_PAGE {
+		t.Fatalf("verify found %v, want page %d", damaged, FIRST_PAGE)
+	}
+
+	// a page with a right checksum over a wrong layout is found as well.
+	corruptPage(t, path, FIRST_PAGE, func(page []byte) {
+		page[PAGE_SIZE-1] ^= 1
+		binary.BigEndian.PutUint16(page[SIZE_OF_LSN+2:], 0xFFFF)
+		binary.BigEndian.PutUint32(page[CHECKSUM_OFFSET:], checksum(page))
+	})
+	damaged, _ = table.Verify()
+	if len(damaged) != 1 || damaged[0].Reason != "bad slot directory" {
+		t.Fatalf("verify found %v, want a bad slot directory", damaged)
+	}
+}
+
+// The slots of deleted records are taken again before the table grows.
+func TestFSMReuse(t *testing.T) {
+	table, err := Create("reuse", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := strings.Repeat("x", PAGE_SIZE/8)
+	rows := make([][]interface{}, 0)
+	for a := int64(0); a < 40; a++ {
+		rows = append(rows, []interface{}{a, nil, text})
+	}
+	txn, _ := Begin()
+	rids := insertRows(t, table, txn, rows...)
+	commit(t, txn)
+	numOfBlocks := table.Kacher.NumOfBlocks()
+
+	txn, _ = Begin()
+	for _, rid := range rids[:20] {
+		if err := table.Delete(txn, rid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(t, txn)
+	txn, _ = Begin()
+	if _, err := table.CollectGarbage(txn); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, txn)
+
+	txn, _ = Begin()
+	insertRows(t, table, txn, rows[:20]...)
+	commit(t, txn)
+	if n := table.Kacher.NumOfBlocks(); n != numOfBlocks {
+		t.Fatalf("the table grew from %d pages to %d", numOfBlocks, n)
+	}
+}
+
+// The overflow pages given back are found again after a restart.
+func TestFreePagesSurviveRestart(t *testing.T) {
+	table, err := Create("freepages", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("0123456789", 3*PAGE_SIZE/10)
+	txn, _ := Begin()
+	rids := insertRows(t, table, txn, []interface{}{int64(1), nil, long})
+	commit(t, txn)
+	numOfBlocks := table.Kacher.NumOfBlocks()
+
+	txn, _ = Begin()
+	if err := table.Delete(txn, rids[0]); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, txn)
+	txn, _ = Begin()
+	if _, err := table.CollectGarbage(txn); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, txn)
+
+	restart(t, crash(t))
+	if table, err = Open("freepages"); err != nil {
+		t.Fatal(err)
+	}
+	txn, _ = Begin()
+	insertRows(t, table, txn, []interface{}{int64(2), nil, long})
+	commit(t, txn)
+	if n := table.Kacher.NumOfBlocks(); n != numOfBlocks {
+		t.Fatalf("the table grew from %d pages to %d", numOfBlocks, n)
+	}
+
+	txn, _ = Begin()
+	if rows := rowsOf(t, table, txn); len(rows) != 1 || rows[0][2] != long {
+		t.Fatalf("got %d rows, want the new one", len(rows))
+	}
+	commit(t, txn)
+}
+
+func TestVacuumTruncate(t *testing.T) {
+	table, err := Create("vacuum", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := strings.Repeat("x", PAGE_SIZE/8)
+	rows := make([][]interface{}, 0)
+	for a := int64(0); a < 40; a++ {
+		rows = append(rows, []interface{}{a, nil, text})
+	}
+	txn, _ := Begin()
+	rids := insertRows(t, table, txn, rows...)
+	commit(t, txn)
+
+	// every other record goes, half the pages are enough for the rest.
+	txn, _ = Begin()
+	for i := 0; i < len(rids); i += 2 {
+		if err := table.Delete(txn, rids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(t, txn)
+
+	numOfBlocks := table.Kacher.NumOfBlocks()
+	given, err := table.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if given == 0 || table.Kacher.NumOfBlocks() != numOfBlocks-given {
+		t.Fatalf("gave %d of %d pages back, %d left", given, numOfBlocks, table.Kacher.NumOfBlocks())
+	}
+	if size := getSizeOfFile(table.Kacher.dbFile); size != int64(numOfBlocks-given)*PAGE_SIZE {
+		t.Fatalf("the file still has %d bytes", size)
+	}
+
+	txn, _ = Begin()
+	got := rowsOf(t, table, txn)
+	commit(t, txn)
+	if len(got) != 20 || got[0][0] != int64(1) || got[19][0] != int64(39) {
+		t.Fatalf("after vacuum got %d rows", len(got))
+	}
+
+	// cutting the file waits for the writer in progress no longer than a
+	// writer would.
+	lockTimeout = 50 * time.Millisecond
+	defer func() { lockTimeout = LOCK_TIMEOUT }()
+
+	holder, _ := Begin()
+	if err := holder.LockForWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.truncate(); err != ErrSerialization {
+		t.Fatalf("truncating with a writer in progress got %v", err)
+	}
+	commit(t, holder)
+}
+
+func TestIndexLockTimeout(t *testing.T) {
+	table, err := Create("indexlock", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockTimeout = 50 * time.Millisecond
+	defer func() { lockTimeout = LOCK_TIMEOUT }()
+
+	holder, _ := Begin()
+	if err := holder.LockForWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	built := false
+	def := IndexDef{Name: "indexlock_a", Cols: []string{"a"}}
+	if err := table.AddIndex(def, func() error { built = true; return nil }); err != ErrSerialization || built {
+		t.Fatalf("building an index with a writer in progress got %v", err)
+	}
+	if err := table.DropIndex("indexlock_a", func() error { return nil }); err != ErrSerialization {
+		t.Fatalf("dropping an index with a writer in progress got %v", err)
+	}
+	commit(t, holder)
+
+	if err := table.AddIndex(def, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if table.Kacher.Metadata.IndexDef("indexlock_a") == nil {
+		t.Fatal("the index is not in the metadata")
+	}
+	if err := table.DropIndex("indexlock_a", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.DropIndex("indexlock_a", func() error { return nil }); err != ErrNoSuchIndex {
+		t.Fatalf("dropping the index twice got %v", err)
+	}
+}
+
+type failingWatcher struct {
+	Watcher
+	fail int64 // the value of a the watcher refuses
+}
+
+func (w failingWatcher) Inserted(txn *Txn, data []byte, rid RID) error {
+	if int64(binary.BigEndian.Uint16(data[1:])) == w.fail {
+		return ErrSerialization
+	}
+	return nil
+}
+
+func TestInsertAll(t *testing.T) {
+	table, err := Create("insertall", testMetaData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make([][]byte, 0)
+	for a := int64(1); a <= 3; a++ {
+		data, err := table.Kacher.Metadata.EncodeRecord([]interface{}{a, nil, nil})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, data)
+	}
+
+	txn, _ := Begin()
+	insertRows(t, table, txn, []interface{}{int64(0), "kept", nil})
+	table.Watch(failingWatcher{fail: 3})
+	if _, err := table.InsertAll(txn, records); err != ErrSerialization {
+		t.Fatalf("got %v, want the error of the watcher", err)
+	}
+	if rows := rowsOf(t, table, txn); len(rows) != 1 {
+		t.Fatalf("after a failed InsertAll got %d rows, want the one inserted before", len(rows))
+	}
+
+	table.Watch(failingWatcher{fail: -1})
+	rids, err := table.InsertAll(txn, records)
+	if err != nil || len(rids) != 3 {
+		t.Fatalf("got %v, %v", rids, err)
+	}
+	commit(t, txn)
+
+	txn, _ = Begin()
+	if rows := rowsOf(t, table, txn); len(rows) != 4 {
+		t.Fatalf("got %d rows, want 4", len(rows))
+	}
+	commit(t, txn)
+}
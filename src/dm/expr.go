@@ -0,0 +1,155 @@
+package dm
+
+import (
+	"../sql/lexer"
+	"../sql/parser/statements"
+	"errors"
+)
+
+// 表达式：arith.go的算式再由比较、AND OR NOT连起来，先算式，再比较，
+// 再NOT、AND、OR。WHERE、SELECT的字段、UPDATE的SET和CHECK都用同一个求值。
+// INT与DOUBLE之间可以比较，STRING与STRING、TEXT比较，BLOB不能比较。
+// 与NULL比较不真也不假；AND、OR、NOT按三值逻辑。
+
+var ErrNotCondition = errors.New("Only conditions can be joined by AND, OR and NOT.")
+
+// TypeOf makes sure the expression names columns of the table and its parts
+// go together. It returns the type of its value, one of the column types,
+// BOOL for a condition or NULL.
+func (md *MetaData) TypeOf(expr statements.Expr) (string, error) {
+	switch e := expr.(type) {
+	case statements.Value:
+		tok := e.Value.(lexer.Token)
+		if tok.TypeInfo != "IDENTIFIER" {
+			return tok.TypeInfo, nil
+		}
+		i := md.ColOf(e)
+		if i == -1 {
+			return "", ErrNoSuchCol
+		}
+		return md.Types[i], nil
+
+	case statements.Unary:
+		tp, err := md.TypeOf(e.X)
+		if err != nil {
+			return "", err
+		}
+		if e.Op.Token.TypeInfo == "NOT" {
+			if tp != "BOOL" && tp != "NULL" {
+				return "", ErrNotCondition
+			}
+			return "BOOL", nil
+		}
+		if !isNumber(tp) && tp != "NULL" {
+			return "", ErrNotNumber
+		}
+		return tp, nil
+
+	case statements.Binary:
+		l, err := md.TypeOf(e.L)
+		if err != nil {
+			return "", err
+		}
+		r, err := md.TypeOf(e.R)
+		if err != nil {
+			return "", err
+		}
+
+		switch e.Op.Token.TypeInfo {
+		case "AND", "OR":
+			if l != "BOOL" && l != "NULL" || r != "BOOL" && r != "NULL" {
+				return "", ErrNotCondition
+			}
+			return "BOOL", nil
+		case "EQEQ", "NE", "LT", "LE", "GT", "GE":
+			if !comparable(l, r) {
+				return "", ErrIncomparable
+			}
+			return "BOOL", nil
+		}
+
+		if !isNumber(l) && l != "NULL" || !isNumber(r) && r != "NULL" {
+			return "", ErrNotNumber
+		}
+		switch {
+		case l == "NULL":
+			return r, nil
+		case r == "NULL", l == r:
+			return l, nil
+		}
+		return "DOUBLE", nil
+	}
+	return "", ErrNotNumber
+}
+
+func isText(tp string) bool {
+	return tp == "STRING" || tp == "TEXT"
+}
+
+func comparable(l string, r string) bool {
+	if l == "NULL" || r == "NULL" {
+		return l != "BLOB" && l != "BOOL" && r != "BLOB" && r != "BOOL"
+	}
+	return isNumber(l) && isNumber(r) || isText(l) && isText(r)
+}
+
+// Eval returns the value of an expression TypeOf passed for the values of a
+// record: int64, float64, string, []byte, bool, or nil for NULL.
+func (md *MetaData) Eval(values []interface{}, expr statements.Expr) (interface{}, error) {
+	switch e := expr.(type) {
+	case statements.Value:
+		if e.Value.(lexer.Token).TypeInfo == "NULL" {
+			return nil, nil
+		}
+		return md.valueOf(values, e), nil
+
+	case statements.Unary:
+		x, err := md.Eval(values, e.X)
+		if x == nil || err != nil {
+			return nil, err
+		}
+		if e.Op.Token.TypeInfo == "NOT" {
+			return !x.(bool), nil
+		}
+		return compute("-", int64(0), x)
+
+	case statements.Binary:
+		op := e.Op.Token.Value.(string)
+
+		l, err := md.Eval(values, e.L)
+		if err != nil {
+			return nil, err
+		}
+		// false AND x is false and true OR x is true, whatever x is.
+		if op == "AND" && l == false || op == "OR" && l == true {
+			return l, nil
+		}
+
+		r, err := md.Eval(values, e.R)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "AND", "OR":
+			switch {
+			case r == (op == "OR"):
+				return r, nil
+			case l == nil || r == nil:
+				return nil, nil
+			}
+			return r, nil
+		}
+
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		if e.Op.Token.TypeInfo == "PLUS" || e.Op.Token.TypeInfo == "MINUS" ||
+			e.Op.Token.TypeInfo == "STAR" || e.Op.Token.TypeInfo == "SLASH" ||
+			e.Op.Token.TypeInfo == "PERCENT" {
+			return compute(op, l, r)
+		}
+		return Holds(op, l, r), nil
+	}
+	return nil, ErrNotNumber
+}
@@ -0,0 +1,252 @@
+package dm
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// 空闲空间表(FSM)：存在.fsm文件中，魔数(8)之后每页一个字节，
+// 记录该页还能放下多大的记录，以FSM_UNIT字节为单位，向下取整。
+// 表只是提示，不记日志：事务结束时把改过的项写回，崩溃后可能过时，
+// 所以插入前仍在页上确认，不对就改正。打开表时，文件尾新加的页从磁盘读出来补上；
+// 文件丢失或魔数不对时扫描整个.db重建。
+// 溢出链释放的页记为FSM_FREE_PAGE，重启后仍留给以后的溢出链使用。
+
+const (
+	FSM_MAGIC      = "lipDB.fs"
+	FSM_UNIT       = PAGE_SIZE / FSM_CATEGORIES
+	FSM_CATEGORIES = 256
+	FSM_FREE_PAGE  = FSM_CATEGORIES - 1 // the entry of an overflow page given back
+
+	SUFFIX_FSM = ".fsm"
+)
+
+type fsm struct {
+	file  *os.File // nil for a table no one else sees yet
+	avail []uint8
+	pages [FSM_CATEGORIES]map[uint64]bool // pages by category, 0 left out
+	free  map[uint64]bool                 // overflow pages given back
+	dirty map[uint64]bool                 // entries not written back yet
+	mu    sync.Mutex
+}
+
+func newFSM(file *os.File) *fsm {
+	m := &fsm{
+		file:  file,
+		free:  make(map[uint64]bool),
+		dirty: make(map[uint64]bool),
+	}
+	for i := range m.pages {
+		m.pages[i] = make(map[uint64]bool)
+	}
+	return m
+}
+
+// openFSM reads the free-space map of a table, filling in the pages it does
+// not know from the .db file.
+func openFSM(path string, kacher *cacher) (*fsm, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	m := newFSM(file)
+
+	known := uint64(0)
+	if len(bts) >= SIZE_OF_MAGIC && string(bts[:SIZE_OF_MAGIC]) == FSM_MAGIC {
+		known = uint64(len(bts) - SIZE_OF_MAGIC)
+	} else if err := m.reset(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	for pgNo := uint64(FIRST_PAGE); pgNo < kacher.numOfBlocks; pgNo++ {
+		if pgNo < known {
+			m.setCategory(pgNo, bts[SIZE_OF_MAGIC+pgNo])
+			continue
+		}
+
+		// a damaged page is left out until it is written again.
+		room := 0
+		if data, err := readPage(kacher.dbFile, pgNo); err == nil {
+			page := &Pge{index: pgNo, kacher: kacher}
+			page.load(data)
+			if page.kind() == PAGE_FREE {
+				m.giveBack(pgNo)
+				continue
+			}
+			room = page.room()
+		}
+		m.set(pgNo, room)
+	}
+
+	return m, m.flush()
+}
+
+// reset starts the file over with nothing but the magic.
+func (m *fsm) reset() error {
+	if err := m.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := m.file.WriteAt([]byte(FSM_MAGIC), 0)
+	return err
+}
+
+// set records that the largest tuple fitting into the page has room bytes.
+func (m *fsm) set(pgNo uint64, room int) {
+	category := room / FSM_UNIT
+	if category >= FSM_FREE_PAGE {
+		category = FSM_FREE_PAGE - 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.setCategory(pgNo, uint8(category)) {
+		m.dirty[pgNo] = true
+	}
+}
+
+// setCategory reports whether the entry of the page changed. mu must be
+// held, or m not shared yet.
+func (m *fsm) setCategory(pgNo uint64, category uint8) bool {
+	grown := false
+	for uint64(len(m.avail)) <= pgNo {
+		m.avail = append(m.avail, 0)
+		grown = true
+	}
+
+	old := m.avail[pgNo]
+	if old == category && !grown {
+		return false
+	}
+
+	delete(m.pages[old], pgNo)
+	delete(m.free, pgNo)
+	if category == FSM_FREE_PAGE {
+		m.free[pgNo] = true
+	} else if category > 0 {
+		m.pages[category][pgNo] = true
+	}
+	m.avail[pgNo] = category
+	return true
+}
+
+// find returns a page which has room for a tuple of size bytes, the one
+// with the most of it. It does not look at more than FSM_CATEGORIES sets,
+// however large the table is.
+func (m *fsm) find(size int) (uint64, bool) {
+	need := (size + FSM_UNIT - 1) / FSM_UNIT
+	if need == 0 {
+		need = 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for category := FSM_CATEGORIES - 1; category >= need; category-- {
+		for pgNo := range m.pages[category] {
+			return pgNo, true
+		}
+	}
+	return 0, false
+}
+
+// findBefore returns the first page before end which has room for a tuple
+// of size bytes.
+func (m *fsm) findBefore(size int, end uint64) (uint64, bool) {
+	need := (size + FSM_UNIT - 1) / FSM_UNIT
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for pgNo := uint64(FIRST_PAGE); pgNo < end && pgNo < uint64(len(m.avail)); pgNo++ {
+		if int(m.avail[pgNo]) >= need && m.avail[pgNo] > 0 && m.avail[pgNo] != FSM_FREE_PAGE {
+			return pgNo, true
+		}
+	}
+	return 0, false
+}
+
+// giveBack records that an overflow chain gave the page back.
+func (m *fsm) giveBack(pgNo uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.setCategory(pgNo, FSM_FREE_PAGE) {
+		m.dirty[pgNo] = true
+	}
+}
+
+// takeFree takes the first page before end out of the pages given back.
+func (m *fsm) takeFree(end uint64) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	first := end
+	for pgNo := range m.free {
+		if pgNo < first {
+			first = pgNo
+		}
+	}
+	if first == end {
+		return 0, false
+	}
+
+	m.setCategory(first, 0)
+	m.dirty[first] = true
+	return first, true
+}
+
+// truncate forgets the pages from end on, which are cut off the table.
+func (m *fsm) truncate(end uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for pgNo := end; pgNo < uint64(len(m.avail)); pgNo++ {
+		delete(m.pages[m.avail[pgNo]], pgNo)
+		delete(m.free, pgNo)
+		delete(m.dirty, pgNo)
+	}
+	if end < uint64(len(m.avail)) {
+		m.avail = m.avail[:end]
+	}
+
+	if m.file == nil {
+		return nil
+	}
+	return m.file.Truncate(int64(SIZE_OF_MAGIC + end))
+}
+
+// flush writes the entries changed since the last flush back.
+func (m *fsm) flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		m.dirty = make(map[uint64]bool)
+		return nil
+	}
+
+	for pgNo := range m.dirty {
+		if _, err := m.file.WriteAt([]byte{m.avail[pgNo]}, int64(SIZE_OF_MAGIC+pgNo)); err != nil {
+			return err
+		}
+		delete(m.dirty, pgNo)
+	}
+	return nil
+}
+
+func (m *fsm) close() error {
+	if m.file == nil {
+		return nil
+	}
+	return m.file.Close()
+}
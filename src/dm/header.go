@@ -0,0 +1,88 @@
+package dm
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"strconv"
+)
+
+// 文件头页：.db文件的第0页，记录页从第1页开始。
+// 魔数(8) 格式版本(2) 页大小(4) 校验和(4)，校验和是前面各字段的CRC32。
+// .meta中也存有魔数和格式版本，打开表时两者都要检查。
+
+const (
+	DB_MAGIC   = "lipDB.db"
+	META_MAGIC = "lipDB.meta"
+
+	SIZE_OF_MAGIC     = 8
+	SIZE_OF_FILE_HEAD = SIZE_OF_MAGIC + 2 + 4 + 4
+
+	FIRST_PAGE = 1 // page 0 is the file header
+)
+
+var (
+	ErrNotDBFile        = errors.New("Not a lipDB file.")
+	ErrHeaderCorrupted  = errors.New("The file header is corrupted.")
+	ErrVersionMismatch  = errors.New("The .db and .meta files of the table have different format versions.")
+	ErrMetaDataMismatch = errors.New("The .meta file does not belong to a lipDB table.")
+)
+
+// writeFileHeader writes the header page of a new file, a .db file or a
+// page file with its own magic.
+func writeFileHeader(dbFile *os.File, magic string) error {
+	head := make([]byte, PAGE_SIZE)
+	copy(head, magic)
+	binary.BigEndian.PutUint16(head[SIZE_OF_MAGIC:], FORMAT_VERSION)
+	binary.BigEndian.PutUint32(head[SIZE_OF_MAGIC+2:], PAGE_SIZE)
+	binary.BigEndian.PutUint32(head[SIZE_OF_MAGIC+6:], crc32.ChecksumIEEE(head[:SIZE_OF_MAGIC+6]))
+
+	return writeThroughAt(dbFile, 0, head)
+}
+
+// checkFileHeader makes sure this build can read the file.
+func checkFileHeader(dbFile *os.File, magic string, md *MetaData) error {
+	head := make([]byte, SIZE_OF_FILE_HEAD)
+	if _, err := dbFile.ReadAt(head, 0); err != nil {
+		return ErrHeaderCorrupted
+	}
+
+	if string(head[:SIZE_OF_MAGIC]) != magic {
+		return ErrNotDBFile
+	}
+	if crc32.ChecksumIEEE(head[:SIZE_OF_MAGIC+6]) != binary.BigEndian.Uint32(head[SIZE_OF_MAGIC+6:]) {
+		return ErrHeaderCorrupted
+	}
+
+	version := binary.BigEndian.Uint16(head[SIZE_OF_MAGIC:])
+	if version > FORMAT_VERSION {
+		return newerVersion(dbFile.Name(), version)
+	}
+	if version != md.Version {
+		return ErrVersionMismatch
+	}
+
+	if pageSize := binary.BigEndian.Uint32(head[SIZE_OF_MAGIC+2:]); pageSize != PAGE_SIZE {
+		return errors.New(dbFile.Name() + " uses pages of " + strconv.Itoa(int(pageSize)) +
+			" bytes, this build uses " + strconv.Itoa(PAGE_SIZE) + ".")
+	}
+	return nil
+}
+
+// checkMetaData makes sure this build can read the .meta file. Files older
+// than FORMAT_VERSION are upgraded by dm.Open before.
+func checkMetaData(metaFile *os.File, md *MetaData) error {
+	if md.Version > FORMAT_VERSION {
+		return newerVersion(metaFile.Name(), md.Version)
+	}
+	if md.Magic != META_MAGIC {
+		return ErrMetaDataMismatch
+	}
+	return nil
+}
+
+func newerVersion(path string, version uint16) error {
+	return errors.New(path + " has format version " + strconv.Itoa(int(version)) +
+		", this build reads up to version " + strconv.Itoa(FORMAT_VERSION) + ".")
+}
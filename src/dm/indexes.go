@@ -0,0 +1,102 @@
+package dm
+
+import "errors"
+
+// 索引的名字和列记在.meta中，索引本身由im管理。建索引和删索引时挡住所有写者：
+// 建的时候表中的记录不变，建好后才写入.meta；删的时候先从.meta中去掉，
+// 删掉文件后做一次检查点，日志中不再留有这个文件的页，恢复时不会写回去。
+
+var ErrNoSuchIndex = errors.New("No such index.")
+
+// IndexDef returns the index called name, or nil.
+func (md *MetaData) IndexDef(name string) *IndexDef {
+	for i := range md.IndexDefs {
+		if md.IndexDefs[i].Name == name {
+			return &md.IndexDefs[i]
+		}
+	}
+	return nil
+}
+
+// AddIndex runs build with every writer kept out, and records the index in
+// the metadata if it succeeds.
+func (dm DM) AddIndex(def IndexDef, build func() error) error {
+	if !txnLock.lockWithin(lockTimeout) {
+		return ErrSerialization
+	}
+	defer txnLock.Unlock()
+
+	if err := build(); err != nil {
+		return err
+	}
+
+	md := dm.Kacher.Metadata
+	md.IndexDefs = append(md.IndexDefs, def)
+	if err := saveMetaData(dm.TableName, md); err != nil {
+		md.IndexDefs = md.IndexDefs[:len(md.IndexDefs)-1]
+		return err
+	}
+	return nil
+}
+
+// DropIndex takes the index out of the metadata and runs remove to delete
+// it, with every writer kept out.
+func (dm DM) DropIndex(name string, remove func() error) error {
+	if !txnLock.lockWithin(lockTimeout) {
+		return ErrSerialization
+	}
+	defer txnLock.Unlock()
+
+	md := dm.Kacher.Metadata
+
+	defs := make([]IndexDef, 0, len(md.IndexDefs))
+	for _, def := range md.IndexDefs {
+		if def.Name != name {
+			defs = append(defs, def)
+		}
+	}
+	if len(defs) == len(md.IndexDefs) {
+		return ErrNoSuchIndex
+	}
+
+	old := md.IndexDefs
+	md.IndexDefs = defs
+	if err := saveMetaData(dm.TableName, md); err != nil {
+		md.IndexDefs = old
+		return err
+	}
+
+	if err := remove(); err != nil {
+		return err
+	}
+	return forceCheckpoint()
+}
+
+// Versions calls fn with every version of every record stored, whoever can
+// see it, as an index has to know them.
+func (dm DM) Versions(fn func(rid RID, data []byte) error) error {
+	return dm.scanVersions(func(xmin uint64, xmax uint64) bool {
+		return true
+	}, fn)
+}
+
+// Live reports whether the record at rid has not been deleted.
+func (dm DM) Live(rid RID) (bool, error) {
+	dm.Kacher.moving.RLock()
+	defer dm.Kacher.moving.RUnlock()
+
+	page, err := dm.Kacher.GetPage(rid.PgNo)
+	if err != nil {
+		return false, err
+	}
+	defer dm.Kacher.Unpin(page)
+
+	page.latch.RLock()
+	defer page.latch.RUnlock()
+
+	if page.kind() != PAGE_DATA || page.IsFree(rid.Slot) {
+		return false, nil
+	}
+	_, xmax := page.versionOf(rid.Slot)
+	return xmax == 0, nil
+}
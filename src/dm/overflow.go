@@ -0,0 +1,232 @@
+package dm
+
+import "encoding/binary"
+
+// 溢出页：存放放不进记录的大值，一个值占用一串溢出页。
+// 页头同分槽页，空闲区末尾的位置存本页已用字节数(2)。
+// 页头之后是下一页页号(8)，然后是值的内容。链表最后一页的下一页为NO_PAGE。
+// 释放后的溢出页标为PAGE_FREE，留给以后的溢出链使用。
+
+const (
+	SIZE_OF_OVERFLOW_HEAD = SIZE_OF_PAGE_HEAD + SIZE_OF_PGNO
+	SIZE_OF_OVERFLOW_DATA = PAGE_SIZE - SIZE_OF_OVERFLOW_HEAD
+
+	NO_PAGE = 1<<64 - 1
+)
+
+func (p *Pge) nextPage() uint64 {
+	return binary.BigEndian.Uint64(p.data[SIZE_OF_PAGE_HEAD:])
+}
+
+func (p *Pge) setNextPage(pgNo uint64) {
+	binary.BigEndian.PutUint64(p.data[SIZE_OF_PAGE_HEAD:], pgNo)
+}
+
+func (p *Pge) used() int {
+	return int(binary.BigEndian.Uint16(p.data[SIZE_OF_LSN+4:]))
+}
+
+func (p *Pge) setUsed(used int) {
+	binary.BigEndian.PutUint16(p.data[SIZE_OF_LSN+4:], uint16(used))
+}
+
+// writeOverflow stores value in a chain of overflow pages and returns the
+// first of them. The chain is built from its end, so every page knows the
+// next one when it is written.
+func (dm DM) writeOverflow(txn *Txn, value []byte) (uint64, error) {
+	next := uint64(NO_PAGE)
+
+	numOfPages := (len(value) + SIZE_OF_OVERFLOW_DATA - 1) / SIZE_OF_OVERFLOW_DATA
+	for i := numOfPages - 1; i >= 0; i-- {
+		chunk := value[i*SIZE_OF_OVERFLOW_DATA:]
+		if len(chunk) > SIZE_OF_OVERFLOW_DATA {
+			chunk = chunk[:SIZE_OF_OVERFLOW_DATA]
+		}
+
+		page, err := dm.Kacher.allocPage()
+		if err != nil {
+			return 0, err
+		}
+		page.latch.Lock()
+
+		before := page.image()
+
+		page.setKind(PAGE_OVERFLOW)
+		page.setNextPage(next)
+		page.setUsed(len(chunk))
+		copy(page.data[SIZE_OF_OVERFLOW_HEAD:], chunk)
+
+		err = txn.write(page, before)
+
+		page.latch.Unlock()
+		dm.Kacher.Unpin(page)
+		if err != nil {
+			return 0, err
+		}
+
+		next = page.index
+	}
+
+	return next, nil
+}
+
+// readOverflow reads back a value of length bytes stored from page first on.
+func (dm DM) readOverflow(first uint64, length int) ([]byte, error) {
+	value := make([]byte, 0, length)
+
+	for pgNo := first; len(value) < length; {
+		if pgNo == NO_PAGE {
+			return nil, ErrRecordCorrupted
+		}
+
+		page, err := dm.Kacher.GetPage(pgNo)
+		if err != nil {
+			return nil, err
+		}
+		page.latch.RLock()
+
+		corrupted := page.kind() != PAGE_OVERFLOW || page.used() > SIZE_OF_OVERFLOW_DATA
+		if !corrupted {
+			value = append(value, page.data[SIZE_OF_OVERFLOW_HEAD:SIZE_OF_OVERFLOW_HEAD+page.used()]...)
+			pgNo = page.nextPage()
+		}
+
+		page.latch.RUnlock()
+		dm.Kacher.Unpin(page)
+		if corrupted {
+			return nil, ErrRecordCorrupted
+		}
+	}
+
+	if len(value) != length {
+		return nil, ErrRecordCorrupted
+	}
+	return value, nil
+}
+
+// freeOverflow gives the chain starting at page first back.
+func (dm DM) freeOverflow(txn *Txn, first uint64) error {
+	for pgNo := first; pgNo != NO_PAGE; {
+		page, err := dm.Kacher.GetPage(pgNo)
+		if err != nil {
+			return err
+		}
+		page.latch.Lock()
+
+		if page.kind() != PAGE_OVERFLOW {
+			page.latch.Unlock()
+			dm.Kacher.Unpin(page)
+			return ErrRecordCorrupted
+		}
+
+		before := page.image()
+		next := page.nextPage()
+
+		page.setKind(PAGE_FREE)
+		err = txn.write(page, before)
+
+		page.latch.Unlock()
+		dm.Kacher.Unpin(page)
+		if err != nil {
+			return err
+		}
+
+		dm.Kacher.giveBackPage(pgNo)
+		pgNo = next
+	}
+	return nil
+}
+
+// overflowsOf returns the first overflow page of every value the record
+// keeps out of line.
+func (md *MetaData) overflowsOf(data []byte) ([]uint64, error) {
+	fields, err := md.fieldsOf(data)
+	if err != nil {
+		return nil, err
+	}
+
+	firsts := make([]uint64, 0)
+	for _, f := range fields {
+		if f.overflow {
+			firsts = append(firsts, binary.BigEndian.Uint64(data[f.begin+SIZE_OF_LENGTH:]))
+		}
+	}
+	return firsts, nil
+}
+
+// toast moves the largest values of a record into overflow pages until it
+// is small enough to share a page with others.
+func (dm DM) toast(txn *Txn, data []byte) ([]byte, error) {
+	md := dm.Kacher.Metadata
+
+	for len(data) > TOAST_THRESHOLD {
+		fields, err := md.fieldsOf(data)
+		if err != nil {
+			return nil, err
+		}
+
+		largest := -1
+		for i, f := range fields {
+			if f.overflow || !isVarLen(md.Types[f.col]) || f.end-f.begin <= SIZE_OF_POINTER {
+				continue
+			}
+			if largest == -1 || f.end-f.begin > fields[largest].end-fields[largest].begin {
+				largest = i
+			}
+		}
+		if largest == -1 {
+			break
+		}
+
+		f := fields[largest]
+
+		first, err := dm.writeOverflow(txn, data[f.begin+SIZE_OF_LENGTH:f.end])
+		if err != nil {
+			return nil, err
+		}
+
+		pointer := make([]byte, SIZE_OF_POINTER)
+		binary.BigEndian.PutUint32(pointer, uint32(f.end-f.begin-SIZE_OF_LENGTH)|OVERFLOW_FLAG)
+		binary.BigEndian.PutUint64(pointer[SIZE_OF_LENGTH:], first)
+
+		toasted := make([]byte, 0, len(data))
+		toasted = append(toasted, data[:f.begin]...)
+		toasted = append(toasted, pointer...)
+		data = append(toasted, data[f.end:]...)
+	}
+
+	if len(data) > int(dm.Kacher.sizeOfRecord) {
+		return nil, ErrRecordTooLarge
+	}
+	return data, nil
+}
+
+// detoast reads the values a record keeps in overflow pages back in line.
+func (dm DM) detoast(data []byte) ([]byte, error) {
+	fields, err := dm.Kacher.Metadata.fieldsOf(data)
+	if err != nil {
+		return nil, err
+	}
+
+	inline := make([]byte, 0, len(data))
+	pos := 0
+
+	for _, f := range fields {
+		if !f.overflow {
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint32(data[f.begin:]) &^ OVERFLOW_FLAG)
+		value, err := dm.readOverflow(binary.BigEndian.Uint64(data[f.begin+SIZE_OF_LENGTH:]), length)
+		if err != nil {
+			return nil, err
+		}
+
+		inline = append(inline, data[pos:f.begin+SIZE_OF_LENGTH]...)
+		binary.BigEndian.PutUint32(inline[len(inline)-SIZE_OF_LENGTH:], uint32(length))
+		inline = append(inline, value...)
+		pos = f.end
+	}
+
+	return append(inline, data[pos:]...), nil
+}
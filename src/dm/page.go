@@ -1,52 +1,307 @@
 package dm
 
-import "container/list"
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+	"sync"
+)
+
+// 分槽页：页头之后是槽目录，记录从页尾向前存放，中间是空闲区。
+// 页头：lsn(8) 页类型(1) 保留(1) 槽数(2) 空闲区末尾(2) 校验和(4)。
+// 校验和是整页（校验和字段记为0）的CRC32C，在页写到磁盘或日志时算出，读入时检查。
+// 槽：偏移(2) 长度(2)，偏移为0表示空槽。
+// 记录：xmin(8) xmax(8)，然后是编码后的行。
+
+const (
+	SIZE_OF_PAGE_HEAD = SIZE_OF_LSN + 10
+	CHECKSUM_OFFSET   = SIZE_OF_LSN + 6
+	SIZE_OF_SLOT      = 4
+	SIZE_OF_PGNO      = 8
+
+	PAGE_DATA     = 0
+	PAGE_OVERFLOW = 1
+	PAGE_FREE     = 2 // an overflow page given back
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError reports a page whose contents can not be trusted.
+type CorruptionError struct {
+	Path   string
+	PgNo   uint64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return "Page " + strconv.FormatUint(e.PgNo, 10) + " of " + e.Path + " is corrupted: " + e.Reason + "."
+}
 
 type Page interface {
-	Pgno() uint16
-	Data() []byte
-	Flush()
-	NumOfFreeList() uint16
+	PgNo() uint64
+	Flush() error
+	FreeSpace() int
 }
 
 type Pge struct {
-	index         uint16
-	data          []byte
-	numOfFreeList uint16
-	freeList      *list.List
-	kacher        *cacher
-	maxPos        uint16
+	index  uint64
+	data   []byte
+	kacher *cacher
+	lsn    uint64
+	latch  sync.RWMutex // readers share it, writers take it alone
+	pins   int          // users of the page, guarded by the pool
+	dirty  bool         // changed since it was last written back
 }
 
-func (p *Pge) PgNo() uint16 {
+func (p *Pge) PgNo() uint64 {
 	return p.index
 }
 
-func (p *Pge) SizeOfBlockHead() uint16 {
-	return 2 + 2*MaxNumOfRecord(p.kacher.sizeOfRecord)
+// Flush writes the page back. The block head is kept in sync by every
+// change, so readers holding the latch are not disturbed.
+func (p *Pge) Flush() error {
+	// WAL: the log must reach the disk before the page does.
+	if err := forceLog(p.lsn); err != nil {
+		return err
+	}
+
+	if err := writeThroughAt(p.kacher.dbFile, p.index, p.image()); err != nil {
+		return err
+	}
+
+	p.dirty = false
+	return nil
+}
+
+// syncBlockHead writes the lsn back into the block head.
+func (p *Pge) syncBlockHead() {
+	binary.BigEndian.PutUint64(p.data[0:], p.lsn)
+}
+
+// image returns a copy of the page as it is written to disk or the log,
+// carrying its lsn and checksum.
+func (p *Pge) image() []byte {
+	bts := make([]byte, len(p.data))
+	copy(bts, p.data)
+
+	binary.BigEndian.PutUint64(bts[0:], p.lsn)
+	binary.BigEndian.PutUint32(bts[CHECKSUM_OFFSET:], checksum(bts))
+	return bts
 }
 
-func (p *Pge) Flush() {
-	writeThroughAt(p.kacher.dbFile, uint16(p.index), p.data)
+// checksum returns the CRC32C of a page image, leaving its checksum out.
+func checksum(image []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, image[:CHECKSUM_OFFSET])
+	crc = crc32.Update(crc, castagnoli, make([]byte, 4))
+	return crc32.Update(crc, castagnoli, image[CHECKSUM_OFFSET+4:])
+}
+
+func validChecksum(image []byte) bool {
+	return binary.BigEndian.Uint32(image[CHECKSUM_OFFSET:]) == checksum(image)
+}
+
+// load rebuilds the page from an image read from disk or the log.
+func (p *Pge) load(data []byte) {
+	p.data = make([]byte, PAGE_SIZE)
+	copy(p.data, data)
+
+	p.lsn = binary.BigEndian.Uint64(data[0:])
 }
 
-func (p *Pge) FreeList() *list.List {
-	return p.freeList
+// format lays an empty slotted page out.
+func (p *Pge) format() {
+	p.setKind(PAGE_DATA)
+	p.setNumOfSlots(0)
+	p.setFreeEnd(PAGE_SIZE)
 }
 
-func (p *Pge) NumOfFreeList() uint16 {
-	return uint16(p.freeList.Len())
+func (p *Pge) kind() uint8 {
+	return p.data[SIZE_OF_LSN]
 }
 
-func (p *Pge) UpdateWith(bts []byte, pos uint16) {
-	sizeOfRecord := p.kacher.sizeOfRecord
-	begin := int(p.SizeOfBlockHead() + pos*sizeOfRecord)
-	for i := 0; i < int(sizeOfRecord); i++ {
-		p.data[begin+i] = bts[i]
+func (p *Pge) setKind(kind uint8) {
+	p.data[SIZE_OF_LSN] = kind
+}
+
+// numOfSlots returns the size of the slot directory, which is empty on
+// anything but a data page.
+func (p *Pge) numOfSlots() uint16 {
+	if p.kind() != PAGE_DATA {
+		return 0
 	}
+	return binary.BigEndian.Uint16(p.data[SIZE_OF_LSN+2:])
+}
+
+func (p *Pge) setNumOfSlots(n uint16) {
+	binary.BigEndian.PutUint16(p.data[SIZE_OF_LSN+2:], n)
+}
+
+func (p *Pge) freeEnd() int {
+	return int(binary.BigEndian.Uint16(p.data[SIZE_OF_LSN+4:]))
+}
+
+func (p *Pge) setFreeEnd(end int) {
+	binary.BigEndian.PutUint16(p.data[SIZE_OF_LSN+4:], uint16(end))
+}
+
+func (p *Pge) slot(i uint16) (int, int) {
+	entry := p.data[SIZE_OF_PAGE_HEAD+SIZE_OF_SLOT*int(i):]
+	return int(binary.BigEndian.Uint16(entry[0:])), int(binary.BigEndian.Uint16(entry[2:]))
+}
+
+func (p *Pge) setSlot(i uint16, offset int, length int) {
+	entry := p.data[SIZE_OF_PAGE_HEAD+SIZE_OF_SLOT*int(i):]
+	binary.BigEndian.PutUint16(entry[0:], uint16(offset))
+	binary.BigEndian.PutUint16(entry[2:], uint16(length))
+}
+
+// IsFree reports whether no record lives in the slot.
+func (p *Pge) IsFree(i uint16) bool {
+	if i >= p.numOfSlots() {
+		return true
+	}
+
+	offset, _ := p.slot(i)
+	return offset == 0
+}
+
+// FreeSpace returns the bytes left for records and slots, counting the holes
+// a compaction would close.
+func (p *Pge) FreeSpace() int {
+	if p.kind() != PAGE_DATA {
+		return 0
+	}
+
+	n := p.numOfSlots()
+
+	used := SIZE_OF_PAGE_HEAD + SIZE_OF_SLOT*int(n)
+	for i := uint16(0); i < n; i++ {
+		_, length := p.slot(i)
+		used += length
+	}
+	return PAGE_SIZE - used
+}
+
+// freeSlot returns an empty slot of the directory, if there is one.
+func (p *Pge) freeSlot() (uint16, bool) {
+	n := p.numOfSlots()
+	for i := uint16(0); i < n; i++ {
+		if offset, _ := p.slot(i); offset == 0 {
+			return i, true
+		}
+	}
+	return n, false
+}
+
+// room returns the size of the largest tuple which fits into the page.
+func (p *Pge) room() int {
+	if p.kind() != PAGE_DATA {
+		return 0
+	}
+
+	if _, reuse := p.freeSlot(); reuse {
+		return p.FreeSpace()
+	}
+	if p.numOfSlots() >= p.kacher.slotsPerPage || p.FreeSpace() < SIZE_OF_SLOT {
+		return 0
+	}
+	return p.FreeSpace() - SIZE_OF_SLOT
+}
+
+// roomFor reports whether a tuple of size bytes fits into the page.
+func (p *Pge) roomFor(size int) bool {
+	return size <= p.room()
+}
+
+// markDirty records a change to the page, keeping the free-space map of its
+// table up to date.
+func (p *Pge) markDirty() {
+	p.dirty = true
+	p.kacher.fsm.set(p.index, p.room())
+}
+
+// insert stores the tuple and returns its slot, compacting the page first if
+// the free space is scattered.
+func (p *Pge) insert(tuple []byte) (uint16, bool) {
+	if !p.roomFor(len(tuple)) {
+		return 0, false
+	}
+
+	slot, reuse := p.freeSlot()
+
+	need := len(tuple)
+	if !reuse {
+		need += SIZE_OF_SLOT
+	}
+
+	if p.freeEnd()-SIZE_OF_PAGE_HEAD-SIZE_OF_SLOT*int(p.numOfSlots()) < need {
+		p.compact()
+	}
+
+	if !reuse {
+		p.setNumOfSlots(slot + 1)
+	}
+
+	begin := p.freeEnd() - len(tuple)
+	copy(p.data[begin:], tuple)
+
+	p.setFreeEnd(begin)
+	p.setSlot(slot, begin, len(tuple))
+	return slot, true
+}
+
+// free empties the slot. Its bytes are given back by the next compaction.
+func (p *Pge) free(i uint16) {
+	p.setSlot(i, 0, 0)
+
+	n := p.numOfSlots()
+	for n > 0 {
+		if offset, _ := p.slot(n - 1); offset != 0 {
+			break
+		}
+		n--
+	}
+	p.setNumOfSlots(n)
+}
+
+// compact moves every tuple to the end of the page, so the free space is
+// in one piece again. Slots keep their numbers.
+func (p *Pge) compact() {
+	bts := make([]byte, PAGE_SIZE)
+	end := PAGE_SIZE
+
+	n := p.numOfSlots()
+	for i := uint16(0); i < n; i++ {
+		offset, length := p.slot(i)
+		if offset == 0 {
+			continue
+		}
+
+		end -= length
+		copy(bts[end:], p.data[offset:offset+length])
+		p.setSlot(i, end, length)
+	}
+
+	copy(p.data[end:], bts[end:])
+	p.setFreeEnd(end)
+}
+
+func (p *Pge) tuple(i uint16) []byte {
+	offset, length := p.slot(i)
+	return p.data[offset : offset+length]
+}
+
+// record returns the encoded row stored in the slot.
+func (p *Pge) record(i uint16) []byte {
+	return p.tuple(i)[SIZE_OF_VERSION:]
+}
+
+// versionOf returns the transactions which created and deleted the record.
+func (p *Pge) versionOf(i uint16) (uint64, uint64) {
+	version := p.tuple(i)
+	return binary.BigEndian.Uint64(version[0:]), binary.BigEndian.Uint64(version[8:])
 }
 
-func (p *Pge) MarkDeleteOn(pos uint16) {
-	begin := p.SizeOfBlockHead() + p.kacher.sizeOfRecord*pos
-	p.data[begin] = p.data[begin] | 0x80
+func (p *Pge) stampXmax(i uint16, xmax uint64) {
+	binary.BigEndian.PutUint64(p.tuple(i)[8:], xmax)
 }
@@ -0,0 +1,129 @@
+package dm
+
+import (
+	"os"
+	"sync"
+)
+
+// 页文件：索引等不存记录的文件。页同样放在缓冲池里，改动同样记日志，
+// 回滚和崩溃恢复都与表文件一样。第0页是文件头，魔数由使用者给出；
+// 其余各页的页类型为PAGE_OTHER，页头之后的内容由使用者安排。
+
+const PAGE_OTHER = 3
+
+type PageFile struct {
+	kacher *cacher
+}
+
+// CreatePageFile lays a new page file out and opens it.
+func CreatePageFile(path string, magic string) (*PageFile, error) {
+	if err := openLog(); err != nil {
+		return nil, err
+	}
+
+	file, err := createFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileHeader(file, magic); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	md := &MetaData{Magic: magic, Version: FORMAT_VERSION}
+	return &PageFile{newCacher(file, md, FIRST_PAGE)}, nil
+}
+
+// OpenPageFile opens a page file, refusing one with another magic.
+func OpenPageFile(path string, magic string) (*PageFile, error) {
+	if err := openLog(); err != nil {
+		return nil, err
+	}
+
+	file, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &MetaData{Magic: magic, Version: FORMAT_VERSION}
+	if err := checkFileHeader(file, magic, md); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	numOfPages := getSizeOfFile(file) / PAGE_SIZE
+	return &PageFile{newCacher(file, md, uint64(numOfPages))}, nil
+}
+
+// Page returns the page pinned, the caller must Unpin it when done.
+func (f *PageFile) Page(pgNo uint64) (*Pge, error) {
+	return f.kacher.GetPage(pgNo)
+}
+
+// NewPage adds an empty page to the end of the file and returns it pinned.
+func (f *PageFile) NewPage() (*Pge, error) {
+	f.kacher.mu.Lock()
+	defer f.kacher.mu.Unlock()
+
+	page, err := f.kacher.appendPage()
+	if err != nil {
+		return nil, err
+	}
+
+	page.setKind(PAGE_OTHER)
+	page.markDirty()
+	return page, nil
+}
+
+// BelongsTo names the table and index the file holds, as sys_buffer_stats
+// shows them.
+func (f *PageFile) BelongsTo(table string, index string) {
+	sharedPool.own(f.kacher.dbFile.Name(), table, index)
+}
+
+func (f *PageFile) Unpin(page *Pge) {
+	f.kacher.Unpin(page)
+}
+
+func (f *PageFile) NumOfPages() uint64 {
+	return f.kacher.NumOfBlocks()
+}
+
+// Flush writes the dirty pages of the file back, for a file written without
+// a transaction.
+func (f *PageFile) Flush() error {
+	return sharedPool.flushFile(f.kacher.dbFile.Name())
+}
+
+// Close forgets the pages of the file, which must have been flushed.
+func (f *PageFile) Close() error {
+	sharedPool.discard(f.kacher.dbFile.Name())
+	return f.kacher.dbFile.Close()
+}
+
+// Remove closes the file and deletes it.
+func (f *PageFile) Remove() error {
+	path := f.kacher.dbFile.Name()
+	f.Close()
+	return os.Remove(path)
+}
+
+// Body returns the bytes of a page of a page file after its head.
+func (p *Pge) Body() []byte {
+	return p.data[SIZE_OF_PAGE_HEAD:]
+}
+
+// Latch returns the latch guarding the page, which readers share and
+// writers take alone.
+func (p *Pge) Latch() *sync.RWMutex {
+	return &p.latch
+}
+
+// Change runs fn on the body of a page of a page file and logs the change.
+// The page must be latched. A nil Txn changes it without logging.
+func (t *Txn) Change(page *Pge, fn func(body []byte)) error {
+	before := page.image()
+	fn(page.Body())
+	return t.write(page, before)
+}
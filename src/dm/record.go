@@ -0,0 +1,274 @@
+package dm
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strings"
+)
+
+// 行编码：先是null位图，然后依次存放非空列的值。
+// INT占2字节，DOUBLE占8字节。
+// STRING、TEXT和BLOB是4字节长度加实际内容；长度最高位为1时，
+// 内容在溢出页中，长度之后只存8字节的首个溢出页页号。
+
+const (
+	SIZE_OF_LENGTH  = 4
+	SIZE_OF_POINTER = SIZE_OF_LENGTH + SIZE_OF_PGNO // length + first overflow page
+	OVERFLOW_FLAG   = 1 << 31
+
+	TOAST_THRESHOLD = PAGE_SIZE / 4 // larger records move values out
+)
+
+var (
+	ErrWrongValues     = errors.New("Values do not match the columns.")
+	ErrValueTooLong    = errors.New("Value is too long for the column.")
+	ErrOutOfRange      = errors.New("Value is out of range for the column, an INT is 0 to 65535.")
+	ErrRecordCorrupted = errors.New("Record is corrupted.")
+	ErrRecordTooLarge  = errors.New("Record is too large for a page.")
+)
+
+// field is where a non-null value sits in a record. Values of variable
+// length begin with their length.
+type field struct {
+	col      int
+	begin    int
+	end      int
+	overflow bool
+}
+
+func sizeOfNulls(numOfCols int) int {
+	return (numOfCols + 7) / 8
+}
+
+func isVarLen(tp string) bool {
+	return tp == "STRING" || tp == "TEXT" || tp == "BLOB"
+}
+
+// sizeOfRecord returns the size of the largest record of a table as
+// stored, after large values are moved to overflow pages.
+func sizeOfRecord(types []string, lens []uint16) int {
+	full := sizeOfNulls(len(types))
+	toasted := sizeOfNulls(len(types))
+	bounded := true
+
+	for i, tp := range types {
+		switch tp {
+		case "INT":
+			full += 2
+			toasted += 2
+		case "DOUBLE":
+			full += 8
+			toasted += 8
+		case "STRING":
+			full += SIZE_OF_LENGTH + int(lens[i])
+			toasted += SIZE_OF_POINTER
+		default: // TEXT and BLOB have no limit.
+			bounded = false
+			toasted += SIZE_OF_POINTER
+		}
+	}
+
+	if toasted < TOAST_THRESHOLD {
+		toasted = TOAST_THRESHOLD
+	}
+	if bounded && full < toasted {
+		return full
+	}
+	return toasted
+}
+
+// minSizeOfRecord returns the size of the smallest record of a table.
+func minSizeOfRecord(types []string, nullables []bool) int {
+	size := sizeOfNulls(len(types))
+	for i, tp := range types {
+		if nullables[i] {
+			continue
+		}
+
+		switch tp {
+		case "INT":
+			size += 2
+		case "DOUBLE":
+			size += 8
+		default:
+			size += SIZE_OF_LENGTH
+		}
+	}
+	return size
+}
+
+// blobValue takes a BLOB given as a string, 0x-prefixed hex is decoded.
+func blobValue(s string) []byte {
+	if strings.HasPrefix(s, "0x") {
+		if bts, err := hex.DecodeString(s[2:]); err == nil {
+			return bts
+		}
+	}
+	return []byte(s)
+}
+
+// IsInt reports whether an INT column can hold the value, it takes 2 bytes.
+func IsInt(integer int64) bool {
+	return integer >= 0 && integer <= math.MaxUint16
+}
+
+// EncodeRecord turns the values of a row into a record. A value is nil for
+// NULL, int64 for INT, float64 for DOUBLE, string for STRING and TEXT and
+// []byte or string for BLOB.
+func (md *MetaData) EncodeRecord(values []interface{}) ([]byte, error) {
+	if len(values) != len(md.Cols) {
+		return nil, ErrWrongValues
+	}
+
+	data := make([]byte, sizeOfNulls(len(md.Cols)), md.SizeOfRecord)
+
+	for i, v := range values {
+		if v == nil {
+			data[i/8] |= 0x80 >> uint(i%8)
+			continue
+		}
+
+		var bts []byte
+
+		switch md.Types[i] {
+		case "INT":
+			integer, ok := v.(int64)
+			if !ok {
+				return nil, ErrWrongValues
+			}
+			if !IsInt(integer) {
+				return nil, ErrOutOfRange
+			}
+
+			bts = make([]byte, 2)
+			binary.BigEndian.PutUint16(bts, uint16(integer))
+
+		case "DOUBLE":
+			double, ok := v.(float64)
+			if !ok {
+				return nil, ErrWrongValues
+			}
+
+			bts = make([]byte, 8)
+			binary.BigEndian.PutUint64(bts, math.Float64bits(double))
+
+		case "BLOB":
+			switch blob := v.(type) {
+			case []byte:
+				bts = blob
+			case string:
+				bts = blobValue(blob)
+			default:
+				return nil, ErrWrongValues
+			}
+
+		default:
+			s, ok := v.(string)
+			if !ok {
+				return nil, ErrWrongValues
+			}
+			if md.Types[i] == "STRING" && len(s) > int(md.Lens[i]) {
+				return nil, ErrValueTooLong
+			}
+			bts = []byte(s)
+		}
+
+		if isVarLen(md.Types[i]) {
+			if len(bts) >= OVERFLOW_FLAG {
+				return nil, ErrValueTooLong
+			}
+
+			length := make([]byte, SIZE_OF_LENGTH)
+			binary.BigEndian.PutUint32(length, uint32(len(bts)))
+			data = append(data, length...)
+		}
+		data = append(data, bts...)
+	}
+
+	return data, nil
+}
+
+// DecodeRecord turns a record back into the values of its row.
+func (md *MetaData) DecodeRecord(data []byte) ([]interface{}, error) {
+	fields, err := md.fieldsOf(data)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(md.Cols))
+
+	for _, f := range fields {
+		if f.overflow {
+			return nil, ErrRecordCorrupted
+		}
+
+		switch md.Types[f.col] {
+		case "INT":
+			values[f.col] = int64(binary.BigEndian.Uint16(data[f.begin:]))
+		case "DOUBLE":
+			values[f.col] = math.Float64frombits(binary.BigEndian.Uint64(data[f.begin:]))
+		case "BLOB":
+			bts := make([]byte, f.end-f.begin-SIZE_OF_LENGTH)
+			copy(bts, data[f.begin+SIZE_OF_LENGTH:f.end])
+			values[f.col] = bts
+		default:
+			values[f.col] = string(data[f.begin+SIZE_OF_LENGTH : f.end])
+		}
+	}
+
+	return values, nil
+}
+
+// fieldsOf finds every non-null value of a record.
+func (md *MetaData) fieldsOf(data []byte) ([]field, error) {
+	return md.fieldsWith(data, SIZE_OF_POINTER)
+}
+
+// fieldsWith finds every non-null value of a record whose overflow pointers
+// take sizeOfPointer bytes, which depends on the format version.
+func (md *MetaData) fieldsWith(data []byte, sizeOfPointer int) ([]field, error) {
+	pos := sizeOfNulls(len(md.Cols))
+	if len(data) < pos {
+		return nil, ErrRecordCorrupted
+	}
+
+	fields := make([]field, 0, len(md.Cols))
+
+	for i, tp := range md.Types {
+		if data[i/8]&(0x80>>uint(i%8)) != 0 {
+			continue
+		}
+
+		f := field{col: i, begin: pos}
+
+		switch tp {
+		case "INT":
+			pos += 2
+		case "DOUBLE":
+			pos += 8
+		default:
+			if len(data) < pos+SIZE_OF_LENGTH {
+				return nil, ErrRecordCorrupted
+			}
+
+			length := binary.BigEndian.Uint32(data[pos:])
+			if length&OVERFLOW_FLAG != 0 {
+				f.overflow = true
+				pos += sizeOfPointer
+			} else {
+				pos += SIZE_OF_LENGTH + int(length)
+			}
+		}
+
+		if len(data) < pos {
+			return nil, ErrRecordCorrupted
+		}
+
+		f.end = pos
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
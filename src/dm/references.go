@@ -0,0 +1,98 @@
+package dm
+
+// FOREIGN KEY：子表的.meta记着外键，父表的.meta在Children中记着子表的名字，
+// 删父表的记录时才知道去看哪些表。先记到父表再建子表，
+// 所以Children中可能有没建成的表，找不到就不管。
+
+const (
+	CASCADE  = "CASCADE"
+	SET_NULL = "SET NULL"
+	RESTRICT = "RESTRICT"
+)
+
+// ForeignKey makes the columns of a table refer to the columns of a
+// PRIMARY KEY or UNIQUE constraint of Parent. OnDelete tells what becomes
+// of the records referring to a record deleted from Parent.
+type ForeignKey struct {
+	Name       string
+	Cols       []string
+	Parent     string
+	ParentCols []string
+	OnDelete   string
+}
+
+// AddChild records that the table child has a FOREIGN KEY to this one.
+func (dm DM) AddChild(child string) error {
+	md := dm.Kacher.Metadata
+	for _, c := range md.Children {
+		if c == child {
+			return nil
+		}
+	}
+
+	md.Children = append(md.Children, child)
+	if err := saveMetaData(dm.TableName, md); err != nil {
+		md.Children = md.Children[:len(md.Children)-1]
+		return err
+	}
+	return nil
+}
+
+// RemoveChild forgets the table child.
+func (dm DM) RemoveChild(child string) error {
+	md := dm.Kacher.Metadata
+
+	children := make([]string, 0, len(md.Children))
+	for _, c := range md.Children {
+		if c != child {
+			children = append(children, c)
+		}
+	}
+
+	old := md.Children
+	md.Children = children
+	if err := saveMetaData(dm.TableName, md); err != nil {
+		md.Children = old
+		return err
+	}
+	return nil
+}
+
+// LiveRecord returns the record at rid, or nil if it has been deleted,
+// whatever snapshot wrote it. A FOREIGN KEY looks at the records as they
+// are now.
+func (dm DM) LiveRecord(rid RID) ([]byte, error) {
+	dm.Kacher.moving.RLock()
+	defer dm.Kacher.moving.RUnlock()
+
+	page, err := dm.Kacher.GetPage(rid.PgNo)
+	if err != nil {
+		return nil, err
+	}
+	defer dm.Kacher.Unpin(page)
+
+	page.latch.RLock()
+
+	if page.kind() != PAGE_DATA || page.IsFree(rid.Slot) {
+		page.latch.RUnlock()
+		return nil, nil
+	}
+	if _, xmax := page.versionOf(rid.Slot); xmax != 0 {
+		page.latch.RUnlock()
+		return nil, nil
+	}
+
+	record := page.record(rid.Slot)
+	data := make([]byte, len(record))
+	copy(data, record)
+	page.latch.RUnlock()
+
+	return dm.detoast(data)
+}
+
+// LiveRecords calls fn with every record not deleted.
+func (dm DM) LiveRecords(fn func(rid RID, data []byte) error) error {
+	return dm.scanVersions(func(xmin uint64, xmax uint64) bool {
+		return xmax == 0
+	}, fn)
+}
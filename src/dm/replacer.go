@@ -0,0 +1,151 @@
+package dm
+
+import "errors"
+
+// replacer picks which frame of a buffer pool to evict. Only frames marked
+// evictable, i.e. unpinned, are ever chosen.
+type replacer interface {
+	recordAccess(key pageKey)
+	setEvictable(key pageKey, evictable bool)
+	victim() (pageKey, bool)
+	remove(key pageKey)
+}
+
+const (
+	POLICY_LRU_K = "LRU-K"
+	POLICY_CLOCK = "CLOCK"
+
+	LRU_K = 2
+)
+
+var ErrUnknownPolicy = errors.New("Unknown replacement policy.")
+
+func newReplacer(policy string) replacer {
+	if policy == POLICY_CLOCK {
+		return &clockReplacer{
+			ref:       make(map[pageKey]bool),
+			evictable: make(map[pageKey]bool),
+		}
+	}
+
+	return &lruKReplacer{
+		k:         LRU_K,
+		history:   make(map[pageKey][]uint64),
+		evictable: make(map[pageKey]bool),
+	}
+}
+
+// lruKReplacer evicts the frame whose k-th most recent access is the oldest.
+// Frames accessed fewer than k times go first, least recently used first.
+type lruKReplacer struct {
+	k         int
+	now       uint64
+	history   map[pageKey][]uint64 // the last k access times, oldest first
+	evictable map[pageKey]bool
+}
+
+func (r *lruKReplacer) recordAccess(key pageKey) {
+	r.now++
+
+	history := append(r.history[key], r.now)
+	if len(history) > r.k {
+		history = history[1:]
+	}
+	r.history[key] = history
+}
+
+func (r *lruKReplacer) setEvictable(key pageKey, evictable bool) {
+	if evictable {
+		r.evictable[key] = true
+	} else {
+		delete(r.evictable, key)
+	}
+}
+
+func (r *lruKReplacer) victim() (pageKey, bool) {
+	var victim pageKey
+	found, victimInf, victimTime := false, false, uint64(0)
+
+	for key := range r.evictable {
+		history := r.history[key]
+		inf := len(history) < r.k
+
+		if !found || (inf && !victimInf) || (inf == victimInf && history[0] < victimTime) {
+			victim, found, victimInf, victimTime = key, true, inf, history[0]
+		}
+	}
+
+	if found {
+		r.remove(victim)
+	}
+	return victim, found
+}
+
+func (r *lruKReplacer) remove(key pageKey) {
+	delete(r.history, key)
+	delete(r.evictable, key)
+}
+
+// clockReplacer sweeps a hand over the frames, giving every recently
+// referenced one a second chance.
+type clockReplacer struct {
+	ring      []pageKey
+	hand      int
+	ref       map[pageKey]bool
+	evictable map[pageKey]bool
+}
+
+func (r *clockReplacer) recordAccess(key pageKey) {
+	if _, in := r.ref[key]; !in {
+		r.ring = append(r.ring, key)
+	}
+	r.ref[key] = true
+}
+
+func (r *clockReplacer) setEvictable(key pageKey, evictable bool) {
+	if evictable {
+		r.evictable[key] = true
+	} else {
+		delete(r.evictable, key)
+	}
+}
+
+func (r *clockReplacer) victim() (pageKey, bool) {
+	if len(r.evictable) == 0 {
+		return pageKey{}, false
+	}
+
+	// two rounds clear every reference bit at worst.
+	for i := 0; i <= 2*len(r.ring); i++ {
+		if r.hand >= len(r.ring) {
+			r.hand = 0
+		}
+
+		key := r.ring[r.hand]
+		if r.evictable[key] {
+			if !r.ref[key] {
+				r.remove(key)
+				return key, true
+			}
+			r.ref[key] = false
+		}
+		r.hand++
+	}
+
+	return pageKey{}, false
+}
+
+func (r *clockReplacer) remove(key pageKey) {
+	for i, k := range r.ring {
+		if k == key {
+			r.ring = append(r.ring[:i], r.ring[i+1:]...)
+			if i < r.hand {
+				r.hand--
+			}
+			break
+		}
+	}
+
+	delete(r.ref, key)
+	delete(r.evictable, key)
+}
@@ -0,0 +1,33 @@
+package dm
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+const SIZE_OF_RID = SIZE_OF_PGNO + 2
+
+// RID names a record by the page it lives in and its slot in the page.
+type RID struct {
+	PgNo uint64
+	Slot uint16
+}
+
+func (rid RID) String() string {
+	return "(" + strconv.FormatUint(rid.PgNo, 10) + "," + strconv.FormatUint(uint64(rid.Slot), 10) + ")"
+}
+
+// Bytes encodes the RID so that encoded RIDs sort like the records in the file.
+func (rid RID) Bytes() []byte {
+	bts := make([]byte, SIZE_OF_RID)
+	binary.BigEndian.PutUint64(bts[0:], rid.PgNo)
+	binary.BigEndian.PutUint16(bts[SIZE_OF_PGNO:], rid.Slot)
+	return bts
+}
+
+func RIDFrom(bts []byte) RID {
+	return RID{
+		PgNo: binary.BigEndian.Uint64(bts[0:]),
+		Slot: binary.BigEndian.Uint16(bts[SIZE_OF_PGNO:]),
+	}
+}
@@ -0,0 +1,314 @@
+package dm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Txn groups changes to any number of tables into one atomic unit.
+//
+// Readers never block: every transaction reads from the snapshot taken by its
+// first statement. Writers are serialized, and a writer only gets its id when
+// it takes the write lock, so its versions stay invisible to every snapshot
+// taken before it commits. The write lock is held until the transaction ends,
+// across round trips to its client, so a writer waiting longer than
+// LOCK_TIMEOUT for it gives up with ErrSerialization.
+type Txn struct {
+	id      uint64
+	snap    *snapshot
+	writing bool
+	undo    []undoEntry
+	logged  bool
+	tables  map[*cacher]bool // tables written, see end
+}
+
+type snapshot struct {
+	xmax    uint64 // transactions from xmax on are invisible
+	writer  uint64 // the writer in progress when the snapshot was taken
+	commits uint64 // writer commits seen when the snapshot was taken
+}
+
+type undoEntry struct {
+	kacher *cacher
+	pgNo   uint64
+	before []byte
+}
+
+const LOCK_TIMEOUT = 10 * time.Second // longest wait for the write lock
+
+var lockTimeout = LOCK_TIMEOUT // the tests wait less
+
+var ErrSerialization = errors.New("Could not serialize access due to a concurrent update.")
+
+// writeLock is a mutex a writer can stop waiting for.
+type writeLock chan struct{}
+
+func (l writeLock) Lock() {
+	l <- struct{}{}
+}
+
+func (l writeLock) Unlock() {
+	<-l
+}
+
+// lockWithin reports whether the lock was taken before timeout passed.
+func (l writeLock) lockWithin(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+var (
+	txnLock = make(writeLock, 1) // held by the one writer in progress
+
+	snapLock  sync.Mutex
+	writer    uint64
+	commits   uint64
+	snapshots = make(map[*Txn]uint64)
+)
+
+func Begin() (*Txn, error) {
+	if err := openLog(); err != nil {
+		return nil, err
+	}
+
+	return &Txn{}, nil
+}
+
+// LockForWrite makes t the writer. A transaction whose snapshot has missed
+// a commit since can not write anymore, nor one kept waiting LOCK_TIMEOUT
+// by another writer.
+func (t *Txn) LockForWrite() error {
+	if t.writing {
+		return nil
+	}
+
+	if !txnLock.lockWithin(lockTimeout) {
+		return ErrSerialization
+	}
+
+	snapLock.Lock()
+	defer snapLock.Unlock()
+
+	if t.snap != nil && t.snap.commits != commits {
+		txnLock.Unlock()
+		return ErrSerialization
+	}
+
+	wal.mu.Lock()
+	t.id = wal.nextTxn
+	wal.nextTxn++
+	wal.active++
+	wal.mu.Unlock()
+
+	t.writing = true
+	writer = t.id
+	if t.snap == nil {
+		t.takeSnapshot()
+	}
+	return nil
+}
+
+// takeSnapshot must be called with snapLock held.
+func (t *Txn) takeSnapshot() {
+	wal.mu.Lock()
+	xmax := wal.nextTxn
+	wal.mu.Unlock()
+
+	t.snap = &snapshot{xmax, writer, commits}
+
+	// the snapshot doesn't see the writer in progress either, what it
+	// deletes is not garbage while t runs.
+	if writer != 0 && writer < xmax {
+		xmax = writer
+	}
+	snapshots[t] = xmax
+}
+
+func (t *Txn) snapshot() *snapshot {
+	if t.snap == nil {
+		snapLock.Lock()
+		t.takeSnapshot()
+		snapLock.Unlock()
+	}
+	return t.snap
+}
+
+// committed reports whether the work of transaction id is visible to t.
+func (t *Txn) committed(id uint64) bool {
+	if id == 0 {
+		return false
+	}
+	if id == t.id {
+		return true
+	}
+
+	snap := t.snapshot()
+	return id < snap.xmax && id != snap.writer
+}
+
+// sees reports whether a version stamped with xmin and xmax is visible to t.
+func (t *Txn) sees(xmin uint64, xmax uint64) bool {
+	return t.committed(xmin) && !t.committed(xmax)
+}
+
+// horizon returns the oldest transaction id some snapshot may still need.
+// Versions deleted by a committed transaction below it are garbage.
+func horizon() uint64 {
+	snapLock.Lock()
+	defer snapLock.Unlock()
+
+	wal.mu.Lock()
+	oldest := wal.nextTxn
+	wal.mu.Unlock()
+
+	for _, xmax := range snapshots {
+		if xmax < oldest {
+			oldest = xmax
+		}
+	}
+	return oldest
+}
+
+func (t *Txn) Commit() error {
+	return t.end(LOG_COMMIT)
+}
+
+func (t *Txn) Rollback() error {
+	if err := t.RollbackTo(0); err != nil {
+		return err
+	}
+	return t.end(LOG_ABORT)
+}
+
+func (t *Txn) end(kind uint8) error {
+	snapLock.Lock()
+	delete(snapshots, t)
+	snapLock.Unlock()
+
+	if !t.writing {
+		return nil
+	}
+	defer txnLock.Unlock()
+
+	err := t.finish(kind)
+	for kacher := range t.tables {
+		if err == nil {
+			err = kacher.fsm.flush()
+		}
+	}
+	if err == nil {
+		err = checkpoint()
+	}
+
+	snapLock.Lock()
+	writer = 0
+	if kind == LOG_COMMIT {
+		commits++
+	}
+	snapLock.Unlock()
+
+	return err
+}
+
+// Savepoint marks the current point of the transaction for RollbackTo.
+func (t *Txn) Savepoint() int {
+	return len(t.undo)
+}
+
+// RollbackTo undoes every change made after the savepoint. The restored
+// images are logged again so a later commit does not redo the undone work.
+func (t *Txn) RollbackTo(savepoint int) error {
+	for i := len(t.undo) - 1; i >= savepoint; i-- {
+		entry := t.undo[i]
+
+		page, err := entry.kacher.GetPage(entry.pgNo)
+		if err != nil {
+			return err
+		}
+		page.latch.Lock()
+
+		current := page.image()
+		page.load(entry.before)
+
+		err = t.logPage(page, current)
+		page.markDirty()
+
+		page.latch.Unlock()
+		entry.kacher.Unpin(page)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.undo = t.undo[:savepoint]
+	return nil
+}
+
+// write logs the change made to page, remembers how to undo it and marks
+// the page dirty. The buffer pool writes it back later. A nil Txn writes
+// without logging, for a file no one else sees yet, see upgrade.go.
+func (t *Txn) write(page *Pge, before []byte) error {
+	if t == nil {
+		page.markDirty()
+		return nil
+	}
+
+	if err := t.logPage(page, before); err != nil {
+		return err
+	}
+
+	t.undo = append(t.undo, undoEntry{page.kacher, page.index, before})
+	page.markDirty()
+
+	if t.tables == nil {
+		t.tables = make(map[*cacher]bool)
+	}
+	t.tables[page.kacher] = true
+	return nil
+}
+
+// logPage stamps a fresh LSN into the page and appends its before and after
+// images. The page must be flushed only after the log is forced to its LSN.
+func (t *Txn) logPage(page *Pge, before []byte) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	t.logged = true
+	page.lsn = wal.nextLSN
+	page.syncBlockHead()
+
+	after := page.image()
+
+	return wal.append(&logRecord{
+		lsn:    page.lsn,
+		txn:    t.id,
+		kind:   LOG_PAGE,
+		path:   page.kacher.dbFile.Name(),
+		pgNo:   page.index,
+		before: before,
+		after:  after,
+	})
+}
+
+func (t *Txn) finish(kind uint8) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	wal.active--
+	if !t.logged { // nothing to make durable for a read-only transaction.
+		return nil
+	}
+
+	if err := wal.append(&logRecord{lsn: wal.nextLSN, txn: t.id, kind: kind}); err != nil {
+		return err
+	}
+	return wal.force(wal.nextLSN - 1)
+}
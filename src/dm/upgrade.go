@@ -0,0 +1,331 @@
+package dm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// 格式升级：dm.Open发现.meta中的版本低于FORMAT_VERSION时，把表重写为当前格式。
+// 新的.db和.meta先写到带.upgrade后缀的文件中，.meta最后写，然后改名替换旧文件；
+// 中途崩溃的话，下次打开时丢弃不完整的文件，或者接着完成改名。
+// 版本1（.meta中没有Version）：页号2字节，溢出页的下一页页号存在槽数的位置，
+// 内容紧跟页头，溢出指针是长度加2字节页号。
+// 版本2：页号8字节，溢出页的下一页页号(8)紧跟页头。
+// 版本1和2都没有文件头页，记录页从第0页开始，.meta中也没有魔数。
+// 版本3及以前的页头没有校验和，只有14字节。
+
+const (
+	SUFFIX_UPGRADE = ".upgrade"
+
+	SIZE_OF_POINTER_V1   = SIZE_OF_LENGTH + 2
+	NO_PAGE_V1           = 0xFFFF
+	SIZE_OF_PAGE_HEAD_V3 = SIZE_OF_LSN + 6
+)
+
+var ErrUpgradeFailed = errors.New("Failed to upgrade the table.")
+
+// upgrade brings the files of a table to FORMAT_VERSION. Recovery must have
+// run before, so the old file holds committed work only.
+func upgrade(tableName string) error {
+	if err := finishUpgrade(tableName); err != nil {
+		return err
+	}
+
+	metaFile, err := openFile(tableName + SUFFIX_META)
+	if err != nil {
+		return ErrNoSuchTable
+	}
+	md, err := getMetaData(metaFile)
+	metaFile.Close()
+	if err != nil {
+		return err
+	}
+
+	// newer files are refused by NewCacher.
+	if md.Version >= FORMAT_VERSION {
+		return nil
+	}
+
+	if err := rewrite(tableName, md); err != nil {
+		os.Remove(tableName + SUFFIX_DB + SUFFIX_UPGRADE)
+		os.Remove(tableName + SUFFIX_META + SUFFIX_UPGRADE)
+		return err
+	}
+	return finishUpgrade(tableName)
+}
+
+// finishUpgrade puts rewritten files in place. A complete .meta means the
+// .db has been written completely before.
+func finishUpgrade(tableName string) error {
+	dbPath, metaPath := tableName+SUFFIX_DB, tableName+SUFFIX_META
+
+	metaFile, err := os.Open(metaPath + SUFFIX_UPGRADE)
+	if err != nil {
+		os.Remove(dbPath + SUFFIX_UPGRADE)
+		return nil
+	}
+	_, err = getMetaData(metaFile)
+	metaFile.Close()
+
+	if err != nil { // cut short while writing the .meta
+		os.Remove(dbPath + SUFFIX_UPGRADE)
+		os.Remove(metaPath + SUFFIX_UPGRADE)
+		return nil
+	}
+
+	// the free-space map of the old file is of no use.
+	if err := os.Remove(tableName + SUFFIX_FSM); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(dbPath+SUFFIX_UPGRADE, dbPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(metaPath+SUFFIX_UPGRADE, metaPath)
+}
+
+// rewrite copies the live records of a table in an older format into a new
+// file, moving large values into overflow pages of the current format.
+// Records keep their xmin, so they stay visible to everyone.
+func rewrite(tableName string, md *MetaData) error {
+	old, err := openFile(tableName + SUFFIX_DB)
+	if err != nil {
+		return errors.New("Unable to Open dataFile")
+	}
+	defer old.Close()
+
+	version := md.Version
+	if version == 0 {
+		version = 1
+	}
+
+	// overflow pointers may be wider now.
+	size := sizeOfRecord(md.Types, md.Lens)
+	if size > MAX_SIZE_OF_RECORD {
+		return ErrRecordTooLarge
+	}
+	md.Magic = META_MAGIC
+	md.Version = FORMAT_VERSION
+	md.SizeOfRecord = uint16(size)
+
+	os.Remove(tableName + SUFFIX_DB + SUFFIX_UPGRADE)
+	dbFile, err := createFile(tableName + SUFFIX_DB + SUFFIX_UPGRADE)
+	if err != nil {
+		return err
+	}
+	defer dbFile.Close()
+
+	if err := writeFileHeader(dbFile, DB_MAGIC); err != nil {
+		return err
+	}
+
+	dm := DM{tableName, newCacher(dbFile, md, FIRST_PAGE)}
+	defer sharedPool.discard(dbFile.Name())
+
+	first := uint64(0)
+	if version >= 3 {
+		first = FIRST_PAGE
+	}
+
+	numOfPages := uint64(getSizeOfFile(old) / PAGE_SIZE)
+	for i := first; i < numOfPages; i++ {
+		page := readOldPage(old, i)
+		if page == nil || page.kind() != PAGE_DATA {
+			continue
+		}
+
+		for slot := uint16(0); slot < page.numOfSlots(); slot++ {
+			tuple, err := page.tuple(slot)
+			if err != nil {
+				return err
+			}
+			if tuple == nil {
+				continue
+			}
+
+			// a deleter on disk has committed.
+			xmin := binary.BigEndian.Uint64(tuple[0:])
+			if xmax := binary.BigEndian.Uint64(tuple[8:]); xmax != 0 {
+				continue
+			}
+
+			data, err := inlineOld(old, version, md, tuple[SIZE_OF_VERSION:])
+			if err != nil {
+				return err
+			}
+
+			if err := dm.copyIn(xmin, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := sharedPool.flushFile(dbFile.Name()); err != nil {
+		return err
+	}
+
+	metaData, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	metaFile, err := createFile(tableName + SUFFIX_META + SUFFIX_UPGRADE)
+	if err != nil {
+		return err
+	}
+	defer metaFile.Close()
+
+	writeThrough(metaFile, metaData)
+	return nil
+}
+
+// copyIn stores a record created by transaction xmin without logging it.
+func (dm DM) copyIn(xmin uint64, data []byte) error {
+	data, err := dm.toast(nil, data)
+	if err != nil {
+		return err
+	}
+
+	tuple := make([]byte, SIZE_OF_VERSION+len(data))
+	binary.BigEndian.PutUint64(tuple[0:], xmin)
+	copy(tuple[SIZE_OF_VERSION:], data)
+
+	page, err := dm.Kacher.GetPageFor(len(tuple))
+	if err != nil {
+		return err
+	}
+	defer dm.Kacher.Unpin(page)
+
+	page.latch.Lock()
+	defer page.latch.Unlock()
+
+	if _, ok := page.insert(tuple); !ok {
+		return errors.New("No room for the record.")
+	}
+	page.markDirty()
+	return nil
+}
+
+// oldPage is a page written before version 4, whose head had no checksum.
+type oldPage []byte
+
+func readOldPage(file *os.File, pgNo uint64) oldPage {
+	data := make([]byte, PAGE_SIZE)
+	if _, err := file.ReadAt(data, int64(pgNo)*PAGE_SIZE); err != nil {
+		return nil
+	}
+	return oldPage(data)
+}
+
+func (p oldPage) kind() uint8 {
+	return p[SIZE_OF_LSN]
+}
+
+func (p oldPage) numOfSlots() uint16 {
+	return binary.BigEndian.Uint16(p[SIZE_OF_LSN+2:])
+}
+
+func (p oldPage) used() int {
+	return int(binary.BigEndian.Uint16(p[SIZE_OF_LSN+4:]))
+}
+
+// tuple returns the tuple in slot i, or nil if the slot is free.
+func (p oldPage) tuple(i uint16) ([]byte, error) {
+	entry := SIZE_OF_PAGE_HEAD_V3 + SIZE_OF_SLOT*int(i)
+	if entry+SIZE_OF_SLOT > PAGE_SIZE {
+		return nil, ErrUpgradeFailed
+	}
+
+	offset := int(binary.BigEndian.Uint16(p[entry:]))
+	length := int(binary.BigEndian.Uint16(p[entry+2:]))
+	if offset == 0 {
+		return nil, nil
+	}
+	if length < SIZE_OF_VERSION || offset+length > PAGE_SIZE {
+		return nil, ErrUpgradeFailed
+	}
+	return p[offset : offset+length], nil
+}
+
+// inlineOld reads the values a record of an older format keeps in overflow
+// pages back in line.
+func inlineOld(file *os.File, version uint16, md *MetaData, data []byte) ([]byte, error) {
+	sizeOfPointer := SIZE_OF_POINTER
+	if version == 1 {
+		sizeOfPointer = SIZE_OF_POINTER_V1
+	}
+
+	fields, err := md.fieldsWith(data, sizeOfPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	inline := make([]byte, 0, len(data))
+	pos := 0
+
+	for _, f := range fields {
+		if !f.overflow {
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint32(data[f.begin:]) &^ OVERFLOW_FLAG)
+
+		var first uint64
+		if version == 1 {
+			first = uint64(binary.BigEndian.Uint16(data[f.begin+SIZE_OF_LENGTH:]))
+		} else {
+			first = binary.BigEndian.Uint64(data[f.begin+SIZE_OF_LENGTH:])
+		}
+
+		value, err := readOldOverflow(file, version, first, length)
+		if err != nil {
+			return nil, err
+		}
+
+		inline = append(inline, data[pos:f.begin+SIZE_OF_LENGTH]...)
+		binary.BigEndian.PutUint32(inline[len(inline)-SIZE_OF_LENGTH:], uint32(length))
+		inline = append(inline, value...)
+		pos = f.end
+	}
+
+	return append(inline, data[pos:]...), nil
+}
+
+func readOldOverflow(file *os.File, version uint16, first uint64, length int) ([]byte, error) {
+	value := make([]byte, 0, length)
+
+	for pgNo := first; len(value) < length; {
+		if pgNo == NO_PAGE || (version == 1 && pgNo == NO_PAGE_V1) {
+			return nil, ErrUpgradeFailed
+		}
+
+		page := readOldPage(file, pgNo)
+		if page == nil || page.kind() != PAGE_OVERFLOW {
+			return nil, ErrUpgradeFailed
+		}
+
+		begin := SIZE_OF_PAGE_HEAD_V3 + SIZE_OF_PGNO
+		if version == 1 {
+			begin = SIZE_OF_PAGE_HEAD_V3
+		}
+
+		used := page.used()
+		if begin+used > PAGE_SIZE {
+			return nil, ErrUpgradeFailed
+		}
+		value = append(value, page[begin:begin+used]...)
+
+		if version == 1 {
+			pgNo = uint64(binary.BigEndian.Uint16(page[SIZE_OF_LSN+2:]))
+		} else {
+			pgNo = binary.BigEndian.Uint64(page[SIZE_OF_PAGE_HEAD_V3:])
+		}
+	}
+
+	if len(value) != length {
+		return nil, ErrUpgradeFailed
+	}
+	return value, nil
+}
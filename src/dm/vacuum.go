@@ -0,0 +1,227 @@
+package dm
+
+// VACUUM：先回收死版本，再把表尾各页的记录搬到前面页的空闲空间里。
+// 记录连同xmin、xmax原样搬过去，对快照没有影响，但RID变了，
+// 搬迁时告诉表的Watcher，索引随之改过来。
+// 搬空一页时才挡住读者，读者扫描时也挡住搬迁，见cacher.moving。
+// 最后做一次检查点，把表尾的空页从文件中截掉：日志中不能再有这些页的记录，
+// 否则恢复时会把它们写回来。溢出页不搬，它之前的页截不掉；
+// 溢出链释放的页可以改作记录页，接收搬来的记录。
+
+// Vacuum packs the records of the table into the pages at its front and cuts
+// the file after the last page still in use. It returns the number of pages
+// given back.
+func (dm DM) Vacuum() (uint64, error) {
+	txn, err := Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := dm.CollectGarbage(txn); err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+
+	if err := dm.pack(txn); err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	return dm.truncate()
+}
+
+// pack empties the pages at the end of the table one by one, as long as the
+// pages before have room for their records.
+func (dm DM) pack(txn *Txn) error {
+	for pgNo := dm.Kacher.NumOfBlocks() - 1; pgNo > FIRST_PAGE; pgNo-- {
+		empty, err := dm.moveOut(txn, pgNo)
+		if err != nil || !empty {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveOut moves the records of the page to the first pages before it with
+// room, and reports whether the page is empty then.
+func (dm DM) moveOut(txn *Txn, pgNo uint64) (bool, error) {
+	kacher := dm.Kacher
+
+	kacher.moving.Lock()
+	defer kacher.moving.Unlock()
+
+	src, err := kacher.GetPage(pgNo)
+	if err != nil {
+		return false, err
+	}
+	defer kacher.Unpin(src)
+
+	// the records are copied out first, the pages before are fetched with no
+	// latch held, see the lock order in cache.go. Writers are kept out, the
+	// page stays as it is meanwhile.
+	src.latch.RLock()
+	kind := src.kind()
+	slots, tuples := make([]uint16, 0), make([][]byte, 0)
+	for slot := src.numOfSlots(); kind == PAGE_DATA && slot > 0; slot-- {
+		if src.IsFree(slot - 1) {
+			continue
+		}
+
+		tuple := make([]byte, len(src.tuple(slot-1)))
+		copy(tuple, src.tuple(slot-1))
+		slots, tuples = append(slots, slot-1), append(tuples, tuple)
+	}
+	src.latch.RUnlock()
+
+	switch kind {
+	case PAGE_FREE:
+		return true, nil
+	case PAGE_OVERFLOW:
+		return false, nil
+	}
+
+	froms, tos := make([]RID, 0), make([]RID, 0)
+	for i, tuple := range tuples {
+		var dst *Pge
+		if dst, err = kacher.pageBefore(len(tuple), pgNo); err != nil || dst == nil {
+			break
+		}
+
+		dst.latch.Lock()
+		dstBefore := dst.image()
+		if dst.kind() == PAGE_FREE {
+			dst.format()
+		}
+
+		to, ok := dst.insert(tuple)
+		if ok {
+			err = txn.write(dst, dstBefore)
+		}
+
+		dst.latch.Unlock()
+		kacher.Unpin(dst)
+		if !ok || err != nil {
+			break
+		}
+
+		froms, tos = append(froms, RID{pgNo, slots[i]}), append(tos, RID{dst.index, to})
+	}
+	tuples = tuples[:len(tos)]
+
+	// the source is logged once, after everything it gave away.
+	src.latch.Lock()
+	before := src.image()
+	for _, from := range froms {
+		src.free(from.Slot)
+	}
+	if len(froms) > 0 {
+		if werr := txn.write(src, before); err == nil {
+			err = werr
+		}
+	}
+	empty := src.numOfSlots() == 0
+	src.latch.Unlock()
+
+	if w := kacher.watcher; w != nil && err == nil {
+		for i, tuple := range tuples {
+			data, derr := dm.detoast(tuple[SIZE_OF_VERSION:])
+			if derr == nil {
+				derr = w.Moved(txn, data, froms[i], tos[i])
+			}
+			if derr != nil {
+				return false, derr
+			}
+		}
+	}
+	return err == nil && empty, err
+}
+
+// pageBefore returns the first page before end with room for a tuple of size
+// bytes pinned, or nil if there is none. A page given back by an overflow
+// chain does as well, the caller makes a data page of it.
+func (kacher *cacher) pageBefore(size int, end uint64) (*Pge, error) {
+	path := kacher.dbFile.Name()
+
+	for {
+		pgNo, ok := kacher.fsm.findBefore(size, end)
+		if !ok {
+			return kacher.freePageBefore(end)
+		}
+
+		page, err := sharedPool.fetch(path, pgNo, kacher.loadPageAt)
+		if err != nil {
+			return nil, err
+		}
+
+		page.latch.RLock()
+		room := page.room()
+		page.latch.RUnlock()
+
+		if size <= room {
+			return page, nil
+		}
+		kacher.fsm.set(pgNo, room)
+		sharedPool.unpin(path, page)
+	}
+}
+
+// truncate cuts the empty pages at the end of the table off the file. It
+// keeps writers out, and readers while the pages go.
+func (dm DM) truncate() (uint64, error) {
+	kacher := dm.Kacher
+
+	if !txnLock.lockWithin(lockTimeout) {
+		return 0, ErrSerialization
+	}
+	defer txnLock.Unlock()
+
+	kacher.moving.Lock()
+	defer kacher.moving.Unlock()
+
+	numOfBlocks := kacher.NumOfBlocks()
+
+	end := numOfBlocks
+	for end > FIRST_PAGE {
+		page, err := kacher.GetPage(end - 1)
+		if err != nil {
+			return 0, err
+		}
+
+		page.latch.RLock()
+		empty := page.kind() == PAGE_FREE || page.kind() == PAGE_DATA && page.numOfSlots() == 0
+		page.latch.RUnlock()
+		kacher.Unpin(page)
+
+		if !empty {
+			break
+		}
+		end--
+	}
+
+	if end == numOfBlocks {
+		return 0, nil
+	}
+
+	// no record in the log may refer to the pages cut off.
+	if err := forceCheckpoint(); err != nil {
+		return 0, err
+	}
+
+	kacher.mu.Lock()
+	defer kacher.mu.Unlock()
+
+	sharedPool.discardFrom(kacher.dbFile.Name(), end)
+	if err := kacher.dbFile.Truncate(int64(end) * PAGE_SIZE); err != nil {
+		return 0, err
+	}
+	if err := kacher.dbFile.Sync(); err != nil {
+		return 0, err
+	}
+
+	kacher.numOfBlocks = end
+
+	return numOfBlocks - end, kacher.fsm.truncate(end)
+}
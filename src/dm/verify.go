@@ -0,0 +1,70 @@
+package dm
+
+import "strconv"
+
+// Verify reads every page of the table from disk, past the buffer pool, and
+// returns the damaged ones along with the number of pages in the file. Pages
+// not written back yet are left out.
+func (dm DM) Verify() ([]*CorruptionError, uint64) {
+	file := dm.Kacher.dbFile
+	damaged := make([]*CorruptionError, 0)
+
+	if err := checkFileHeader(file, DB_MAGIC, dm.Kacher.Metadata); err != nil {
+		damaged = append(damaged, &CorruptionError{file.Name(), 0, "bad file header"})
+	}
+
+	size := getSizeOfFile(file)
+	numOfBlocks := uint64(size / PAGE_SIZE)
+	for i := uint64(FIRST_PAGE); i < numOfBlocks; i++ {
+		data, err := sharedPool.readThrough(file, i)
+		if err != nil {
+			damaged = append(damaged, err.(*CorruptionError))
+			continue
+		}
+
+		page := &Pge{index: i}
+		page.load(data)
+		if reason := page.check(); reason != "" {
+			damaged = append(damaged, &CorruptionError{file.Name(), i, reason})
+		}
+	}
+
+	if size%PAGE_SIZE != 0 {
+		damaged = append(damaged, &CorruptionError{file.Name(), numOfBlocks, "partial page"})
+	}
+
+	return damaged, numOfBlocks
+}
+
+// check returns what is wrong with the layout of the page, if anything.
+func (p *Pge) check() string {
+	switch p.kind() {
+	case PAGE_DATA:
+		n := p.numOfSlots()
+		end := p.freeEnd()
+		if SIZE_OF_PAGE_HEAD+SIZE_OF_SLOT*int(n) > end || end > PAGE_SIZE {
+			return "bad slot directory"
+		}
+
+		for i := uint16(0); i < n; i++ {
+			offset, length := p.slot(i)
+			if offset == 0 {
+				continue
+			}
+			if offset < end || offset+length > PAGE_SIZE || length < SIZE_OF_VERSION {
+				return "bad slot " + strconv.Itoa(int(i))
+			}
+		}
+
+	case PAGE_OVERFLOW:
+		if p.used() > SIZE_OF_OVERFLOW_DATA {
+			return "bad overflow length"
+		}
+
+	case PAGE_FREE:
+
+	default:
+		return "unknown page kind " + strconv.Itoa(int(p.kind()))
+	}
+	return ""
+}
@@ -0,0 +1,389 @@
+package dm
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"sync"
+)
+
+// 预写日志：所有表共用一个日志文件。
+// 每条页记录保存整页的前像和后像，页头记录最后一次修改的LSN。
+// 提交时强制刷日志；dm.Open时先做redo再做undo，然后截断日志。
+// 脏页留在缓冲池里，检查点先把脏页写回再截断日志。
+
+const (
+	WAL_FILE            = "lipDB.wal"
+	WAL_HEAD_SIZE       = 24      // nextLSN + nextTxn + version
+	WAL_HEAD_SIZE_V1    = 16      // version 1 had no version field
+	WAL_VERSION         = 2       // 1 had 16-bit page numbers
+	WAL_CHECKPOINT_SIZE = 1 << 20 // truncate the log once it grows past this
+
+	SIZE_OF_LSN = 8
+
+	LOG_PAGE   = 1
+	LOG_COMMIT = 2
+	LOG_ABORT  = 3
+)
+
+var ErrLogCorrupted = errors.New("Write-ahead log is corrupted.")
+
+type logRecord struct {
+	lsn    uint64
+	txn    uint64
+	kind   uint8
+	path   string
+	pgNo   uint64
+	before []byte
+	after  []byte
+}
+
+type logManager struct {
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	nextLSN    uint64
+	flushedLSN uint64
+	nextTxn    uint64
+	active     int
+}
+
+var (
+	wal     *logManager
+	walOnce sync.Once
+	walErr  error
+)
+
+// openLog opens the database log, running crash recovery the first time.
+func openLog() error {
+	walOnce.Do(func() {
+		wal, walErr = recoverDatabase(WAL_FILE)
+	})
+	return walErr
+}
+
+// forceLog makes sure the log is durable up to lsn before a page carrying
+// that lsn goes to disk.
+func forceLog(lsn uint64) error {
+	if wal == nil || lsn == 0 {
+		return nil
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.force(lsn)
+}
+
+// checkpoint starts the log over once it grows past WAL_CHECKPOINT_SIZE,
+// writing every dirty page back first. Only the writer may call it, so no
+// page changes meanwhile.
+func checkpoint() error {
+	wal.mu.Lock()
+	full := wal.active == 0 && wal.size > WAL_CHECKPOINT_SIZE
+	wal.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+	return forceCheckpoint()
+}
+
+// forceCheckpoint writes every dirty page back and starts the log over. The
+// caller must hold txnLock with no writer in progress.
+func forceCheckpoint() error {
+	if err := sharedPool.flushAll(); err != nil {
+		return err
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.truncate()
+}
+
+func (lm *logManager) force(lsn uint64) error {
+	if lsn <= lm.flushedLSN {
+		return nil
+	}
+	if err := lm.file.Sync(); err != nil {
+		return err
+	}
+	lm.flushedLSN = lm.nextLSN - 1
+	return nil
+}
+
+func (lm *logManager) append(rec *logRecord) error {
+	bts := encodeLogRecord(rec)
+	if _, err := lm.file.WriteAt(bts, lm.size); err != nil {
+		return err
+	}
+
+	lm.size += int64(len(bts))
+	lm.nextLSN = rec.lsn + 1
+	return nil
+}
+
+func (lm *logManager) truncate() error {
+	head := make([]byte, WAL_HEAD_SIZE)
+	binary.BigEndian.PutUint64(head[0:], lm.nextLSN)
+	binary.BigEndian.PutUint64(head[8:], lm.nextTxn)
+	binary.BigEndian.PutUint64(head[16:], WAL_VERSION)
+
+	if err := lm.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := lm.file.WriteAt(head, 0); err != nil {
+		return err
+	}
+	if err := lm.file.Sync(); err != nil {
+		return err
+	}
+
+	lm.size = WAL_HEAD_SIZE
+	lm.flushedLSN = lm.nextLSN - 1
+	return nil
+}
+
+// Record layout: size(4) crc(4) | lsn(8) txn(8) kind(1) pgNo(8)
+// pathLen(2) path beforeLen(2) before afterLen(2) after
+// Version 1 stored pgNo in 2 bytes.
+func encodeLogRecord(rec *logRecord) []byte {
+	size := 8 + 8 + 1 + SIZE_OF_PGNO + 2 + len(rec.path) + 2 + len(rec.before) + 2 + len(rec.after)
+	bts := make([]byte, 8+size)
+	body := bts[8:]
+
+	binary.BigEndian.PutUint64(body[0:], rec.lsn)
+	binary.BigEndian.PutUint64(body[8:], rec.txn)
+	body[16] = rec.kind
+	binary.BigEndian.PutUint64(body[17:], rec.pgNo)
+
+	i := 17 + SIZE_OF_PGNO
+	for _, field := range [][]byte{[]byte(rec.path), rec.before, rec.after} {
+		binary.BigEndian.PutUint16(body[i:], uint16(len(field)))
+		i += 2
+		i += copy(body[i:], field)
+	}
+
+	binary.BigEndian.PutUint32(bts[0:], uint32(size))
+	binary.BigEndian.PutUint32(bts[4:], crc32.ChecksumIEEE(body))
+	return bts
+}
+
+func decodeLogRecord(body []byte, version uint64) (*logRecord, error) {
+	i := 17 + SIZE_OF_PGNO
+	if version == 1 {
+		i = 17 + 2
+	}
+
+	if len(body) < i {
+		return nil, ErrLogCorrupted
+	}
+
+	rec := &logRecord{
+		lsn:  binary.BigEndian.Uint64(body[0:]),
+		txn:  binary.BigEndian.Uint64(body[8:]),
+		kind: body[16],
+	}
+	if version == 1 {
+		rec.pgNo = uint64(binary.BigEndian.Uint16(body[17:]))
+	} else {
+		rec.pgNo = binary.BigEndian.Uint64(body[17:])
+	}
+
+	fields := make([][]byte, 3)
+	for f := range fields {
+		if i+2 > len(body) {
+			return nil, ErrLogCorrupted
+		}
+		n := int(binary.BigEndian.Uint16(body[i:]))
+		i += 2
+		if i+n > len(body) {
+			return nil, ErrLogCorrupted
+		}
+		fields[f] = body[i : i+n]
+		i += n
+	}
+
+	rec.path = string(fields[0])
+	rec.before = fields[1]
+	rec.after = fields[2]
+	return rec, nil
+}
+
+// readLog returns every intact record; a torn tail left by a crash ends the scan.
+func readLog(file *os.File, size int64, version uint64) []*logRecord {
+	records := make([]*logRecord, 0)
+	head := make([]byte, 8)
+
+	off := int64(WAL_HEAD_SIZE)
+	if version == 1 {
+		off = WAL_HEAD_SIZE_V1
+	}
+
+	for off < size {
+		if _, err := file.ReadAt(head, off); err != nil {
+			break
+		}
+
+		// a size from a torn head may be anything, the record must fit in
+		// the file.
+		n := int64(binary.BigEndian.Uint32(head[0:]))
+		if off+8+n > size {
+			break
+		}
+		body := make([]byte, n)
+		if _, err := file.ReadAt(body, off+8); err != nil {
+			break
+		}
+
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[4:]) {
+			break
+		}
+
+		rec, err := decodeLogRecord(body, version)
+		if err != nil {
+			break
+		}
+
+		records = append(records, rec)
+		off += 8 + n
+	}
+
+	return records
+}
+
+func recoverDatabase(path string) (*logManager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.New("Unable to Open the log.")
+	}
+
+	lm := &logManager{file: file, nextLSN: 1, nextTxn: 1}
+
+	// a log without the version field was written by version 1, it is
+	// replayed as such and started over in the current format.
+	version := uint64(WAL_VERSION)
+
+	size := getSizeOfFile(file)
+	if size >= WAL_HEAD_SIZE_V1 {
+		head := make([]byte, WAL_HEAD_SIZE)
+		if _, err := file.ReadAt(head[:WAL_HEAD_SIZE_V1], 0); err != nil {
+			return nil, ErrLogCorrupted
+		}
+		lm.nextLSN = binary.BigEndian.Uint64(head[0:])
+		lm.nextTxn = binary.BigEndian.Uint64(head[8:])
+
+		version = 1
+		if _, err := file.ReadAt(head[WAL_HEAD_SIZE_V1:], WAL_HEAD_SIZE_V1); err == nil &&
+			binary.BigEndian.Uint64(head[WAL_HEAD_SIZE_V1:]) == WAL_VERSION {
+			version = WAL_VERSION
+		}
+	}
+
+	records := readLog(file, size, version)
+	committed := make(map[uint64]bool)
+	for _, rec := range records {
+		if rec.lsn >= lm.nextLSN {
+			lm.nextLSN = rec.lsn + 1
+		}
+		if rec.txn >= lm.nextTxn {
+			lm.nextTxn = rec.txn + 1
+		}
+		if rec.kind == LOG_COMMIT {
+			committed[rec.txn] = true
+		}
+	}
+
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	fileOf := func(path string) *os.File {
+		if f, ok := files[path]; ok {
+			return f
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err != nil { // the table has been dropped since.
+			f = nil
+		}
+		files[path] = f
+		return f
+	}
+
+	// redo: repeat the history of every committed transaction.
+	for _, rec := range records {
+		if rec.kind != LOG_PAGE || !committed[rec.txn] {
+			continue
+		}
+
+		f := fileOf(rec.path)
+		if f == nil {
+			continue
+		}
+
+		if pageLSNAt(f, rec.pgNo) < rec.lsn {
+			if _, err := f.WriteAt(rec.after, int64(rec.pgNo)*PAGE_SIZE); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// undo: roll back losers, newest first. A page touched by a later
+	// committed transaction already holds its final image.
+	type pageKey struct {
+		path string
+		pgNo uint64
+	}
+	final := make(map[pageKey]bool)
+
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		if rec.kind != LOG_PAGE {
+			continue
+		}
+
+		key := pageKey{rec.path, rec.pgNo}
+		if committed[rec.txn] {
+			final[key] = true
+			continue
+		}
+		if final[key] {
+			continue
+		}
+
+		f := fileOf(rec.path)
+		if f == nil {
+			continue
+		}
+		if _, err := f.WriteAt(rec.before, int64(rec.pgNo)*PAGE_SIZE); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := lm.truncate(); err != nil {
+		return nil, err
+	}
+	return lm, nil
+}
+
+func pageLSNAt(file *os.File, pgNo uint64) uint64 {
+	bts := make([]byte, SIZE_OF_LSN)
+	if _, err := file.ReadAt(bts, int64(pgNo)*PAGE_SIZE); err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(bts)
+}
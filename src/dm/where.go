@@ -0,0 +1,132 @@
+package dm
+
+import (
+	"../sql/lexer"
+	"../sql/parser/statements"
+	"errors"
+	"strings"
+)
+
+// WHERE：一个表达式，见expr.go，为真的记录才选中；为假或不真不假都不选。
+
+var (
+	ErrNoSuchCol    = errors.New("No such col")
+	ErrIncomparable = errors.New("The values can not be compared.")
+)
+
+// CheckWhere makes sure the expression of where names columns of the table
+// and is a condition.
+func (md *MetaData) CheckWhere(where *statements.Where) error {
+	if where == nil || where.Expr == nil {
+		return nil
+	}
+
+	tp, err := md.TypeOf(where.Expr)
+	if err != nil {
+		return err
+	}
+	if tp != "BOOL" && tp != "NULL" {
+		return ErrNotCondition
+	}
+	return nil
+}
+
+// ColOf returns the position of the column named by the value, or -1 if
+// the value is a literal.
+func (md *MetaData) ColOf(val statements.Value) int {
+	tok := val.Value.(lexer.Token)
+	if tok.TypeInfo != "IDENTIFIER" {
+		return -1
+	}
+
+	for i, c := range md.Cols {
+		if c == tok.Value.(string) {
+			return i
+		}
+	}
+	return -1
+}
+
+// valueOf returns the value of a column or a literal for the record.
+func (md *MetaData) valueOf(values []interface{}, val statements.Value) interface{} {
+	if i := md.ColOf(val); i != -1 {
+		return values[i]
+	}
+	return val.Value.(lexer.Token).Value
+}
+
+// valid reports whether the record satisfies where, which CheckWhere passed.
+func (dm DM) valid(data []byte, where statements.Where) (bool, error) {
+	md := dm.Kacher.Metadata
+	if where.Expr == nil {
+		return true, nil
+	}
+
+	values, err := md.DecodeRecord(data)
+	if err != nil {
+		return false, err
+	}
+
+	v, err := md.Eval(values, where.Expr)
+	return v == true, err
+}
+
+// Holds reports whether a op b, false if either is NULL.
+func Holds(op string, a interface{}, b interface{}) bool {
+	c, ok := Compare(a, b)
+	if !ok {
+		return false
+	}
+
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// Compare orders two values of columns, INT and DOUBLE alike. It reports
+// false if they can't be compared, as with NULL.
+func Compare(a interface{}, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return order(x < y, x > y), true
+		case float64:
+			return order(float64(x) < y, float64(x) > y), true
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return order(x < float64(y), x > float64(y)), true
+		case float64:
+			return order(x < y, x > y), true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func order(less bool, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
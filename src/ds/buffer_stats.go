@@ -0,0 +1,70 @@
+package ds
+
+import (
+	"../dm"
+	"strconv"
+)
+
+// SYS_BUFFER_STATS is a virtual table showing what the buffer pool does for
+// every table and index, e.g. SELECT * FROM sys_buffer_stats; index is NULL
+// on the row of the records of a table.
+const SYS_BUFFER_STATS = "sys_buffer_stats"
+
+var bufferStatsCols = []string{
+	"table",
+	"index",
+	"pages",
+	"dirty",
+	"hits",
+	"misses",
+	"evictions",
+	"flushes",
+	"avg_flush_us",
+	"max_flush_us",
+}
+
+func readBufferStats(all bool, fields []string) string {
+	for _, f := range fields {
+		in := false
+		for _, c := range bufferStatsCols {
+			if c == f {
+				in = true
+			}
+		}
+		if !in {
+			return "No field " + f
+		}
+	}
+
+	if all {
+		fields = bufferStatsCols
+	}
+
+	ret := "{ "
+	for _, stat := range dm.BufferStats() {
+		index := stat.Index
+		if index == "" {
+			index = "NULL"
+		}
+		values := map[string]string{
+			"table":        stat.Table,
+			"index":        index,
+			"pages":        strconv.Itoa(stat.Pages),
+			"dirty":        strconv.Itoa(stat.DirtyPages),
+			"hits":         strconv.FormatUint(stat.Hits, 10),
+			"misses":       strconv.FormatUint(stat.Misses, 10),
+			"evictions":    strconv.FormatUint(stat.Evictions, 10),
+			"flushes":      strconv.FormatUint(stat.Flushes, 10),
+			"avg_flush_us": strconv.FormatInt(stat.AvgFlush.Nanoseconds()/1000, 10),
+			"max_flush_us": strconv.FormatInt(stat.MaxFlush.Nanoseconds()/1000, 10),
+		}
+
+		ret += "["
+		for _, f := range fields {
+			ret += values[f] + ","
+		}
+		ret += "]"
+	}
+
+	return ret + " }"
+}
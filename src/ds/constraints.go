@@ -0,0 +1,582 @@
+package ds
+
+import (
+	"../dm"
+	"../im"
+	"../sql/parser"
+	"../sql/parser/statements"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// PRIMARY KEY and UNIQUE constraints are kept by unique indexes, named after
+// the constraint, t_pkey or t_a_b_key if it has no name. A PRIMARY KEY is
+// never NULL, as its columns can't be Nullable.
+//
+// A FOREIGN KEY, t_a_fkey if it has no name, refers to the columns of a
+// PRIMARY KEY or UNIQUE constraint, and is checked against the records as
+// they are now, not as a snapshot sees them; writers take turns anyway. A
+// key with NULL in it refers to nothing. Records are found by an index of
+// the child table starting with the columns of the key if there is one, or
+// else by a scan. ON DELETE RESTRICT is the default, and a key referred to
+// can't be updated.
+//
+// A CHECK, t_a_check after its column or t_check if it has no name, holds
+// unless its expression is false, so NULL passes it. It is checked on every
+// record written, an update too. A DEFAULT gives the value of a column left
+// out of an INSERT, or else it is NULL. Its expression refers to no column
+// and is computed on every INSERT.
+
+// ConstraintError tells that a statement would break a constraint.
+type ConstraintError struct {
+	Msg string
+}
+
+func (e *ConstraintError) Error() string {
+	return e.Msg
+}
+
+// constraintIndexes returns the indexes backing the constraints of a new
+// table.
+func constraintIndexes(tableName string,
+	cols []string,
+	types []string,
+	nullables []bool,
+	constraints []statements.Constraint) ([]dm.IndexDef, error) {
+	defs := make([]dm.IndexDef, 0, len(constraints))
+	primary := false
+
+	for _, c := range constraints {
+		if c.Kind != statements.PRIMARY_KEY && c.Kind != statements.UNIQUE {
+			continue
+		}
+
+		for i, col := range c.Cols {
+			for _, other := range c.Cols[:i] {
+				if other == col {
+					return nil, errors.New("The col " + col + " is in the constraint twice.")
+				}
+			}
+
+			found := false
+			for j, name := range cols {
+				if name != col {
+					continue
+				}
+				if !im.Indexable(types[j]) {
+					return nil, im.ErrUnindexable
+				}
+				if c.Kind == statements.PRIMARY_KEY && nullables[j] {
+					return nil, errors.New("The PRIMARY KEY col " + col + " can't be Nullable.")
+				}
+				found = true
+			}
+			if !found {
+				return nil, errors.New("No col called " + col)
+			}
+		}
+
+		name := c.Name
+		if c.Kind == statements.PRIMARY_KEY {
+			if primary {
+				return nil, errors.New("A table has one PRIMARY KEY at most.")
+			}
+			primary = true
+
+			if name == "" {
+				name = tableName + "_pkey"
+			}
+		} else if name == "" {
+			name = tableName + "_" + strings.Join(c.Cols, "_") + "_key"
+		}
+
+		defs = append(defs, dm.IndexDef{Name: name, Cols: c.Cols, Unique: true, Constraint: c.Kind})
+	}
+	return defs, nil
+}
+
+// foreignKeys returns the FOREIGN KEYs of a new table, defs being the
+// indexes it will have.
+func (ds DS) foreignKeys(tableName string,
+	cols []string,
+	types []string,
+	nullables []bool,
+	defs []dm.IndexDef,
+	constraints []statements.Constraint) ([]dm.ForeignKey, error) {
+	fks := make([]dm.ForeignKey, 0)
+
+	for _, c := range constraints {
+		if c.Kind != statements.FOREIGN_KEY {
+			continue
+		}
+
+		// the parent may be the table itself.
+		parentCols, parentTypes, parentDefs := cols, types, defs
+		if c.Parent != tableName {
+			parent, err := ds.table(c.Parent)
+			if err != nil {
+				return nil, err
+			}
+			md := parent.dm.Kacher.Metadata
+			parentCols, parentTypes, parentDefs = md.Cols, md.Types, md.IndexDefs
+		}
+
+		fk := dm.ForeignKey{
+			Name:       c.Name,
+			Cols:       c.Cols,
+			Parent:     c.Parent,
+			ParentCols: c.ParentCols,
+			OnDelete:   c.OnDelete,
+		}
+		if fk.Name == "" {
+			fk.Name = tableName + "_" + strings.Join(c.Cols, "_") + "_fkey"
+		}
+		if fk.OnDelete == "" {
+			fk.OnDelete = dm.RESTRICT
+		}
+
+		if len(fk.ParentCols) == 0 {
+			for _, def := range parentDefs {
+				if def.Constraint == statements.PRIMARY_KEY {
+					fk.ParentCols = def.Cols
+				}
+			}
+			if len(fk.ParentCols) == 0 {
+				return nil, errors.New("The table " + c.Parent + " has no PRIMARY KEY.")
+			}
+		}
+
+		referable := false
+		for _, def := range parentDefs {
+			if def.Constraint != "" && sameCols(def.Cols, fk.ParentCols) {
+				referable = true
+			}
+		}
+		if !referable {
+			return nil, errors.New("A FOREIGN KEY refers to a PRIMARY KEY or UNIQUE constraint of " +
+				c.Parent + ".")
+		}
+		if len(fk.Cols) != len(fk.ParentCols) {
+			return nil, errors.New("The FOREIGN KEY " + fk.Name + " has " +
+				strconv.Itoa(len(fk.Cols)) + " cols, it refers to " +
+				strconv.Itoa(len(fk.ParentCols)) + ".")
+		}
+
+		for i, col := range fk.Cols {
+			j := position(cols, col)
+			if j == -1 {
+				return nil, errors.New("No col called " + col)
+			}
+			if types[j] != parentTypes[position(parentCols, fk.ParentCols[i])] {
+				return nil, errors.New("The col " + col + " does not match the type of " +
+					c.Parent + "." + fk.ParentCols[i] + ".")
+			}
+			if fk.OnDelete == dm.SET_NULL && !nullables[j] {
+				return nil, errors.New("ON DELETE SET NULL needs the col " + col + " to be Nullable.")
+			}
+		}
+
+		for _, other := range fks {
+			if other.Name == fk.Name {
+				return nil, errors.New("There is already a FOREIGN KEY called " + fk.Name + ".")
+			}
+		}
+		fks = append(fks, fk)
+	}
+	return fks, nil
+}
+
+// constraintChecks returns the CHECKs of a new table. Names left out are told apart by
+// a number, as in t_a_check1.
+func constraintChecks(tableName string,
+	cols []string,
+	types []string,
+	constraints []statements.Constraint) ([]dm.Check, error) {
+	md := &dm.MetaData{Cols: cols, Types: types}
+	checks := make([]dm.Check, 0)
+
+	taken := func(name string) bool {
+		for _, check := range checks {
+			if check.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, c := range constraints {
+		if c.Kind != statements.CHECK {
+			continue
+		}
+
+		expr, err := parser.ParseCheck(c.Check)
+		if err != nil {
+			return nil, err
+		}
+		if err := md.CheckWhere(&statements.Where{Expr: expr}); err != nil {
+			return nil, err
+		}
+
+		name := c.Name
+		if name == "" {
+			base := tableName + "_check"
+			if len(c.Cols) > 0 {
+				base = tableName + "_" + strings.Join(c.Cols, "_") + "_check"
+			}
+
+			name = base
+			for n := 1; taken(name); n++ {
+				name = base + strconv.Itoa(n)
+			}
+		} else if taken(name) {
+			return nil, errors.New("There is already a CHECK called " + name + ".")
+		}
+
+		checks = append(checks, dm.Check{Name: name, Expr: c.Check})
+	}
+	return checks, nil
+}
+
+// checkDefaults makes sure the DEFAULT of every column could be written to
+// it. A DEFAULT is an expression of no col, e.g. DEFAULT 60 * 60.
+func checkDefaults(md *dm.MetaData) error {
+	for i := range md.Cols {
+		text := md.DefaultOf(i)
+		if text == "" {
+			continue
+		}
+
+		expr, err := parser.ParseDefault(text)
+		if err != nil {
+			return err
+		}
+		if _, err := defaultOf(md, i, expr); err != nil {
+			return errors.New("The DEFAULT of " + md.Cols[i] + " does not fit: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// defaultOf returns the value of the DEFAULT of the col i, as written.
+func defaultOf(md *dm.MetaData, i int, expr statements.Expr) (interface{}, error) {
+	none := &dm.MetaData{}
+
+	tp, err := none.TypeOf(expr)
+	if err == dm.ErrNoSuchCol {
+		return nil, errors.New("A DEFAULT can not refer to a col.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !md.Fits(i, tp) {
+		return nil, errors.New("Wrong type for " + md.Cols[i])
+	}
+
+	v, err := none.Eval(nil, expr)
+	if err != nil {
+		return nil, err
+	}
+	return md.Assign(i, v)
+}
+
+// parseClauses parses the CHECKs and DEFAULTs kept with the table, once as
+// it is opened.
+func (t *diPair) parseClauses() error {
+	md := t.dm.Kacher.Metadata
+
+	t.checks = make([]statements.Expr, len(md.Checks))
+	for i, check := range md.Checks {
+		expr, err := parser.ParseCheck(check.Expr)
+		if err != nil {
+			return err
+		}
+		t.checks[i] = expr
+	}
+
+	t.defaults = make([]statements.Expr, len(md.Cols))
+	for i := range md.Cols {
+		if text := md.DefaultOf(i); text != "" {
+			expr, err := parser.ParseDefault(text)
+			if err != nil {
+				return err
+			}
+			t.defaults[i] = expr
+		}
+	}
+	return nil
+}
+
+// satisfies makes sure the record breaks no CHECK.
+func (t *diPair) satisfies(data []byte) error {
+	md := t.dm.Kacher.Metadata
+	if len(t.checks) == 0 {
+		return nil
+	}
+
+	values, err := md.DecodeRecord(data)
+	if err != nil {
+		return err
+	}
+
+	for i, expr := range t.checks {
+		ok, err := md.Satisfies(values, expr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &ConstraintError{"The record " + formatKey(values) +
+				" violates the CHECK constraint " + md.Checks[i].Name + "."}
+		}
+	}
+	return nil
+}
+
+func sameCols(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// position returns where name is in cols, or -1.
+func position(cols []string, name string) int {
+	for i, c := range cols {
+		if c == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// valuesOf picks the values of some columns out of the values of a record,
+// and reports whether none of them is NULL.
+func (t *diPair) valuesOf(values []interface{}, cols []string) ([]interface{}, bool) {
+	md := t.dm.Kacher.Metadata
+
+	key := make([]interface{}, len(cols))
+	whole := true
+	for i, col := range cols {
+		key[i] = values[position(md.Cols, col)]
+		whole = whole && key[i] != nil
+	}
+	return key, whole
+}
+
+// checkParents makes sure every FOREIGN KEY of the record refers to a
+// record of its parent.
+func (t *diPair) checkParents(data []byte) error {
+	md := t.dm.Kacher.Metadata
+	if len(md.ForeignKeys) == 0 {
+		return nil
+	}
+
+	values, err := md.DecodeRecord(data)
+	if err != nil {
+		return err
+	}
+
+	for _, fk := range md.ForeignKeys {
+		key, whole := t.valuesOf(values, fk.Cols)
+		if !whole {
+			continue
+		}
+
+		parent, err := t.ds.table(fk.Parent)
+		if err != nil {
+			return err
+		}
+
+		found, err := parent.hasKey(fk.ParentCols, key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return &ConstraintError{"Key " + formatKey(key) + " is not in " + fk.Parent +
+				", violating the FOREIGN KEY constraint " + fk.Name + "."}
+		}
+	}
+	return nil
+}
+
+// hasKey reports whether a record not deleted has the key in the columns of
+// a constraint.
+func (t *diPair) hasKey(cols []string, key []interface{}) (bool, error) {
+	for _, index := range t.ims {
+		if index.Constraint() == "" || !sameCols(index.Cols(), cols) {
+			continue
+		}
+
+		rids, err := index.Lookup(key)
+		if err != nil {
+			return false, err
+		}
+		for _, rid := range rids {
+			if live, err := t.dm.Live(rid); live || err != nil {
+				return live, err
+			}
+		}
+		return false, nil
+	}
+	return false, nil
+}
+
+// Deleted lets the records referring to a deleted record follow ON DELETE,
+// and refuses to update a key referred to.
+func (t *diPair) Deleted(txn *dm.Txn, data []byte, rid dm.RID, replacement []byte) error {
+	md := t.dm.Kacher.Metadata
+	if len(md.Children) == 0 {
+		return nil
+	}
+
+	values, err := md.DecodeRecord(data)
+	if err != nil {
+		return err
+	}
+	var newValues []interface{}
+	if replacement != nil {
+		if newValues, err = md.DecodeRecord(replacement); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range md.Children {
+		child, err := t.ds.table(name)
+		if err == dm.ErrNoSuchTable {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, fk := range child.dm.Kacher.Metadata.ForeignKeys {
+			if fk.Parent != t.dm.TableName {
+				continue
+			}
+
+			key, whole := t.valuesOf(values, fk.ParentCols)
+			if !whole {
+				continue
+			}
+			if newValues != nil {
+				if newKey, _ := t.valuesOf(newValues, fk.ParentCols); sameKey(key, newKey) {
+					continue
+				}
+			}
+
+			if err := child.onDelete(txn, fk, key, newValues != nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// onDelete does what fk asks for with the records referring to key, which
+// is gone from the parent, or changed if updated.
+func (t *diPair) onDelete(txn *dm.Txn, fk dm.ForeignKey, key []interface{}, updated bool) error {
+	rids, records, err := t.referrers(fk, key)
+	if err != nil || len(rids) == 0 {
+		return err
+	}
+
+	if updated || fk.OnDelete == dm.RESTRICT {
+		return &ConstraintError{"Key " + formatKey(key) + " of " + fk.Parent +
+			" is referred to by " + t.dm.TableName +
+			", violating the FOREIGN KEY constraint " + fk.Name + "."}
+	}
+
+	for i, rid := range rids {
+		if fk.OnDelete == dm.CASCADE {
+			err = t.dm.Delete(txn, rid)
+		} else {
+			err = t.setNull(txn, fk, rid, records[i])
+		}
+
+		// a CASCADE may have reached the record already.
+		if err != nil && err != dm.ErrDeleted {
+			return err
+		}
+	}
+	return nil
+}
+
+// setNull updates the record at rid to refer to nothing by fk.
+func (t *diPair) setNull(txn *dm.Txn, fk dm.ForeignKey, rid dm.RID, record []byte) error {
+	md := t.dm.Kacher.Metadata
+
+	values, err := md.DecodeRecord(record)
+	if err != nil {
+		return err
+	}
+	for _, col := range fk.Cols {
+		values[position(md.Cols, col)] = nil
+	}
+
+	data, err := md.EncodeRecord(values)
+	if err != nil {
+		return err
+	}
+	_, err = t.dm.Update(txn, data, rid)
+	return err
+}
+
+// referrers returns the records not deleted whose FOREIGN KEY fk is key.
+func (t *diPair) referrers(fk dm.ForeignKey, key []interface{}) ([]dm.RID, [][]byte, error) {
+	rids, records := make([]dm.RID, 0), make([][]byte, 0)
+	md := t.dm.Kacher.Metadata
+
+	keep := func(rid dm.RID, data []byte) error {
+		values, err := md.DecodeRecord(data)
+		if err != nil {
+			return err
+		}
+		if other, _ := t.valuesOf(values, fk.Cols); sameKey(key, other) {
+			rids, records = append(rids, rid), append(records, data)
+		}
+		return nil
+	}
+
+	for _, index := range t.ims {
+		n := len(fk.Cols)
+		if len(index.Cols()) < n || !sameCols(index.Cols()[:n], fk.Cols) ||
+			!index.Ordered() && len(index.Cols()) != n {
+			continue
+		}
+
+		b := &im.Bound{Key: key, Inclusive: true}
+		found, err := index.Range(b, b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, rid := range found {
+			data, err := t.dm.LiveRecord(rid)
+			if err != nil {
+				return nil, nil, err
+			}
+			if data != nil {
+				if err := keep(rid, data); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		return rids, records, nil
+	}
+
+	return rids, records, t.dm.LiveRecords(keep)
+}
+
+// sameKey reports whether two keys are equal, column by column.
+func sameKey(a []interface{}, b []interface{}) bool {
+	for i := range a {
+		if c, ok := dm.Compare(a[i], b[i]); !ok || c != 0 {
+			return false
+		}
+	}
+	return true
+}
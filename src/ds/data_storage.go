@@ -5,357 +5,823 @@ import (
 	"../im"
 	"../sql/lexer"
 	"../sql/parser/statements"
-	"encoding/binary"
+	"encoding/hex"
 	"errors"
-	"math"
+	"sort"
 	"strconv"
+	"sync"
 )
 
 type DS struct {
 	tables map[string]*diPair
+	mu     *sync.Mutex // guards tables, sessions share one DS
 }
 
 type diPair struct {
+	ds  DS // the other tables, for FOREIGN KEYs
 	dm  *dm.DM
 	ims []*im.IM
+	mu  sync.RWMutex // guards ims against CREATE and DROP INDEX
+
+	checks   []statements.Expr // the CHECKs of the metadata, parsed
+	defaults []statements.Expr // the DEFAULT of each col, nil if none
 }
 
-func NewDS() *DS { return &DS{make(map[string]*diPair)} }
+func NewDS() *DS { return &DS{make(map[string]*diPair), &sync.Mutex{}} }
 
-func (ds DS) CreateTable(tableName string,
+func (ds DS) CreateTable(txn *dm.Txn,
+	tableName string,
 	cols []string,
 	types []string,
 	lens []uint16,
 	nullables []bool,
-	indexes []string) string {
+	defaults []string,
+	indexes []string,
+	constraints []statements.Constraint) string {
 
-	indexesToBuild := make([]bool, len(cols))
+	defs := make([]dm.IndexDef, 0)
 
 	for _, s := range indexes {
+		found := false
 		for i, c := range cols {
 			if s == c {
-				indexesToBuild[i] = true
-				continue
+				if !im.Indexable(types[i]) {
+					return im.ErrUnindexable.Error()
+				}
+				found = true
 			}
 		}
-		return "No col called" + s
+		if !found {
+			return "No col called " + s
+		}
+
+		if !hasIndex(defs, s) {
+			defs = append(defs, dm.IndexDef{Name: s, Cols: []string{s}})
+		}
+	}
+
+	constraintDefs, err := constraintIndexes(tableName, cols, types, nullables, constraints)
+	if err != nil {
+		return err.Error()
+	}
+	for _, def := range constraintDefs {
+		if hasIndex(defs, def.Name) {
+			return "There is already an index called " + def.Name + "."
+		}
+		if _, err := ds.tableOfIndex(def.Name); err != dm.ErrNoSuchIndex {
+			return "There is already an index called " + def.Name + "."
+		}
+		defs = append(defs, def)
+	}
+	for _, def := range defs {
+		if err := checkKeyWidth(def, cols, types, lens); err != nil {
+			return err.Error()
+		}
+	}
+
+	fks, err := ds.foreignKeys(tableName, cols, types, nullables, defs, constraints)
+	if err != nil {
+		return err.Error()
+	}
+
+	checks, err := constraintChecks(tableName, cols, types, constraints)
+	if err != nil {
+		return err.Error()
+	}
+	md := &dm.MetaData{
+		Cols:        cols,
+		Types:       types,
+		Lens:        lens,
+		Nullables:   nullables,
+		IndexDefs:   defs,
+		ForeignKeys: fks,
+		Defaults:    defaults,
+		Checks:      checks,
+	}
+	if err := checkDefaults(md); err != nil {
+		return err.Error()
+	}
+
+	if err := txn.LockForWrite(); err != nil {
+		return err.Error()
+	}
+
+	if tableName == SYS_BUFFER_STATS {
+		return "The table name is reserved."
 	}
 
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
 	if ds.tables[tableName] != nil {
 		return "The table has been created"
 	}
 
-	dP := &diPair{}
+	dP := &diPair{ds: ds}
+
+	// parents first, a child they don't find does no harm.
+	parents := make([]*diPair, 0)
+	defer func() {
+		for _, parent := range parents {
+			parent.dm.RemoveChild(tableName)
+		}
+	}()
+	for _, fk := range fks {
+		if parent := ds.tables[fk.Parent]; parent != nil && fk.Parent != tableName {
+			if err := parent.dm.AddChild(tableName); err != nil {
+				return err.Error()
+			}
+			parents = append(parents, parent)
+		}
+	}
 
-	dataManager, err := dm.Create(tableName, cols, types, lens, nullables, indexesToBuild)
+	dataManager, err := dm.Create(tableName, md)
 	if err != nil {
 		return err.Error()
 	}
 	dP.dm = dataManager
 
+	if err := dP.parseClauses(); err != nil {
+		dataManager.Boom()
+		return err.Error()
+	}
+
+	for _, fk := range fks {
+		if fk.Parent == tableName {
+			if err := dataManager.AddChild(tableName); err != nil {
+				dataManager.Boom()
+				return err.Error()
+			}
+		}
+	}
+
 	ims := make([]*im.IM, 0)
-	for i, s := range indexesToBuild {
-		if s {
-			indexM, err := im.NewIndexManager(tableName, cols[i])
-			if err != nil {
-				return "Failed to Create Index for " + tableName +
-					"." + cols[i]
+	for _, def := range dataManager.Kacher.Metadata.IndexDefs {
+		indexM, err := dP.openIndex(def, true)
+		if err != nil {
+			for _, index := range ims {
+				index.Boom()
 			}
-			ims = append(ims, indexM)
+			dataManager.Boom()
+			return "Failed to Create Index for " + tableName +
+				"." + def.Name
 		}
+		ims = append(ims, indexM)
 	}
 	dP.ims = ims
+	dataManager.Watch(dP)
 
 	ds.tables[tableName] = dP
+	parents = nil
 	return "OK"
 }
 
-func (ds DS) DropTable(tableName string) string {
-	t := ds.tables[tableName]
-	if t == nil {
-		tableFromDisk, err := loadTableFromDisk(tableName)
-		if err != nil {
-			return err.Error()
-		}
+func (ds DS) DropTable(txn *dm.Txn, tableName string) string {
+	if err := txn.LockForWrite(); err != nil {
+		return err.Error()
+	}
 
-		ds.tables[tableName] = tableFromDisk
-		t = ds.tables[tableName]
+	t, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
 	}
 
+	md := t.dm.Kacher.Metadata
+	for _, child := range md.Children {
+		if _, err := ds.table(child); err == nil && child != tableName {
+			return "The table " + tableName + " is referred to by " + child + "."
+		}
+	}
+	fks := md.ForeignKeys
+
 	if err := t.dm.Boom(); err != nil {
 		return "Failed to Delete the table."
 	}
 	t.dm = nil
 
-	for i, index := range t.ims {
+	for _, index := range t.ims {
 		if err := index.Boom(); err != nil {
 			return "RM Index Failed."
 		}
-
-		t.ims = append(t.ims[:i], t.ims[i+1:]...)
 	}
 	t.ims = nil
 
+	ds.mu.Lock()
 	delete(ds.tables, tableName)
+	ds.mu.Unlock()
+
+	for _, fk := range fks {
+		if parent, err := ds.table(fk.Parent); err == nil {
+			parent.dm.RemoveChild(tableName)
+		}
+	}
 
 	return "OK!"
 }
 
-func (ds DS) ReadTable(tableName string,
+func (ds DS) ReadTable(txn *dm.Txn,
+	tableName string,
 	all bool,
-	fields []string,
-	where *statements.Where) string {
-	table := ds.tables[tableName]
-	if table == nil {
-		table, err := loadTableFromDisk(tableName)
-		if err != nil {
-			return "No Such Table."
+	fields []statements.Field,
+	where *statements.Where,
+	orderBy []statements.OrderByStatement) string {
+	if tableName == SYS_BUFFER_STATS {
+		if where != nil && where.Expr != nil {
+			return "WHERE is not supported on " + SYS_BUFFER_STATS + "."
 		}
+		if len(orderBy) > 0 {
+			return "ORDER BY is not supported on " + SYS_BUFFER_STATS + "."
+		}
+
+		cols := make([]string, 0)
+		for _, f := range fields {
+			if !statements.IsIDF(f.Token) {
+				return "Only cols can be selected from " + SYS_BUFFER_STATS + "."
+			}
+			cols = append(cols, f.Token.Value.(string))
+		}
+		return readBufferStats(all, cols)
+	}
+
+	sel, err := ds.query(txn, tableName, all, fields, where, orderBy)
+	if err != nil {
+		return err.Error()
+	}
+	return formatRows(sel.rows)
+}
+
+// selection is what a SELECT gives: the name, type, len and nullable of each
+// field, as a col of a table would have, and a row of values for each record
+// found. A field which is an expression is nullable, a STRING one is TEXT.
+type selection struct {
+	names     []string
+	types     []string
+	lens      []uint16
+	nullables []bool
+	rows      [][]interface{}
+}
+
+// query runs a SELECT on a table, the rows found come in order.
+func (ds DS) query(txn *dm.Txn,
+	tableName string,
+	all bool,
+	fields []statements.Field,
+	where *statements.Where,
+	orderBy []statements.OrderByStatement) (*selection, error) {
+	if tableName == SYS_BUFFER_STATS {
+		return nil, errors.New("Only SELECT reads " + SYS_BUFFER_STATS + ".")
+	}
 
-		ds.tables[tableName] = table
+	table, err := ds.table(tableName)
+	if err != nil {
+		return nil, err
 	}
 
 	md := table.dm.Kacher.Metadata
 
-	cols := md.Cols
+	if all {
+		fields = make([]statements.Field, len(md.Cols))
+		for i, c := range md.Cols {
+			idf := lexer.Token{TypeInfo: "IDENTIFIER", Value: c}
+			fields[i] = statements.Field{Token: idf, Expr: statements.Value{Value: idf}}
+		}
+	}
+
+	sel := &selection{}
 	for _, f := range fields {
-		in := false
-		for _, c := range cols {
-			if c == f {
-				in = true
+		if statements.IsIDF(f.Token) {
+			i := md.ColOf(statements.Value{Value: f.Token})
+			if i == -1 {
+				return nil, errors.New("No field " + f.Token.Value.(string))
 			}
+			sel.add(f.Name(), md.Types[i], md.Lens[i], md.Nullables[i])
+			continue
 		}
-		if !in {
-			return "No field " + f
+
+		tp, err := md.TypeOf(f.Expr)
+		if err != nil {
+			return nil, err
+		}
+		switch tp {
+		case "INT":
+			sel.add(f.Name(), tp, 2, true)
+		case "DOUBLE":
+			sel.add(f.Name(), tp, 8, true)
+		case "STRING":
+			sel.add(f.Name(), "TEXT", 0, true)
+		default:
+			sel.add(f.Name(), tp, 0, true)
 		}
 	}
 
-	if where == nil {
-		byteArrs := ReadAllPosFrom(table.dm)
+	for _, o := range orderBy {
+		if md.ColOf(statements.Value{Value: o.Field.Token}) == -1 {
+			return nil, errors.New("No field " + o.Name())
+		}
+	}
+
+	if err := md.CheckWhere(where); err != nil {
+		return nil, err
+	}
 
-		ret := "{ "
+	table.mu.RLock()
+	defer table.mu.RUnlock()
 
-		for _, arr := range byteArrs {
-			ret += "["
-			for _, f := range fields {
-				for i, c := range md.Cols {
-					if f == c { // Support null
-						if md.Types[i] == "INT" {
-							bytes := arr[int(md.Offsets[i]):int(md.Offsets[i]+2)]
-							ret += string(int(binary.BigEndian.Uint16(bytes))) + ","
-						} else if md.Types[i] == "DOUBLE" {
-							bytes := arr[int(md.Offsets[i]):int(md.Offsets[i]+4)]
-							ret += string(strconv.FormatFloat(float64(binary.BigEndian.Uint64(bytes)), 'g', 1, 64)) + ","
-						} else {
-							ret += string(arr[int(md.Offsets[i]):int(md.Offsets[i]+md.Lens[i])]) + ","
-						}
-					}
-				}
+	var arrs [][]byte
+	index, lo, hi, ordered := table.indexFor(where, orderBy)
+	switch {
+	case index != nil:
+		cond := statements.Where{}
+		if where != nil {
+			cond = *where
+		}
+		arrs, err = table.dm.RetrieveFound(txn, func() ([]dm.RID, error) {
+			return index.Range(lo, hi)
+		}, cond)
+	case where == nil || where.Expr == nil:
+		arrs, err = ReadAllPosFrom(txn, table.dm)
+	default:
+		arrs, err = table.dm.RetrieveBy(txn, *where)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ordered {
+		if orderBy[0].Desc() {
+			for i, j := 0, len(arrs)-1; i < j; i, j = i+1, j-1 {
+				arrs[i], arrs[j] = arrs[j], arrs[i]
 			}
-			ret += "]"
 		}
+	} else if len(orderBy) > 0 {
+		if err := sortRows(md, orderBy, arrs); err != nil {
+			return nil, err
+		}
+	}
 
-		return ret + " }"
+	sel.rows = make([][]interface{}, len(arrs))
+	for r, arr := range arrs {
+		values, err := md.DecodeRecord(arr)
+		if err != nil {
+			return nil, err
+		}
 
-	} else {
+		row := make([]interface{}, len(fields))
+		for j, f := range fields {
+			if row[j], err = md.Eval(values, f.Expr); err != nil {
+				return nil, err
+			}
+		}
+		sel.rows[r] = row
+	}
+	return sel, nil
+}
 
-		arrs := table.dm.RetrieveBy(*where)
+func (sel *selection) add(name string, tp string, l uint16, nullable bool) {
+	sel.names = append(sel.names, name)
+	sel.types = append(sel.types, tp)
+	sel.lens = append(sel.lens, l)
+	sel.nullables = append(sel.nullables, nullable)
+}
 
-		ret := "{ "
+// sortRows sorts records by the columns of ORDER BY, NULL before any value
+// as in an index.
+func sortRows(md *dm.MetaData, orderBy []statements.OrderByStatement, arrs [][]byte) error {
+	rows := make([][]interface{}, len(arrs))
+	for i, arr := range arrs {
+		values, err := md.DecodeRecord(arr)
+		if err != nil {
+			return err
+		}
+		rows[i] = values
+	}
 
-		for _, arr := range arrs {
-			ret += "["
-			for _, f := range fields {
-				for i, c := range md.Cols {
-					if f == c { // Support null
-						if md.Types[i] == "INT" {
-							bytes := arr[int(md.Offsets[i]):int(md.Offsets[i]+2)]
-							ret += string(int(binary.BigEndian.Uint16(bytes))) + ","
-						} else if md.Types[i] == "DOUBLE" {
-							bytes := arr[int(md.Offsets[i]):int(md.Offsets[i]+4)]
-							ret += string(strconv.FormatFloat(float64(binary.BigEndian.Uint64(bytes)), 'g', 1, 64)) + ","
-						} else {
-							ret += string(arr[int(md.Offsets[i]):int(md.Offsets[i]+md.Lens[i])]) + ","
-						}
-					}
-				}
-			}
-			ret += "]"
-		}
-
-		return ret + " }"
-
-		//conds := where.Expr.Conditions
-
-		// hasIndex := false
-		// ind := ""
-		// ran := []int{
-		//	math.MinInt16,
-		//	math.MaxInt16,
-		// }
-		//
-		// for _, cond := range conds {
-		//
-		//	for i, index := range md.Indexes {
-		//		if index && md.Types[i] != "INT" && cond == md.Cols[i] {
-		//			if cond.LVal.Value == md.Cols[i] {
-		//				hasIndex = true
-		//				index = md.Cols[i]
-		//
-		//			} else if cond.RVal.Value == md.Cols[i] {
-		//
-		//			}
-		//		} else if index {
-		//			return "Now we only support int type index."
-		//		}
-		//	}
-		// }
-
-		//if hasIndex {
-		//	ReadByIndex(table, table.ims[ind], ran)
-		//} else {
-		//
-		//}
+	cols := make([]int, len(orderBy))
+	for i, o := range orderBy {
+		cols[i] = md.ColOf(statements.Value{Value: o.Field.Token})
 	}
+
+	sort.Stable(byCols{arrs, rows, cols, orderBy})
+	return nil
 }
 
-func ReadAllPosFrom(table *dm.DM) [][]byte {
-	return table.RetrieveAll()
+type byCols struct {
+	arrs    [][]byte
+	rows    [][]interface{}
+	cols    []int
+	orderBy []statements.OrderByStatement
 }
 
-func (ds DS) Delete(tableName string, where statements.Where) string {
-	table := ds.tables[tableName]
-	if table == nil {
-		table, err := loadTableFromDisk(tableName)
-		if err != nil {
-			return "No Such Table."
+func (b byCols) Len() int {
+	return len(b.arrs)
+}
+
+func (b byCols) Swap(i int, j int) {
+	b.arrs[i], b.arrs[j] = b.arrs[j], b.arrs[i]
+	b.rows[i], b.rows[j] = b.rows[j], b.rows[i]
+}
+
+func (b byCols) Less(i int, j int) bool {
+	for k, col := range b.cols {
+		x, y := b.rows[i][col], b.rows[j][col]
+
+		c := 0
+		switch {
+		case x == nil && y == nil:
+		case x == nil:
+			c = -1
+		case y == nil:
+			c = 1
+		default:
+			c, _ = dm.Compare(x, y)
 		}
 
-		ds.tables[tableName] = table
+		if b.orderBy[k].Desc() {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
 	}
-	if err := table.dm.DeleteBy(where); err != nil {
+	return false
+}
+
+// formatRows renders rows as { [v,v,][v,v,] }.
+func formatRows(rows [][]interface{}) string {
+	ret := "{ "
+
+	for _, row := range rows {
+		ret += "["
+		for _, v := range row {
+			ret += formatValue(v) + ","
+		}
+		ret += "]"
+	}
+
+	return ret + " }"
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	case []byte:
+		return "0x" + hex.EncodeToString(v)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return "NULL"
+}
+
+func ReadAllPosFrom(txn *dm.Txn, table *dm.DM) ([][]byte, error) {
+	return table.RetrieveAll(txn)
+}
+
+func (ds DS) Delete(txn *dm.Txn, tableName string, where *statements.Where) string {
+	table, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
+	}
+
+	savepoint := txn.Savepoint()
+	if err := table.dm.DeleteBy(txn, where); err != nil {
+		txn.RollbackTo(savepoint)
+		if _, ok := err.(*dm.CorruptionError); ok {
+			return err.Error()
+		}
+		if _, ok := err.(*ConstraintError); ok {
+			return err.Error()
+		}
+		if err == dm.ErrNoSuchCol || err == dm.ErrIncomparable || err == dm.ErrNotCondition ||
+			err == dm.ErrNotNumber || err == dm.ErrDivisionByZero || err == dm.ErrSerialization {
+			return err.Error()
+		}
 		return "Fail to Delete."
 	}
 	return "OK"
 }
 
-func (ds DS) Insert(tableName string, values []interface{}) string {
+// Insert writes the rows of VALUES, all of them or none. cols names the col
+// of each value, or is empty for a value of every col in order.
+func (ds DS) Insert(txn *dm.Txn, tableName string, cols []string, rows [][]interface{}) string {
+	table, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
+	}
+	return table.insert(txn, cols, rows)
+}
 
-	table := ds.tables[tableName]
-	if table == nil {
-		table, err := loadTableFromDisk(tableName)
-		if err != nil {
-			return "No Such Table."
+// InsertSelect writes the rows a SELECT finds as Insert does, e.g.
+// INSERT INTO t (a, b) SELECT c, d FROM u WHERE ...;
+func (ds DS) InsertSelect(txn *dm.Txn,
+	tableName string,
+	cols []string,
+	from string,
+	all bool,
+	fields []statements.Field,
+	where *statements.Where,
+	orderBy []statements.OrderByStatement) string {
+	table, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
+	}
+
+	sel, err := ds.query(txn, from, all, fields, where, orderBy)
+	if err != nil {
+		return err.Error()
+	}
+
+	rows, err := literals(sel)
+	if err != nil {
+		return err.Error()
+	}
+	return table.insert(txn, cols, rows)
+}
+
+// CreateTableAs creates a table with the cols a SELECT gives, of their types
+// and no constraints, and writes the rows it finds to it, e.g.
+// CREATE TABLE t AS SELECT a, b FROM u WHERE ...;
+func (ds DS) CreateTableAs(txn *dm.Txn,
+	tableName string,
+	from string,
+	all bool,
+	fields []statements.Field,
+	where *statements.Where,
+	orderBy []statements.OrderByStatement) string {
+	sel, err := ds.query(txn, from, all, fields, where, orderBy)
+	if err != nil {
+		return err.Error()
+	}
+
+	for j, name := range sel.names {
+		if name == "" {
+			return "The col " + strconv.Itoa(j+1) + " of the SELECT needs a name, given with AS."
+		}
+		if position(sel.names[:j], name) != -1 {
+			return "The col " + name + " is given twice."
 		}
+		if sel.types[j] == "BOOL" || sel.types[j] == "NULL" {
+			return "The col " + name + " is of no type a col can have."
+		}
+	}
+
+	rows, err := literals(sel)
+	if err != nil {
+		return err.Error()
+	}
 
-		ds.tables[tableName] = table
+	if result := ds.CreateTable(txn, tableName,
+		sel.names, sel.types, sel.lens, sel.nullables, nil, nil, nil); result != "OK" {
+		return result
 	}
 
-	md := table.dm.Kacher.Metadata
-	if len(values) != len(md.Cols) {
-		return "You input more or less values than actual."
+	table, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
+	}
+	if result := table.insert(txn, nil, rows); result != "OK" {
+		ds.DropTable(txn, tableName)
+		return result
+	}
+	return "OK"
+}
+
+// literals turns the rows a SELECT gives into rows of VALUES.
+func literals(sel *selection) ([][]interface{}, error) {
+	rows := make([][]interface{}, len(sel.rows))
+
+	for r, values := range sel.rows {
+		row := make([]interface{}, len(values))
+		for j, value := range values {
+			switch v := value.(type) {
+			case int64:
+				row[j] = lexer.Token{TypeInfo: "INT", Value: v}
+			case float64:
+				row[j] = lexer.Token{TypeInfo: "DOUBLE", Value: v}
+			case string:
+				row[j] = lexer.Token{TypeInfo: "STRING", Value: v}
+			case []byte:
+				// a BLOB is given as 0x-prefixed hex.
+				row[j] = lexer.Token{TypeInfo: "STRING", Value: formatValue(v)}
+			case bool:
+				return nil, errors.New("A condition can not be written to a col.")
+			default:
+				row[j] = lexer.Token{TypeInfo: "NULL", Value: "NULL"}
+			}
+		}
+		rows[r] = row
 	}
+	return rows, nil
+}
 
-	data := make([]byte, md.SizeOfRecord)
+// insert writes the rows of VALUES to the table, see Insert.
+func (t *diPair) insert(txn *dm.Txn, cols []string, rows [][]interface{}) string {
+	md := t.dm.Kacher.Metadata
 
-	for i, v := range values {
-		tok := v.(lexer.Token)
-		if tok.TypeInfo == "NULL" {
-			if !md.Nullables[i] {
-				return "Col" + md.Cols[i] + "is not nullable."
-			} else {
-				continue
+	// the value of the col i is the value from[i] of a row.
+	from := make([]int, len(md.Cols))
+	for i := range from {
+		from[i] = i
+	}
+	if len(cols) > 0 {
+		for i := range from {
+			from[i] = -1
+		}
+		for j, col := range cols {
+			i := position(md.Cols, col)
+			if i == -1 {
+				return "No col called " + col
 			}
+			if from[i] != -1 {
+				return "The col " + col + " is given twice."
+			}
+			from[i] = j
 		}
+	}
 
-		if tok.TypeInfo != md.Types[i] {
-			return "Wrong type for " + md.Cols[i]
+	records := make([][]byte, len(rows))
+	for r, values := range rows {
+		if len(cols) > 0 && len(values) != len(cols) {
+			return "You input more or less values than actual."
 		}
+		if len(cols) == 0 && len(values) != len(md.Cols) {
+			return "The table has " + strconv.Itoa(len(md.Cols)) + " cols, the row " +
+				strconv.Itoa(r+1) + " gives " + strconv.Itoa(len(values)) + " values."
+		}
+
+		data, err := t.record(values, from)
+		if err != nil {
+			return err.Error()
+		}
+		records[r] = data
 	}
 
-	for i, v := range values {
-		tok := v.(lexer.Token)
+	if _, err := t.dm.InsertAll(txn, records); err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+// record encodes a row of VALUES, the value of the col i being values[from[i]].
+// A col left out takes its DEFAULT, as DEFAULT does, or else NULL.
+func (t *diPair) record(values []interface{}, from []int) ([]byte, error) {
+	md := t.dm.Kacher.Metadata
+	row := make([]interface{}, len(md.Cols))
 
-		if tok.TypeInfo == "NULL" {
+	for i := range md.Cols {
+		tok := lexer.Token{TypeInfo: "DEFAULT", Value: "DEFAULT"}
+		if j := from[i]; j != -1 {
+			tok = values[j].(lexer.Token)
+		}
 
-		} else if tok.TypeInfo == "STRING" {
-			s := tok.Value.(string)
-			if len(s) > int(md.Lens[i]) {
-				return "To long for col" + md.Cols[i]
-			}
+		var value interface{}
+		var err error
+		switch {
+		case tok.TypeInfo != "DEFAULT":
+			value, err = valueFor(md, i, tok)
+		case t.defaults[i] != nil:
+			value, err = defaultOf(md, i, t.defaults[i])
+		case !md.Nullables[i]:
+			err = errors.New("No value for col " + md.Cols[i] +
+				", it has no DEFAULT and is not nullable.")
+		}
+		if err != nil {
+			return nil, err
+		}
+		row[i] = value
+	}
+	return md.EncodeRecord(row)
+}
 
-			copy(data[md.Offsets[i]:], []byte(s))
-		} else if tok.TypeInfo == "INT" {
-			integer := tok.Value.(uint16)
+// valueFor checks a value given for the col i and returns it as written.
+func valueFor(md *dm.MetaData, i int, tok lexer.Token) (interface{}, error) {
+	if tok.TypeInfo == "NULL" {
+		if !md.Nullables[i] {
+			return nil, errors.New("Col" + md.Cols[i] + "is not nullable.")
+		}
+		return nil, nil
+	}
 
-			var bts []byte
-			binary.BigEndian.PutUint16(bts, integer)
+	// TEXT and BLOB values are written as strings.
+	tp := md.Types[i]
+	if tp == "TEXT" || tp == "BLOB" {
+		tp = "STRING"
+	}
 
-			copy(data[md.Offsets[i]:], bts)
+	if tok.TypeInfo != tp {
+		return nil, errors.New("Wrong type for " + md.Cols[i])
+	}
 
-		} else {
-			double := tok.Value.(float64)
-			integer := math.Float64bits(double)
+	if md.Types[i] == "STRING" && len(tok.Value.(string)) > int(md.Lens[i]) {
+		return nil, errors.New("To long for col" + md.Cols[i])
+	}
 
-			var bts []byte
-			binary.BigEndian.PutUint64(bts, integer)
+	if md.Types[i] == "INT" && !dm.IsInt(tok.Value.(int64)) {
+		return nil, errors.New("Out of range for col " + md.Cols[i] + ", an INT is 0 to 65535.")
+	}
 
-			copy(data[md.Offsets[i]:],bts)
-		}
+	return tok.Value, nil
+}
+
+// Update sets cols of the records where selects, e.g.
+// UPDATE t SET a = a + 1, b = "x" WHERE c > 2;
+func (ds DS) Update(txn *dm.Txn,
+	tableName string,
+	sets []statements.Assignment,
+	where *statements.Where) string {
+	table, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
+	}
+
+	savepoint := txn.Savepoint()
+	result := table.dm.UpdateBy(txn, where, sets)
+	if result != "OK!" {
+		txn.RollbackTo(savepoint)
 	}
+	return result
+}
 
-	_, err := table.dm.Insert(data)
+// VerifyTable checks every page of a table on disk, e.g. VERIFY TABLE t;
+// It lists the damaged pages, if there are any.
+func (ds DS) VerifyTable(tableName string) string {
+	table, err := ds.table(tableName)
 	if err != nil {
 		return err.Error()
 	}
 
-	//md := table.dm.Kacher.Metadata
+	damaged, numOfPages := table.dm.Verify()
+	if len(damaged) == 0 {
+		return "OK! " + strconv.FormatUint(numOfPages, 10) + " pages verified."
+	}
 
-	//for i, index := range md.Indexes {
-	//	if index {
-	//		table.ims[i].InsertValue(pos, values[i])
-	//	}
-	//}
+	ret := "{ "
+	for _, e := range damaged {
+		ret += "[" + strconv.FormatUint(e.PgNo, 10) + "," + e.Reason + ",]"
+	}
+	return ret + " }"
+}
 
-	return "OK"
+// Vacuum packs a table and gives the pages left empty back, e.g. VACUUM t;
+func (ds DS) Vacuum(tableName string) string {
+	table, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
+	}
+
+	numOfPages, err := table.dm.Vacuum()
+	if err != nil {
+		return err.Error()
+	}
+
+	return "OK! " + strconv.FormatUint(numOfPages, 10) + " pages reclaimed."
 }
 
-func (ds DS) Update(tableName string,
-	col string,
-	value interface{},
-	where *statements.Where) string {
-	table := ds.tables[tableName]
+// table returns the named table, loading it from disk the first time.
+func (ds DS) table(tableName string) (*diPair, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 
-	if table == nil {
-		table, err := loadTableFromDisk(tableName)
-		if err != nil {
-			return "No Such Table."
-		}
+	if table := ds.tables[tableName]; table != nil {
+		return table, nil
+	}
 
-		ds.tables[tableName] = table
+	table, err := loadTableFromDisk(tableName)
+	if err != nil {
+		return nil, err
 	}
+	table.ds = ds
 
-	return table.dm.UpdateBy(where, col, value)
+	ds.tables[tableName] = table
+	return table, nil
 }
 
 func loadTableFromDisk(tableName string) (*diPair, error) {
 	diPair := &diPair{}
 	dataManager, err := dm.Open(tableName)
 	if err != nil {
-		return nil, errors.New("Can't get dataManager.")
+		return nil, err
 	}
 	diPair.dm = dataManager
 
-	indexes := dataManager.Kacher.Metadata.Indexes
-	for i, v := range indexes {
-		if v {
-			b, err := im.GetIndexManager(tableName,
-				dataManager.Kacher.Metadata.Cols[i])
-			if err != nil {
-				return nil, errors.New("Can't load indexManager.")
-			}
-			diPair.ims = append(diPair.ims, b)
+	if err := diPair.parseClauses(); err != nil {
+		return nil, errors.New("Can't load the CHECKs and DEFAULTs.")
+	}
+
+	for _, def := range dataManager.Kacher.Metadata.IndexDefs {
+		b, err := diPair.reopenIndex(def)
+		if err != nil {
+			return nil, errors.New("Can't load indexManager.")
 		}
+		diPair.ims = append(diPair.ims, b)
 	}
+	dataManager.Watch(diPair)
 	return diPair, nil
 }
@@ -0,0 +1,634 @@
+package ds
+
+import (
+	"../dm"
+	"../im"
+	"../sql/parser"
+	"../sql/parser/statements"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "ds")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// run runs a statement in a transaction of its own, as the planner does for
+// a statement outside BEGIN ... COMMIT.
+func run(t *testing.T, ds *DS, sql string) string {
+	txn, err := dm.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := runIn(t, ds, txn, sql)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// runIn runs a statement in txn.
+func runIn(t *testing.T, ds *DS, txn *dm.Txn, sql string) string {
+	appliable, err := parser.Parse(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+
+	var result string
+	switch s := appliable.(type) {
+	case statements.CreateStatement:
+		if s.As != nil {
+			from, all, fields := selected(*s.As)
+			result = ds.CreateTableAs(txn, s.TableName, from, all, fields, &s.As.Where, s.As.OrderBy)
+			break
+		}
+		result = ds.CreateTable(txn, s.TableName, s.Cols, s.Types, s.Lens, s.Nullable,
+			s.Defaults, s.Indexes, s.Constraints)
+	case statements.InsertStatement:
+		if s.Select != nil {
+			from, all, fields := selected(*s.Select)
+			result = ds.InsertSelect(txn, s.TableName, s.Cols, from, all, fields,
+				&s.Select.Where, s.Select.OrderBy)
+			break
+		}
+		result = ds.Insert(txn, s.TableName, s.Cols, s.Rows)
+	case statements.UpdateStatement:
+		result = ds.Update(txn, s.TableName, s.Sets, s.Where)
+	case statements.DeleteStatement:
+		result = ds.Delete(txn, s.TableName, s.Where)
+	case statements.CreateIndexStatement:
+		result = ds.CreateIndex(s.IndexName, s.TableName, s.Cols, s.Unique, s.Using)
+	case statements.DropIndexStatement:
+		result = ds.DropIndex(s.IndexName, s.TableName)
+	case statements.SelectStatement:
+		from, all, fields := selected(s)
+		result = ds.ReadTable(txn, from, all, fields, &s.Where, s.OrderBy)
+	default:
+		t.Fatalf("%s: not a statement the tests run", sql)
+	}
+	return result
+}
+
+// selected returns the table a SELECT reads, whether it takes every col and
+// the fields it gives, as the planner does.
+func selected(sel statements.SelectStatement) (string, bool, []statements.Field) {
+	return sel.From.Table.Idf.Value.(string), sel.All != nil || sel.Star != nil, sel.Fields.Idfs
+}
+
+type step struct {
+	sql  string
+	want string // the result, or the start of an error
+}
+
+func runSteps(t *testing.T, ds *DS, steps []step) {
+	for _, s := range steps {
+		if got := run(t, ds, s.sql); !strings.HasPrefix(got, s.want) {
+			t.Fatalf("%s\ngot  %s\nwant %s", s.sql, got, s.want)
+		}
+	}
+}
+
+func TestDeleteConflict(t *testing.T) {
+	ds := NewDS()
+	for _, sql := range []string{`CREATE tx { a INT ;`, `INSERT INTO tx VALUES (1), (2);`} {
+		if got := run(t, ds, sql); got != "OK" {
+			t.Fatalf("%s: %s", sql, got)
+		}
+	}
+
+	// a transaction whose snapshot missed a commit can't write, and is told
+	// so rather than that the DELETE failed.
+	reader, _ := dm.Begin()
+	runIn(t, ds, reader, `SELECT * FROM tx;`)
+	if got := run(t, ds, `DELETE FROM tx WHERE a = 1;`); got != "OK" {
+		t.Fatal(got)
+	}
+	if got := runIn(t, ds, reader, `DELETE FROM tx WHERE a = 2;`); got != dm.ErrSerialization.Error() {
+		t.Fatalf("got %s, want %s", got, dm.ErrSerialization)
+	}
+	if err := reader.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := run(t, ds, `SELECT * FROM tx;`); got != "{ [2,] }" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	ds := NewDS()
+	for _, sql := range []string{
+		`CREATE bs { a INT PRIMARY KEY, b STRING 8 ;`,
+		`INSERT INTO bs VALUES (1, "one"), (2, "two");`,
+	} {
+		if got := run(t, ds, sql); got != "OK" {
+			t.Fatalf("%s: %s", sql, got)
+		}
+	}
+
+	// the records of the table and its primary key index have a row each,
+	// with the pages they have in the pool.
+	got := run(t, ds, `SELECT table, index, pages FROM sys_buffer_stats;`)
+	for _, row := range []string{"[bs,NULL,1,]", "[bs,bs_pkey,1,]"} {
+		if !strings.Contains(got, row) {
+			t.Errorf("%s is not in %s", row, got)
+		}
+	}
+
+	runSteps(t, ds, []step{
+		{`SELECT * FROM sys_buffer_stats WHERE pages = 1;`, "WHERE is not supported"},
+		{`SELECT nothing FROM sys_buffer_stats;`, "No field nothing"},
+		{`CREATE sys_buffer_stats { a INT ;`, "The table name is reserved."},
+	})
+}
+
+func TestVerifyTable(t *testing.T) {
+	ds := NewDS()
+	for _, sql := range []string{`CREATE vt { a INT ;`, `INSERT INTO vt VALUES (1);`} {
+		if got := run(t, ds, sql); got != "OK" {
+			t.Fatalf("%s: %s", sql, got)
+		}
+	}
+	if got := ds.VerifyTable("vt"); got != "OK! 2 pages verified." {
+		t.Fatal(got)
+	}
+
+	file, err := os.OpenFile("vt"+dm.SUFFIX_DB, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xFF}, dm.FIRST_PAGE*dm.PAGE_SIZE+dm.PAGE_SIZE-1)
+	file.Close()
+
+	if got, want := ds.VerifyTable("vt"), "{ [1,checksum mismatch,] }"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got := ds.VerifyTable("none"); got != dm.ErrNoSuchTable.Error() {
+		t.Fatal(got)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	ds := NewDS()
+	runSteps(t, ds, []step{
+		{`CREATE vac { a INT, b TEXT ;`, "OK"},
+		{`INSERT INTO vac VALUES (1, "` + strings.Repeat("x", 3000) + `"), (2, "` +
+			strings.Repeat("y", 3000) + `"), (3, "z");`, "OK"},
+		{`DELETE FROM vac WHERE a < 3;`, "OK"},
+	})
+	if got := ds.Vacuum("vac"); got == "OK! 0 pages reclaimed." || !strings.HasPrefix(got, "OK! ") {
+		t.Fatal(got)
+	}
+	if got := run(t, ds, `SELECT * FROM vac;`); got != "{ [3,z,] }" {
+		t.Fatal(got)
+	}
+	if got := ds.Vacuum("none"); got != dm.ErrNoSuchTable.Error() {
+		t.Fatal(got)
+	}
+}
+
+func TestKeyWidth(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE kw { a STRING 600, b STRING 600, PRIMARY KEY (a, b) ;`, "The key of the index kw_pkey may take"},
+		{`CREATE kw { a STRING 200 PRIMARY KEY, b TEXT ;`, "OK"},
+	})
+}
+
+// planned returns the index ds picks for a SELECT, the keys it looks
+// through, and whether the index gives the order asked for.
+func planned(t *testing.T, ds *DS, sql string) (string, *im.Bound, *im.Bound, bool) {
+	appliable, err := parser.Parse(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	s := appliable.(statements.SelectStatement)
+
+	table, err := ds.table(s.From.Table.Idf.Value.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, lo, hi, ordered := table.indexFor(&s.Where, s.OrderBy)
+	if index == nil {
+		return "", nil, nil, false
+	}
+	return index.Name(), lo, hi, ordered
+}
+
+func key(values ...interface{}) []interface{} {
+	return values
+}
+
+func TestIndexWhere(t *testing.T) {
+	ds := NewDS()
+	for _, sql := range []string{
+		`CREATE iw { a INT PRIMARY KEY, b INT ;`,
+		`INSERT INTO iw VALUES (1, 1), (2, 2), (3, 0), (4, 1), (5, 2), (6, 0), (7, 1), (8, 2);`,
+	} {
+		if got := run(t, ds, sql); got != "OK" {
+			t.Fatalf("%s: %s", sql, got)
+		}
+	}
+
+	cases := []struct {
+		sql    string
+		index  string
+		lo, hi *im.Bound
+		rows   string
+	}{
+		{`SELECT * FROM iw WHERE a = 5;`, "iw_pkey",
+			&im.Bound{Key: key(int64(5)), Inclusive: true}, &im.Bound{Key: key(int64(5)), Inclusive: true},
+			"{ [5,2,] }"},
+		{`SELECT * FROM iw WHERE a >= 7;`, "iw_pkey",
+			&im.Bound{Key: key(int64(7)), Inclusive: true}, nil, "{ [7,1,][8,2,] }"},
+		{`SELECT * FROM iw WHERE 3 < a AND a <= 6 AND b = 1;`, "iw_pkey",
+			&im.Bound{Key: key(int64(3)), Inclusive: false}, &im.Bound{Key: key(int64(6)), Inclusive: true},
+			"{ [4,1,] }"},
+		{`SELECT * FROM iw WHERE a > 2 AND a > 6;`, "iw_pkey",
+			&im.Bound{Key: key(int64(6)), Inclusive: false}, nil, "{ [7,1,][8,2,] }"},
+		{`SELECT * FROM iw WHERE a = 2 OR a = 3;`, "", nil, nil, "{ [2,2,][3,0,] }"},
+		{`SELECT * FROM iw WHERE b = 0;`, "", nil, nil, "{ [3,0,][6,0,] }"},
+	}
+	for _, c := range cases {
+		index, lo, hi, _ := planned(t, ds, c.sql)
+		if index != c.index || !reflect.DeepEqual(lo, c.lo) || !reflect.DeepEqual(hi, c.hi) {
+			t.Errorf("%s\nplanned %q %v %v, want %q %v %v", c.sql, index, lo, hi, c.index, c.lo, c.hi)
+		}
+		if got := run(t, ds, c.sql); got != c.rows {
+			t.Errorf("%s\ngot  %s\nwant %s", c.sql, got, c.rows)
+		}
+	}
+}
+
+func TestCreateIndexOverData(t *testing.T) {
+	ds := NewDS()
+	runSteps(t, ds, []step{
+		{`CREATE ci { a INT, b STRING 8 ;`, "OK"},
+		{`INSERT INTO ci VALUES (1, "x"), (2, "y"), (3, "x"), (4, "z");`, "OK"},
+		{`DELETE FROM ci WHERE a = 3;`, "OK"},
+	})
+
+	// the records there already are found through the index, the deleted
+	// one is not.
+	runSteps(t, ds, []step{
+		{`CREATE UNIQUE INDEX ci_b ON ci (b);`, "OK"},
+		{`CREATE INDEX ci_b ON ci (a);`, "There is already an index called ci_b."},
+		{`CREATE INDEX ci_c ON ci (c);`, "No col called c"},
+		{`CREATE INDEX ci_a ON ci (a, a);`, "The col a is in the index twice."},
+		{`INSERT INTO ci VALUES (5, "y");`, "Duplicate"},
+	})
+	if index, _, _, _ := planned(t, ds, `SELECT * FROM ci WHERE b = "x";`); index != "ci_b" {
+		t.Fatalf("planned %q, want ci_b", index)
+	}
+	if got := run(t, ds, `SELECT a FROM ci WHERE b = "x";`); got != "{ [1,] }" {
+		t.Fatal(got)
+	}
+
+	runSteps(t, ds, []step{
+		{`INSERT INTO ci VALUES (6, "x");`, "Duplicate"},
+		{`CREATE UNIQUE INDEX ci_dup ON ci (a);`, "OK"},
+		{`INSERT INTO ci VALUES (3, "w");`, "OK"},
+		{`CREATE INDEX ci_bad ON ci (b) USING TRIE;`, "No index type TRIE"},
+	})
+
+	// an index over a col holding a value twice can't be UNIQUE, and is not
+	// left behind.
+	runSteps(t, ds, []step{
+		{`CREATE dup { a INT ;`, "OK"},
+		{`INSERT INTO dup VALUES (1), (1);`, "OK"},
+		{`CREATE UNIQUE INDEX dup_a ON dup (a);`, "Duplicate"},
+		{`CREATE INDEX dup_a ON dup (a);`, "OK"},
+	})
+
+	runSteps(t, ds, []step{
+		{`DROP INDEX ci_b;`, "OK"},
+		{`DROP INDEX ci_b;`, dm.ErrNoSuchIndex.Error()},
+		{`INSERT INTO ci VALUES (7, "x");`, "OK"},
+	})
+	if index, _, _, _ := planned(t, ds, `SELECT * FROM ci WHERE b = "x";`); index != "" {
+		t.Fatalf("planned %q after the index was dropped", index)
+	}
+	if got := run(t, ds, `SELECT a FROM ci WHERE b = "x";`); got != "{ [1,][7,] }" {
+		t.Fatal(got)
+	}
+}
+
+func TestCompositeIndexOrder(t *testing.T) {
+	ds := NewDS()
+	runSteps(t, ds, []step{
+		{`CREATE co { a INT, b INT, c STRING 8 ;`, "OK"},
+		{`INSERT INTO co VALUES (2, 3, "f"), (1, 2, "b"), (2, 1, "d"), (3, 1, "g"), (1, 1, "a"), (2, 2, "e"), (1, 3, "c");`, "OK"},
+		{`CREATE INDEX co_ab ON co (a, b);`, "OK"},
+	})
+
+	cases := []struct {
+		sql     string
+		index   string
+		lo, hi  *im.Bound
+		ordered bool
+		rows    string
+	}{
+		// equal leading cols, then a range on the next.
+		{`SELECT c FROM co WHERE a = 2 AND b > 1;`, "co_ab",
+			&im.Bound{Key: key(int64(2), int64(1)), Inclusive: false}, &im.Bound{Key: key(int64(2)), Inclusive: true},
+			false, "{ [e,][f,] }"},
+		{`SELECT c FROM co WHERE a = 1 AND b = 3;`, "co_ab",
+			&im.Bound{Key: key(int64(1), int64(3)), Inclusive: true}, &im.Bound{Key: key(int64(1), int64(3)), Inclusive: true},
+			false, "{ [c,] }"},
+		{`SELECT c FROM co WHERE a >= 3;`, "co_ab",
+			&im.Bound{Key: key(int64(3)), Inclusive: true}, nil, false, "{ [g,] }"},
+		// b alone is not a prefix of the index.
+		{`SELECT c FROM co WHERE b = 1;`, "", nil, nil, false, "{ [d,][g,][a,] }"},
+
+		// the index gives the order of its cols, all the way or after the
+		// equal ones, ascending or read backwards.
+		{`SELECT c FROM co ORDER BY a, b;`, "co_ab", nil, nil, true, "{ [a,][b,][c,][d,][e,][f,][g,] }"},
+		{`SELECT c FROM co ORDER BY a DESC, b DESC;`, "co_ab", nil, nil, true, "{ [g,][f,][e,][d,][c,][b,][a,] }"},
+		{`SELECT c FROM co WHERE a = 2 ORDER BY b DESC;`, "co_ab",
+			&im.Bound{Key: key(int64(2)), Inclusive: true}, &im.Bound{Key: key(int64(2)), Inclusive: true},
+			true, "{ [f,][e,][d,] }"},
+		// not in the order of the index, the rows are sorted.
+		{`SELECT c FROM co ORDER BY a, b DESC;`, "", nil, nil, false, "{ [c,][b,][a,][f,][e,][d,][g,] }"},
+		{`SELECT c FROM co ORDER BY b, c;`, "", nil, nil, false, "{ [a,][d,][g,][b,][e,][c,][f,] }"},
+	}
+	for _, c := range cases {
+		index, lo, hi, ordered := planned(t, ds, c.sql)
+		if index != c.index || !reflect.DeepEqual(lo, c.lo) || !reflect.DeepEqual(hi, c.hi) || ordered != c.ordered {
+			t.Errorf("%s\nplanned %q %v %v %v, want %q %v %v %v", c.sql, index, lo, hi, ordered,
+				c.index, c.lo, c.hi, c.ordered)
+		}
+		if got := run(t, ds, c.sql); got != c.rows {
+			t.Errorf("%s\ngot  %s\nwant %s", c.sql, got, c.rows)
+		}
+	}
+}
+
+func TestHashIndex(t *testing.T) {
+	ds := NewDS()
+	runSteps(t, ds, []step{
+		{`CREATE hi { a INT, b INT ;`, "OK"},
+		{`INSERT INTO hi VALUES (1, 1), (2, 1), (3, 2);`, "OK"},
+		{`CREATE INDEX hi_a ON hi (a);`, "OK"},
+		{`CREATE INDEX hi_ab ON hi (a, b) USING HASH;`, "OK"},
+	})
+
+	// a hash index only helps with all its cols equal, then it beats a B+tree.
+	eq := &im.Bound{Key: key(int64(2), int64(1)), Inclusive: true}
+	if index, lo, hi, _ := planned(t, ds, `SELECT * FROM hi WHERE a = 2 AND b = 1;`); index != "hi_ab" ||
+		!reflect.DeepEqual(lo, eq) || !reflect.DeepEqual(hi, eq) {
+		t.Fatalf("planned %q %v %v, want hi_ab", index, lo, hi)
+	}
+	if index, _, _, _ := planned(t, ds, `SELECT * FROM hi WHERE a = 2;`); index != "hi_a" {
+		t.Fatalf("planned %q, want hi_a", index)
+	}
+	if index, _, _, _ := planned(t, ds, `SELECT * FROM hi ORDER BY a;`); index != "hi_a" {
+		t.Fatalf("planned %q, want hi_a", index)
+	}
+
+	// the rows a transaction rolled back put in are gone from the index.
+	txn, _ := dm.Begin()
+	rows := make([]string, 0)
+	for a := 10; a < 3000; a++ {
+		rows = append(rows, "("+strconv.Itoa(a)+", 1)")
+	}
+	if got := runIn(t, ds, txn, `INSERT INTO hi VALUES `+strings.Join(rows, ", ")+`;`); got != "OK" {
+		t.Fatal(got)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	runSteps(t, ds, []step{
+		{`INSERT INTO hi VALUES (10, 1);`, "OK"},
+		{`SELECT * FROM hi WHERE a = 10 AND b = 1;`, "{ [10,1,] }"},
+		{`SELECT * FROM hi WHERE a = 11 AND b = 1;`, "{  }"},
+		{`SELECT * FROM hi WHERE a = 2 AND b = 1;`, "{ [2,1,] }"},
+	})
+}
+
+func TestPrimaryKey(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE pk { a INT PRIMARY KEY, b STRING 8 Nullable ;`, "OK"},
+		{`CREATE pkn { a INT Nullable PRIMARY KEY ;`, "The PRIMARY KEY col a can't be Nullable."},
+		{`INSERT INTO pk VALUES (1, "x"), (2, "y");`, "OK"},
+		{`INSERT INTO pk VALUES (3, "z"), (1, "w");`, "Duplicate key 1 violates the PRIMARY KEY constraint pk_pkey."},
+		{`INSERT INTO pk (b) VALUES ("v");`, "No value for col a"},
+		{`UPDATE pk SET a = 2 WHERE a = 1;`, "Duplicate key 2 violates the PRIMARY KEY constraint pk_pkey."},
+		{`UPDATE pk SET a = a + 10 WHERE a = 1;`, "OK"},
+		{`SELECT * FROM pk ORDER BY a;`, "{ [2,y,][11,x,] }"},
+	})
+}
+
+func TestUnique(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE un { a INT, b STRING 8 Nullable, UNIQUE (a, b) ;`, "OK"},
+		{`INSERT INTO un VALUES (1, "x"), (1, "y");`, "OK"},
+		{`INSERT INTO un VALUES (1, "x");`, `Duplicate key (1, x) violates the UNIQUE constraint un_a_b_key.`},
+		// a key with NULL in it equals no other.
+		{`INSERT INTO un (a) VALUES (1), (1);`, "OK"},
+		{`DELETE FROM un WHERE b == "x";`, "OK"},
+		{`INSERT INTO un VALUES (1, "x");`, "OK"},
+		{`SELECT * FROM un WHERE b != "y";`, "{ [1,x,] }"},
+	})
+}
+
+func TestForeignKeyCascade(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE parent { id INT PRIMARY KEY, name STRING 8 ;`, "OK"},
+		{`CREATE child { id INT PRIMARY KEY, p INT Nullable REFERENCES parent ON DELETE CASCADE ;`, "OK"},
+		{`CREATE keeper { id INT PRIMARY KEY, p INT REFERENCES parent ;`, "OK"},
+		{`INSERT INTO parent VALUES (1, "one"), (2, "two"), (3, "three");`, "OK"},
+		{`INSERT INTO child VALUES (10, 1), (11, 1), (12, 2), (13, NULL);`, "OK"},
+		{`INSERT INTO child VALUES (14, 4);`, "Key 4 is not in parent"},
+		{`INSERT INTO keeper VALUES (20, 3);`, "OK"},
+
+		// deleting a parent deletes the children of a CASCADE, and is refused
+		// while a RESTRICT one refers to it.
+		{`DELETE FROM parent WHERE id = 1;`, "OK"},
+		{`SELECT * FROM child ORDER BY id;`, "{ [12,2,][13,NULL,] }"},
+		{`DELETE FROM parent WHERE id = 3;`, "Key 3 of parent"},
+		{`SELECT * FROM parent ORDER BY id;`, "{ [2,two,][3,three,] }"},
+		{`UPDATE parent SET id = 5 WHERE id = 2;`, "Key 2 of parent"},
+		{`UPDATE child SET p = 9 WHERE id = 12;`, "Key 9 is not in parent"},
+	})
+}
+
+func TestForeignKeySetNull(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE sp { id INT PRIMARY KEY ;`, "OK"},
+		{`CREATE sc { id INT PRIMARY KEY, p INT Nullable REFERENCES sp ON DELETE SET NULL ;`, "OK"},
+		{`CREATE snn { id INT PRIMARY KEY, p INT REFERENCES sp ON DELETE SET NULL ;`,
+			"ON DELETE SET NULL needs the col p to be Nullable."},
+		{`INSERT INTO sp VALUES (1), (2);`, "OK"},
+		{`INSERT INTO sc VALUES (10, 1), (11, 2), (12, 1);`, "OK"},
+
+		// the children of a parent deleted lose their key, and keep the rest.
+		{`DELETE FROM sp WHERE id = 1;`, "OK"},
+		{`SELECT * FROM sc ORDER BY id;`, "{ [10,NULL,][11,2,][12,NULL,] }"},
+		{`SELECT * FROM sp;`, "{ [2,] }"},
+		{`INSERT INTO sc VALUES (13, 1);`, "Key 1 is not in sp"},
+		{`UPDATE sp SET id = 3 WHERE id = 2;`, "Key 2 of sp is referred to by sc"},
+	})
+}
+
+func TestCheck(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE ck { a INT CHECK (a > 0), b INT Nullable, CHECK (b < a) ;`, "OK"},
+		{`INSERT INTO ck VALUES (5, 1), (6, NULL);`, "OK"},
+		{`INSERT INTO ck VALUES (0, NULL);`, "The record (0, NULL) violates the CHECK constraint ck_a_check."},
+		{`INSERT INTO ck VALUES (3, 4);`, "The record (3, 4) violates the CHECK constraint ck_check."},
+		{`UPDATE ck SET b = a + 1 WHERE a = 5;`, "The record (5, 6) violates the CHECK constraint ck_check."},
+		{`UPDATE ck SET b = a - 1 WHERE a = 5;`, "OK"},
+		{`SELECT * FROM ck ORDER BY a;`, "{ [5,4,][6,NULL,] }"},
+	})
+}
+
+func TestDefault(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE df { a INT, b INT DEFAULT 2 * (3 + 4), c STRING 8 Nullable DEFAULT "z", d INT Nullable ;`, "OK"},
+		{`INSERT INTO df (a) VALUES (1);`, "OK"},
+		{`INSERT INTO df (a, c) VALUES (2, NULL);`, "OK"},
+		{`SELECT * FROM df;`, "{ [1,14,z,NULL,][2,14,NULL,NULL,] }"},
+
+		{`CREATE dfb { a INT DEFAULT "x" ;`, "The DEFAULT of a does not fit: Wrong type for a"},
+		{`CREATE dfc { a INT DEFAULT b ;`, "The DEFAULT of a does not fit: A DEFAULT can not refer to a col."},
+		{`CREATE dfd { a INT DEFAULT 1 / 0 ;`, "The DEFAULT of a does not fit: Division by zero."},
+		{`CREATE ckx { a INT CHECK (b > 0) ;`, "No such col"},
+	})
+}
+
+func TestInsertRows(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE ir { a INT PRIMARY KEY, b STRING 8 Nullable, c INT DEFAULT 5 ;`, "OK"},
+		{`INSERT INTO ir VALUES (1, "x", 1), (2, NULL, DEFAULT);`, "OK"},
+		{`INSERT INTO ir (c, a) VALUES (7, 3), (DEFAULT, 4);`, "OK"},
+
+		// without a col list a row gives every col.
+		{`INSERT INTO ir VALUES (5, "y");`, "The table has 3 cols, the row 1 gives 2 values."},
+		{`INSERT INTO ir VALUES (5, "y", 1), (6);`, "The table has 3 cols, the row 2 gives 1 values."},
+		{`INSERT INTO ir VALUES (5, "y", 1, 2);`, "The table has 3 cols, the row 1 gives 4 values."},
+		{`INSERT INTO ir (a, b) VALUES (5);`, "You input more or less values than actual."},
+		{`INSERT INTO ir (a, a) VALUES (5, 6);`, "The col a is given twice."},
+		{`INSERT INTO ir (d) VALUES (5);`, "No col called d"},
+
+		// a row failing takes the rows before it back.
+		{`INSERT INTO ir VALUES (5, "y", 1), (6, "z", 1), (1, "dup", 1);`,
+			"Duplicate key 1 violates the PRIMARY KEY constraint ir_pkey."},
+		{`SELECT * FROM ir ORDER BY a;`, "{ [1,x,1,][2,NULL,5,][3,NULL,7,][4,NULL,5,] }"},
+		{`INSERT INTO ir VALUES (5, "y", 1), (6, "z", 1);`, "OK"},
+		{`SELECT a FROM ir WHERE a >= 5;`, "{ [5,][6,] }"},
+	})
+}
+
+func TestInsertSelect(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE isu { a INT PRIMARY KEY, b INT Nullable, s STRING 8 Nullable ;`, "OK"},
+		{`INSERT INTO isu VALUES (1, 10, "x"), (2, NULL, "y"), (3, 30, NULL);`, "OK"},
+		{`CREATE isv { a INT, b INT Nullable ;`, "OK"},
+
+		// arithmetic on a NULL gives NULL.
+		{`INSERT INTO isv SELECT a, b * 2 FROM isu WHERE a > 1;`, "OK"},
+		{`INSERT INTO isv (b, a) SELECT a + 1, a FROM isu WHERE a = 2;`, "OK"},
+		{`SELECT * FROM isv ORDER BY a;`, "{ [2,NULL,][2,3,][3,60,] }"},
+
+		{`INSERT INTO isv SELECT a FROM isu;`, "The table has 2 cols, the row 1 gives 1 values."},
+		{`INSERT INTO isv SELECT s, a FROM isu;`, "Wrong type for a"},
+		{`INSERT INTO isv SELECT a, b FROM nosuch;`, "No Such Table."},
+
+		// the rows come in all together or not at all.
+		{`INSERT INTO isu SELECT a + 2, b, s FROM isu;`, "Duplicate key 3"},
+		{`SELECT a FROM isu;`, "{ [1,][2,][3,] }"},
+	})
+}
+
+func TestCreateTableAs(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE ctu { a INT PRIMARY KEY, b INT Nullable, s STRING 8 Nullable ;`, "OK"},
+		{`INSERT INTO ctu VALUES (1, 10, "x"), (2, NULL, "y"), (3, 30, NULL);`, "OK"},
+
+		{`CREATE TABLE ctw AS SELECT a, b + a AS c, s FROM ctu WHERE a < 3;`, "OK"},
+		{`SELECT * FROM ctw;`, "{ [1,11,x,][2,NULL,y,] }"},
+
+		// the cols keep the types, lens and nullables they come from.
+		{`INSERT INTO ctw VALUES (NULL, 1, "z");`, "Colais not nullable."},
+		{`INSERT INTO ctw VALUES (8, 1, "toolongstring");`, "To long for cols"},
+		{`INSERT INTO ctw VALUES (9, NULL, NULL);`, "OK"},
+
+		{`CREATE TABLE cte AS SELECT * FROM ctu WHERE a > 5;`, "OK"},
+		{`INSERT INTO cte VALUES (7, 1, "q");`, "OK"},
+		{`SELECT * FROM cte;`, "{ [7,1,q,] }"},
+
+		{`CREATE TABLE ctx AS SELECT a + 1 FROM ctu;`, "The col 1 of the SELECT needs a name, given with AS."},
+		{`CREATE TABLE ctx AS SELECT a, a FROM ctu;`, "The col a is given twice."},
+		{`CREATE TABLE ctx AS SELECT a, NULL AS n FROM ctu;`, "The col n is of no type a col can have."},
+		{`CREATE TABLE ctx AS SELECT a, a > 1 AS p FROM ctu;`, "The col p is of no type a col can have."},
+		{`CREATE TABLE ctw AS SELECT a FROM ctu;`, "The table has been created"},
+	})
+}
+
+func TestUpdateSets(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE up { a INT, b INT Nullable, s STRING 4 Nullable, d DOUBLE ;`, "OK"},
+		{`INSERT INTO up VALUES (1, 10, "x", 1.5), (2, NULL, "y", 2.0), (3, 30, NULL, 0.5);`, "OK"},
+
+		{`UPDATE up SET a = a + 1, b = b * 2, s = "z" WHERE a >= 2;`, "OK!"},
+		{`SELECT * FROM up ORDER BY a;`, "{ [1,10,x,1.5,][3,NULL,z,2,][4,60,z,0.5,] }"},
+
+		// every SET reads the row as it was before the UPDATE.
+		{`UPDATE up SET b = a, a = b WHERE a = 1;`, "OK!"},
+		{`UPDATE up SET d = d * 2 + a;`, "OK!"},
+		{`SELECT * FROM up ORDER BY a;`, "{ [3,NULL,z,7,][4,60,z,5,][10,1,x,13,] }"},
+
+		{`UPDATE up SET e = 1;`, "No such col"},
+		{`UPDATE up SET a = "q";`, "Wrong type for a"},
+		{`UPDATE up SET a = NULL WHERE a = 3;`, "The col a is not nullable."},
+		{`UPDATE up SET a = 1, a = 2;`, "The col a is set twice."},
+		{`UPDATE up SET s = "toolong";`, "Too long for col s"},
+		{`UPDATE up SET a = a / 0;`, "Division by zero."},
+		{`UPDATE nosuch SET a = 1;`, "No Such Table."},
+		{`SELECT * FROM up ORDER BY a;`, "{ [3,NULL,z,7,][4,60,z,5,][10,1,x,13,] }"},
+	})
+}
+
+func TestExpressions(t *testing.T) {
+	runSteps(t, NewDS(), []step{
+		{`CREATE ex { a INT, b INT Nullable, d DOUBLE, s STRING 4 Nullable ;`, "OK"},
+		{`INSERT INTO ex VALUES (1, 10, 1.5, "x"), (2, NULL, 2.5, "y"), (3, 30, 0.5, NULL), (4, 4, 4.0, "z");`, "OK"},
+
+		{`SELECT a FROM ex WHERE a = 1 OR b = 30 AND d < 1;`, "{ [1,][3,] }"},
+		{`SELECT a FROM ex WHERE (a = 1 OR b = 30) AND d > 1;`, "{ [1,] }"},
+		{`SELECT a FROM ex WHERE NOT a < 3;`, "{ [3,][4,] }"},
+		{`SELECT a FROM ex WHERE a != 2 AND a <> 3;`, "{ [1,][4,] }"},
+		{`SELECT a FROM ex WHERE a + 2 * 3 > 8;`, "{ [3,][4,] }"},
+		{`SELECT a FROM ex WHERE a % 2 = 0;`, "{ [2,][4,] }"},
+		{`SELECT a FROM ex WHERE s > "x";`, "{ [2,][4,] }"},
+
+		// a comparison with NULL is neither true nor false.
+		{`SELECT a FROM ex WHERE b > 5;`, "{ [1,][3,] }"},
+		{`SELECT a FROM ex WHERE NOT b > 5;`, "{ [4,] }"},
+		{`SELECT a FROM ex WHERE b = NULL;`, "{  }"},
+
+		// INT with INT stays INT, with a DOUBLE it becomes DOUBLE.
+		{`SELECT a, -(a + 1) * 2 AS n, b / a, d * a FROM ex;`,
+			"{ [1,-4,10,1.5,][2,-6,NULL,5,][3,-8,10,1.5,][4,-10,1,16,] }"},
+		{`SELECT a FROM ex WHERE 7 / 2 = 3 AND a = 1;`, "{ [1,] }"},
+		{`SELECT a FROM ex WHERE 7.0 / 2 = 3.5 AND a = 1;`, "{ [1,] }"},
+
+		{`SELECT a FROM ex WHERE a + s > 1;`, "Only numbers can be computed."},
+		{`SELECT a FROM ex WHERE a / 0 > 1;`, "Division by zero."},
+		{`SELECT a FROM ex WHERE a;`, "Only conditions can be joined by AND, OR and NOT."},
+	})
+}
@@ -0,0 +1,571 @@
+package ds
+
+import (
+	"../dm"
+	"../im"
+	"../sql/lexer"
+	"../sql/parser/statements"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A diPair watches its table, so its indexes follow every record that is
+// written, moved by VACUUM or reclaimed. A deleted record keeps its entries
+// until it is reclaimed, older snapshots may still see it.
+
+// A record may refer to itself, so its FOREIGN KEYs are checked once it is
+// in the indexes.
+func (t *diPair) Inserted(txn *dm.Txn, data []byte, rid dm.RID) error {
+	if err := t.satisfies(data); err != nil {
+		return err
+	}
+
+	err := t.eachKey(data, func(index *im.IM, key []interface{}) error {
+		if index.Unique() {
+			if err := t.checkUnique(index, key, rid); err != nil {
+				return err
+			}
+		}
+		return index.Insert(txn, key, rid)
+	})
+	if err != nil {
+		return err
+	}
+	return t.checkParents(data)
+}
+
+func (t *diPair) Moved(txn *dm.Txn, data []byte, from dm.RID, to dm.RID) error {
+	return t.eachKey(data, func(index *im.IM, key []interface{}) error {
+		if err := index.Delete(txn, key, from); err != nil {
+			return err
+		}
+		return index.Insert(txn, key, to)
+	})
+}
+
+func (t *diPair) Reclaimed(txn *dm.Txn, data []byte, rid dm.RID) error {
+	return t.eachKey(data, func(index *im.IM, key []interface{}) error {
+		return index.Delete(txn, key, rid)
+	})
+}
+
+// eachKey runs fn for every index of the table with the key of the record.
+func (t *diPair) eachKey(data []byte, fn func(index *im.IM, key []interface{}) error) error {
+	if len(t.ims) == 0 {
+		return nil
+	}
+
+	values, err := t.dm.Kacher.Metadata.DecodeRecord(data)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range t.ims {
+		if err := fn(index, t.keyOf(index, values)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyOf returns the key of the record with the values in an index.
+func (t *diPair) keyOf(index *im.IM, values []interface{}) []interface{} {
+	md := t.dm.Kacher.Metadata
+
+	key := make([]interface{}, 0, len(index.Cols()))
+	for _, col := range index.Cols() {
+		for i, c := range md.Cols {
+			if c == col {
+				key = append(key, values[i])
+			}
+		}
+	}
+	return key
+}
+
+// checkUnique makes sure no record but the one at rid has the key, unless
+// it has been deleted. Keys with NULL in them never clash.
+func (t *diPair) checkUnique(index *im.IM, key []interface{}, rid dm.RID) error {
+	for _, value := range key {
+		if value == nil {
+			return nil
+		}
+	}
+
+	rids, err := index.Lookup(key)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range rids {
+		if other == rid {
+			continue
+		}
+
+		live, err := t.dm.Live(other)
+		if err != nil {
+			return err
+		}
+		if live {
+			if index.Constraint() != "" {
+				return &ConstraintError{"Duplicate key " + formatKey(key) + " violates the " +
+					index.Constraint() + " constraint " + index.Name() + "."}
+			}
+			return errors.New("Duplicate key " + formatKey(key) +
+				" for the unique index " + index.Name() + ".")
+		}
+	}
+	return nil
+}
+
+// checkKeyWidth refuses an index whose keys may not fit in a key of the
+// index manager, cols being those of the table and tps and lens their types
+// and lengths.
+func checkKeyWidth(def dm.IndexDef, cols []string, tps []string, lens []uint16) error {
+	keyTypes := make([]string, 0, len(def.Cols))
+	keyLens := make([]uint16, 0, len(def.Cols))
+	for _, col := range def.Cols {
+		for i, c := range cols {
+			if c == col {
+				keyTypes = append(keyTypes, tps[i])
+				keyLens = append(keyLens, lens[i])
+			}
+		}
+	}
+
+	if width := im.KeyWidth(keyTypes, keyLens); width > im.MAX_SIZE_OF_KEY {
+		return errors.New("The key of the index " + def.Name + " may take " + strconv.Itoa(width) +
+			" bytes, a key takes " + strconv.Itoa(im.MAX_SIZE_OF_KEY) + " at most.")
+	}
+	return nil
+}
+
+// hasIndex reports whether one of defs is called name.
+func hasIndex(defs []dm.IndexDef, name string) bool {
+	for _, def := range defs {
+		if def.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// formatKey renders a key as its value, or (v, v) for several columns.
+func formatKey(key []interface{}) string {
+	if len(key) == 1 {
+		return formatValue(key[0])
+	}
+
+	values := make([]string, len(key))
+	for i, value := range key {
+		values[i] = formatValue(value)
+	}
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+// openIndex opens the index def describes, or creates it empty.
+func (t *diPair) openIndex(def dm.IndexDef, create bool) (*im.IM, error) {
+	md := t.dm.Kacher.Metadata
+
+	tps := make([]string, 0, len(def.Cols))
+	for _, col := range def.Cols {
+		for i, c := range md.Cols {
+			if c == col {
+				tps = append(tps, md.Types[i])
+			}
+		}
+	}
+
+	if create {
+		return im.NewIndexManager(t.dm.TableName, def, tps)
+	}
+	return im.GetIndexManager(t.dm.TableName, def, tps)
+}
+
+// reopenIndex opens the index def describes, an index file of an older build
+// is built again from the records.
+func (t *diPair) reopenIndex(def dm.IndexDef) (*im.IM, error) {
+	index, err := t.openIndex(def, false)
+	if err != dm.ErrNotDBFile {
+		return index, err
+	}
+
+	if index, err = t.openIndex(def, true); err != nil {
+		return nil, err
+	}
+	if err := t.fill(index); err != nil {
+		index.Boom()
+		return nil, err
+	}
+	return index, nil
+}
+
+// CreateIndex builds an index on one or more columns from the records the
+// table holds, e.g. CREATE UNIQUE INDEX name ON t (a, b) USING HASH; Writers
+// wait meanwhile. The index is a B+tree unless using is HASH.
+func (ds DS) CreateIndex(name string, tableName string, cols []string, unique bool, using string) string {
+	table, err := ds.table(tableName)
+	if err != nil {
+		return err.Error()
+	}
+
+	switch using {
+	case "", "BTREE":
+		using = ""
+	case im.USING_HASH:
+	default:
+		return "No index type " + using + ", an index is a BTREE or a HASH."
+	}
+
+	md := table.dm.Kacher.Metadata
+	for i, col := range cols {
+		for _, other := range cols[:i] {
+			if other == col {
+				return "The col " + col + " is in the index twice."
+			}
+		}
+
+		found := false
+		for j, c := range md.Cols {
+			if c == col {
+				if !im.Indexable(md.Types[j]) {
+					return im.ErrUnindexable.Error()
+				}
+				found = true
+			}
+		}
+		if !found {
+			return "No col called " + col
+		}
+	}
+
+	if _, err := ds.tableOfIndex(name); err != dm.ErrNoSuchIndex {
+		return "There is already an index called " + name + "."
+	}
+
+	def := dm.IndexDef{Name: name, Cols: cols, Unique: unique, Using: using}
+	if err := checkKeyWidth(def, md.Cols, md.Types, md.Lens); err != nil {
+		return err.Error()
+	}
+	var index *im.IM
+
+	err = table.dm.AddIndex(def, func() error {
+		if index, err = table.openIndex(def, true); err != nil {
+			return err
+		}
+
+		if err := table.fill(index); err != nil {
+			return err
+		}
+
+		table.mu.Lock()
+		table.ims = append(table.ims, index)
+		table.mu.Unlock()
+		return nil
+	})
+
+	if err != nil {
+		if index != nil {
+			table.forget(index)
+			index.Boom()
+		}
+		return err.Error()
+	}
+	return "OK"
+}
+
+// fill puts every version stored in the table into a new index, and writes
+// the index back.
+func (t *diPair) fill(index *im.IM) error {
+	md := t.dm.Kacher.Metadata
+
+	rids, keys := make([]dm.RID, 0), make([][]interface{}, 0)
+	err := t.dm.Versions(func(rid dm.RID, data []byte) error {
+		values, err := md.DecodeRecord(data)
+		if err != nil {
+			return err
+		}
+		rids, keys = append(rids, rid), append(keys, t.keyOf(index, values))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a version deleted clashes with none.
+	for i, rid := range rids {
+		if index.Unique() {
+			live, err := t.dm.Live(rid)
+			if err != nil {
+				return err
+			}
+			if live {
+				if err := t.checkUnique(index, keys[i], rid); err != nil {
+					return err
+				}
+			}
+		}
+		if err := index.Insert(nil, keys[i], rid); err != nil {
+			return err
+		}
+	}
+	return index.Flush()
+}
+
+// forget takes the index out of the indexes of the table.
+func (t *diPair) forget(index *im.IM) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, other := range t.ims {
+		if other == index {
+			t.ims = append(t.ims[:i:i], t.ims[i+1:]...)
+			return
+		}
+	}
+}
+
+// DropIndex deletes an index, e.g. DROP INDEX name; The table may be given
+// with ON t, if several tables have an index called so.
+func (ds DS) DropIndex(name string, tableName string) string {
+	var table *diPair
+	var err error
+
+	if tableName == "" {
+		table, err = ds.tableOfIndex(name)
+	} else if table, err = ds.table(tableName); err == nil &&
+		table.dm.Kacher.Metadata.IndexDef(name) == nil {
+		err = dm.ErrNoSuchIndex
+	}
+	if err != nil {
+		return err.Error()
+	}
+
+	if def := table.dm.Kacher.Metadata.IndexDef(name); def.Constraint != "" {
+		return "The index " + name + " backs the " + def.Constraint +
+			" constraint of " + table.dm.TableName + "."
+	}
+
+	err = table.dm.DropIndex(name, func() error {
+		for _, index := range table.ims {
+			if index.Name() == name {
+				table.forget(index)
+				return index.Boom()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+// tableOfIndex returns the one table with an index called name.
+func (ds DS) tableOfIndex(name string) (*diPair, error) {
+	paths, err := filepath.Glob("*" + dm.SUFFIX_META)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *diPair
+	for _, path := range paths {
+		table, err := ds.table(strings.TrimSuffix(path, dm.SUFFIX_META))
+		if err != nil {
+			continue
+		}
+
+		if table.dm.Kacher.Metadata.IndexDef(name) != nil {
+			if found != nil {
+				return nil, errors.New("More than one table has an index called " +
+					name + ", name the table with ON.")
+			}
+			found = table
+		}
+	}
+
+	if found == nil {
+		return nil, dm.ErrNoSuchIndex
+	}
+	return found, nil
+}
+
+// indexFor picks an index to answer where with and the range of keys to look
+// through, or returns nil. Only conditions joined by AND at the top of where
+// help, comparing an indexed column with a value: equalities on the leading columns of an index,
+// then a range on the next one. More equal columns beat a range, which beats
+// an open range. The records found are checked against where all the same.
+//
+// A hash index helps only with equalities on all its columns, and is taken
+// over a B+tree that does as well. An index also serves ORDER BY if the
+// columns ordered by come next in it, after columns fixed by equalities.
+// ordered tells if the records come in that order, ascending.
+func (t *diPair) indexFor(where *statements.Where,
+	orderBy []statements.OrderByStatement) (index *im.IM, lo *im.Bound, hi *im.Bound, ordered bool) {
+	conds := make([]statements.Condition, 0)
+	if where != nil {
+		conds = statements.Conditions(where.Expr)
+	}
+
+	best := 0
+	for _, candidate := range t.ims {
+		prefix := make([]interface{}, 0)
+		var from, to *im.Bound
+		score := 0
+
+		for _, col := range candidate.Cols() {
+			l, h := t.boundsOn(conds, col)
+			if l != nil && h != nil && l.Inclusive && h.Inclusive {
+				if c, _ := dm.Compare(l.Key[0], h.Key[0]); c == 0 {
+					prefix = append(prefix, l.Key[0])
+					score += 3
+					continue
+				}
+			}
+
+			if l != nil {
+				from = &im.Bound{Key: append(prefix[:len(prefix):len(prefix)], l.Key...), Inclusive: l.Inclusive}
+				score++
+			}
+			if h != nil {
+				to = &im.Bound{Key: append(prefix[:len(prefix):len(prefix)], h.Key...), Inclusive: h.Inclusive}
+				score++
+			}
+			break
+		}
+
+		if !candidate.Ordered() && len(prefix) < len(candidate.Cols()) {
+			continue
+		}
+
+		if len(prefix) > 0 {
+			if from == nil {
+				from = &im.Bound{Key: prefix, Inclusive: true}
+			}
+			if to == nil {
+				to = &im.Bound{Key: prefix, Inclusive: true}
+			}
+		}
+
+		serves := candidate.Ordered() && servesOrder(candidate.Cols(), len(prefix), orderBy)
+		rank := score * 4
+		if serves {
+			rank += 2
+		}
+		if !candidate.Ordered() {
+			rank++
+		}
+		if rank > best {
+			index, lo, hi, ordered, best = candidate, from, to, serves, rank
+		}
+	}
+	return index, lo, hi, ordered
+}
+
+// boundsOn returns the narrowest bounds the conditions put on a column, each
+// a key of that column alone.
+func (t *diPair) boundsOn(conds []statements.Condition, name string) (*im.Bound, *im.Bound) {
+	md := t.dm.Kacher.Metadata
+	var lo, hi *im.Bound
+
+	for _, cond := range conds {
+		col, value, op := md.ColOf(cond.LVal), cond.RVal, cond.Op.Op
+		if col == -1 {
+			col, value, op = md.ColOf(cond.RVal), cond.LVal, flip(op)
+		}
+		if col == -1 || md.Cols[col] != name || md.ColOf(value) != -1 {
+			continue
+		}
+
+		key, ok := keyFor(md.Types[col], value.Value.(lexer.Token).Value)
+		if !ok {
+			continue
+		}
+
+		b := &im.Bound{Key: []interface{}{key}, Inclusive: op != "<" && op != ">"}
+		if op == "==" || op == ">" || op == ">=" {
+			lo = tighter(lo, b, 1)
+		}
+		if op == "==" || op == "<" || op == "<=" {
+			hi = tighter(hi, b, -1)
+		}
+	}
+	return lo, hi
+}
+
+// servesOrder reports whether the entries of an index on cols, with the
+// first fixed columns the same, come in the order asked for, ascending.
+func servesOrder(cols []string, fixed int, orderBy []statements.OrderByStatement) bool {
+	if len(orderBy) == 0 {
+		return false
+	}
+	for _, o := range orderBy {
+		if o.Desc() != orderBy[0].Desc() {
+			return false
+		}
+	}
+
+	for skip := 0; skip <= fixed; skip++ {
+		if skip+len(orderBy) > len(cols) {
+			return false
+		}
+
+		same := true
+		for i, o := range orderBy {
+			if cols[skip+i] != o.Name() {
+				same = false
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// tighter returns the narrower of two lower bounds, dir 1, or upper bounds,
+// dir -1, on one column.
+func tighter(cur *im.Bound, b *im.Bound, dir int) *im.Bound {
+	if cur == nil {
+		return b
+	}
+
+	c, _ := dm.Compare(b.Key[0], cur.Key[0])
+	if c*dir > 0 || c == 0 && !b.Inclusive {
+		return b
+	}
+	return cur
+}
+
+// flip turns the operator around, for a condition written value op col.
+func flip(op string) string {
+	switch op {
+	case "<":
+		return ">"
+	case "<=":
+		return ">="
+	case ">":
+		return "<"
+	case ">=":
+		return "<="
+	}
+	return op
+}
+
+// keyFor turns a literal into a key of an index on a column of type tp.
+func keyFor(tp string, value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case int64:
+		if tp == "DOUBLE" {
+			return float64(v), true
+		}
+		return v, tp == "INT"
+	case float64:
+		return v, tp == "DOUBLE"
+	case string:
+		return v, tp == "STRING"
+	}
+	return nil, false
+}
@@ -0,0 +1,371 @@
+package im
+
+import (
+	"../dm"
+	"bytes"
+	"encoding/binary"
+)
+
+// B+树：第1页总是根，根分裂时它的两半搬到两个新页，根改为指向它们。
+// 节点放在页头之后：叶子标志(1) 项数(2) 下一叶(8)，内部节点接着是最左孩子(8)；
+// 然后是各项：键长(2) 键 RID(10)，内部节点的项后面再跟右孩子(8)。
+// 项先按键、再按RID排，同键的项各不相同，删除时能找到确切的那一项。
+// 节点整个读出、修改、写回；删除不合并节点，空叶子留在链中。
+
+const (
+	ROOT = dm.FIRST_PAGE
+
+	SIZE_OF_NODE_HEAD = 1 + 2 + dm.SIZE_OF_PGNO
+	NODE_CAPACITY     = dm.PAGE_SIZE - dm.SIZE_OF_PAGE_HEAD
+)
+
+type entry struct {
+	key   []byte
+	rid   dm.RID
+	child uint64 // the subtree of entries from this one on, in an internal node
+}
+
+type node struct {
+	leaf    bool
+	next    uint64 // the leaf after this one
+	first   uint64 // the subtree of entries before the first, in an internal node
+	entries []entry
+}
+
+func (e entry) compare(o entry) int {
+	if c := bytes.Compare(e.key, o.key); c != 0 {
+		return c
+	}
+	switch {
+	case e.rid.PgNo != o.rid.PgNo:
+		if e.rid.PgNo < o.rid.PgNo {
+			return -1
+		}
+		return 1
+	case e.rid.Slot != o.rid.Slot:
+		if e.rid.Slot < o.rid.Slot {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func (n *node) sizeOf(e entry) int {
+	size := 2 + len(e.key) + dm.SIZE_OF_RID
+	if !n.leaf {
+		size += dm.SIZE_OF_PGNO
+	}
+	return size
+}
+
+func (n *node) size() int {
+	size := SIZE_OF_NODE_HEAD
+	if !n.leaf {
+		size += dm.SIZE_OF_PGNO
+	}
+	for _, e := range n.entries {
+		size += n.sizeOf(e)
+	}
+	return size
+}
+
+// search returns the position of the first entry not before e.
+func (n *node) search(e entry) int {
+	lo, hi := 0, len(n.entries)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if n.entries[mid].compare(e) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// childFor returns the position of the child holding e, 0 for first, and the
+// child.
+func (n *node) childFor(e entry) (int, uint64) {
+	i := n.search(e)
+	if i < len(n.entries) && n.entries[i].compare(e) == 0 {
+		i++
+	}
+	if i == 0 {
+		return 0, n.first
+	}
+	return i, n.entries[i-1].child
+}
+
+func (n *node) encode(body []byte) {
+	for i := range body {
+		body[i] = 0
+	}
+
+	if n.leaf {
+		body[0] = 1
+	}
+	binary.BigEndian.PutUint16(body[1:], uint16(len(n.entries)))
+	binary.BigEndian.PutUint64(body[3:], n.next)
+
+	off := SIZE_OF_NODE_HEAD
+	if !n.leaf {
+		binary.BigEndian.PutUint64(body[off:], n.first)
+		off += dm.SIZE_OF_PGNO
+	}
+
+	for _, e := range n.entries {
+		binary.BigEndian.PutUint16(body[off:], uint16(len(e.key)))
+		off += 2
+		off += copy(body[off:], e.key)
+		off += copy(body[off:], e.rid.Bytes())
+		if !n.leaf {
+			binary.BigEndian.PutUint64(body[off:], e.child)
+			off += dm.SIZE_OF_PGNO
+		}
+	}
+}
+
+func decode(body []byte) (*node, error) {
+	if len(body) < SIZE_OF_NODE_HEAD || body[0] > 1 {
+		return nil, ErrIndexCorrupt
+	}
+
+	n := &node{
+		leaf: body[0] == 1,
+		next: binary.BigEndian.Uint64(body[3:]),
+	}
+	count := int(binary.BigEndian.Uint16(body[1:]))
+
+	off := SIZE_OF_NODE_HEAD
+	if !n.leaf {
+		if off+dm.SIZE_OF_PGNO > len(body) {
+			return nil, ErrIndexCorrupt
+		}
+		n.first = binary.BigEndian.Uint64(body[off:])
+		off += dm.SIZE_OF_PGNO
+	}
+
+	n.entries = make([]entry, count)
+	for i := range n.entries {
+		if off+2 > len(body) {
+			return nil, ErrIndexCorrupt
+		}
+		size := int(binary.BigEndian.Uint16(body[off:]))
+		off += 2
+
+		end := off + size + dm.SIZE_OF_RID
+		if !n.leaf {
+			end += dm.SIZE_OF_PGNO
+		}
+		if end > len(body) {
+			return nil, ErrIndexCorrupt
+		}
+
+		e := &n.entries[i]
+		e.key = make([]byte, size)
+		off += copy(e.key, body[off:off+size])
+		e.rid = dm.RIDFrom(body[off:])
+		off += dm.SIZE_OF_RID
+		if !n.leaf {
+			e.child = binary.BigEndian.Uint64(body[off:])
+			off += dm.SIZE_OF_PGNO
+		}
+	}
+	return n, nil
+}
+
+func (im *IM) read(pgNo uint64) (*node, error) {
+	body, err := im.readBody(pgNo)
+	if err != nil {
+		return nil, err
+	}
+	return decode(body)
+}
+
+func (im *IM) write(txn *dm.Txn, pgNo uint64, n *node) error {
+	return im.writeBody(txn, pgNo, n.encode)
+}
+
+// alloc writes n to a new page and returns its number.
+func (im *IM) alloc(txn *dm.Txn, n *node) (uint64, error) {
+	return im.allocBody(txn, n.encode)
+}
+
+// readBody returns a copy of the body of a page.
+func (im *IM) readBody(pgNo uint64) ([]byte, error) {
+	page, err := im.file.Page(pgNo)
+	if err != nil {
+		return nil, err
+	}
+	defer im.file.Unpin(page)
+
+	page.Latch().RLock()
+	defer page.Latch().RUnlock()
+
+	return append([]byte(nil), page.Body()...), nil
+}
+
+// writeBody changes the body of a page with fn.
+func (im *IM) writeBody(txn *dm.Txn, pgNo uint64, fn func(body []byte)) error {
+	page, err := im.file.Page(pgNo)
+	if err != nil {
+		return err
+	}
+	defer im.file.Unpin(page)
+
+	page.Latch().Lock()
+	defer page.Latch().Unlock()
+
+	return txn.Change(page, fn)
+}
+
+// allocBody adds a page, fills its body with fn and returns its number.
+func (im *IM) allocBody(txn *dm.Txn, fn func(body []byte)) (uint64, error) {
+	page, err := im.file.NewPage()
+	if err != nil {
+		return 0, err
+	}
+	defer im.file.Unpin(page)
+
+	page.Latch().Lock()
+	defer page.Latch().Unlock()
+
+	return page.PgNo(), txn.Change(page, fn)
+}
+
+// insert puts e into the subtree at pgNo. If the node there splits, it
+// returns the entry to put into its parent for the new right half.
+func (im *IM) insert(txn *dm.Txn, pgNo uint64, e entry) (*entry, error) {
+	n, err := im.read(pgNo)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.leaf {
+		i := n.search(e)
+		if i < len(n.entries) && n.entries[i].compare(e) == 0 {
+			return nil, nil
+		}
+		n.entries = append(n.entries, entry{})
+		copy(n.entries[i+1:], n.entries[i:])
+		n.entries[i] = e
+	} else {
+		i, child := n.childFor(e)
+		up, err := im.insert(txn, child, e)
+		if up == nil || err != nil {
+			return nil, err
+		}
+		n.entries = append(n.entries, entry{})
+		copy(n.entries[i+1:], n.entries[i:])
+		n.entries[i] = *up
+	}
+
+	if n.size() <= NODE_CAPACITY {
+		return nil, im.write(txn, pgNo, n)
+	}
+	return im.split(txn, pgNo, n)
+}
+
+// split moves the upper half of n, by bytes, to a new page.
+func (im *IM) split(txn *dm.Txn, pgNo uint64, n *node) (*entry, error) {
+	total, half, cut := n.size(), 0, 0
+	for cut < len(n.entries)-1 && half < total/2 {
+		half += n.sizeOf(n.entries[cut])
+		cut++
+	}
+
+	right := &node{leaf: n.leaf, next: dm.NO_PAGE}
+	var up entry
+	if n.leaf {
+		right.entries = append(right.entries, n.entries[cut:]...)
+		right.next = n.next
+		up = entry{key: right.entries[0].key, rid: right.entries[0].rid}
+	} else {
+		right.first = n.entries[cut].child
+		right.entries = append(right.entries, n.entries[cut+1:]...)
+		up = entry{key: n.entries[cut].key, rid: n.entries[cut].rid}
+	}
+	n.entries = n.entries[:cut]
+
+	rightNo, err := im.alloc(txn, right)
+	if err != nil {
+		return nil, err
+	}
+	if n.leaf {
+		n.next = rightNo
+	}
+	up.child = rightNo
+
+	return &up, im.write(txn, pgNo, n)
+}
+
+// growRoot moves the root, split into up and what is left, a level down.
+func (im *IM) growRoot(txn *dm.Txn, up *entry) error {
+	left, err := im.read(ROOT)
+	if err != nil {
+		return err
+	}
+
+	leftNo, err := im.alloc(txn, left)
+	if err != nil {
+		return err
+	}
+
+	root := &node{next: dm.NO_PAGE, first: leftNo, entries: []entry{*up}}
+	return im.write(txn, ROOT, root)
+}
+
+// remove takes e out of its leaf, if it is there.
+func (im *IM) remove(txn *dm.Txn, e entry) error {
+	pgNo := uint64(ROOT)
+	for {
+		n, err := im.read(pgNo)
+		if err != nil {
+			return err
+		}
+
+		if !n.leaf {
+			_, pgNo = n.childFor(e)
+			continue
+		}
+
+		i := n.search(e)
+		if i == len(n.entries) || n.entries[i].compare(e) != 0 {
+			return nil
+		}
+		n.entries = append(n.entries[:i], n.entries[i+1:]...)
+		return im.write(txn, pgNo, n)
+	}
+}
+
+// scan visits the entries from the first not before from in order, until fn
+// returns false.
+func (im *IM) scan(from entry, fn func(e entry) bool) error {
+	pgNo := uint64(ROOT)
+	for {
+		n, err := im.read(pgNo)
+		if err != nil {
+			return err
+		}
+
+		if !n.leaf {
+			_, pgNo = n.childFor(from)
+			continue
+		}
+
+		for i := n.search(from); ; i = 0 {
+			for ; i < len(n.entries); i++ {
+				if !fn(n.entries[i]) {
+					return nil
+				}
+			}
+			if n.next == dm.NO_PAGE {
+				return nil
+			}
+			if n, err = im.read(n.next); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package im
+
+import (
+	"../dm"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sort"
+)
+
+// 哈希索引：线性散列。第1页记着层数(2)、下一个要分裂的桶(8)和第一页目录(8)；
+// 目录页记着下一页目录(8)、桶数(2)和各桶首页的页号。
+// 桶与B+树的叶子一样编码，next接着溢出页。每添一页溢出页就分裂一个桶，
+// 桶数为 INITIAL_BUCKETS<<层数 再加上已分裂的桶数。页不归还，空页留在桶中。
+// 只能找与键相等的项，不能按顺序扫描。
+// 目录不留在内存中，每次操作都从第1页读出，回滚撤销了分裂也不会过时。
+
+const (
+	USING_HASH = "HASH"
+	HASH_MAGIC = "lipDB.ih"
+
+	INITIAL_BUCKETS = 4
+
+	SIZE_OF_HASH_HEAD = 2 + 8 + dm.SIZE_OF_PGNO
+	SIZE_OF_DIR_HEAD  = dm.SIZE_OF_PGNO + 2
+	DIR_CAPACITY      = (NODE_CAPACITY - SIZE_OF_DIR_HEAD) / dm.SIZE_OF_PGNO
+)
+
+var ErrNotOrdered = errors.New("A hash index only finds equal keys.")
+
+type hashDir struct {
+	level   uint16
+	split   uint64   // the next bucket to split
+	buckets []uint64 // the first page of each bucket
+	pages   []uint64 // the pages of the directory
+}
+
+// createHash lays out an empty hash index in a new file.
+func (im *IM) createHash(txn *dm.Txn) error {
+	dir := &hashDir{}
+
+	if _, err := im.allocBody(txn, dir.encodeHead); err != nil {
+		return err
+	}
+
+	for i := 0; i < INITIAL_BUCKETS; i++ {
+		pages, err := im.writeChain(txn, nil, nil)
+		if err != nil {
+			return err
+		}
+		dir.buckets = append(dir.buckets, pages[0])
+	}
+
+	if err := im.saveDir(txn, dir, 0); err != nil {
+		return err
+	}
+	return im.writeBody(txn, ROOT, dir.encodeHead)
+}
+
+// readDir reads the directory of a hash index.
+func (im *IM) readDir() (*hashDir, error) {
+	head, err := im.readBody(ROOT)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := &hashDir{
+		level: binary.BigEndian.Uint16(head),
+		split: binary.BigEndian.Uint64(head[2:]),
+	}
+
+	for pgNo := binary.BigEndian.Uint64(head[10:]); pgNo != dm.NO_PAGE; {
+		if pgNo <= ROOT || pgNo >= im.file.NumOfPages() || len(dir.pages) > len(dir.buckets) {
+			return nil, ErrIndexCorrupt
+		}
+
+		body, err := im.readBody(pgNo)
+		if err != nil {
+			return nil, err
+		}
+
+		count := int(binary.BigEndian.Uint16(body[dm.SIZE_OF_PGNO:]))
+		if count > DIR_CAPACITY {
+			return nil, ErrIndexCorrupt
+		}
+		for i := 0; i < count; i++ {
+			off := SIZE_OF_DIR_HEAD + i*dm.SIZE_OF_PGNO
+			dir.buckets = append(dir.buckets, binary.BigEndian.Uint64(body[off:]))
+		}
+
+		dir.pages = append(dir.pages, pgNo)
+		pgNo = binary.BigEndian.Uint64(body)
+	}
+
+	if uint64(len(dir.buckets)) != INITIAL_BUCKETS<<dir.level+dir.split {
+		return nil, ErrIndexCorrupt
+	}
+	return dir, nil
+}
+
+func (dir *hashDir) encodeHead(body []byte) {
+	for i := range body {
+		body[i] = 0
+	}
+
+	first := uint64(dm.NO_PAGE)
+	if len(dir.pages) > 0 {
+		first = dir.pages[0]
+	}
+
+	binary.BigEndian.PutUint16(body, dir.level)
+	binary.BigEndian.PutUint64(body[2:], dir.split)
+	binary.BigEndian.PutUint64(body[10:], first)
+}
+
+// saveDir writes the directory back from the page holding bucket from on,
+// adding pages for new buckets.
+func (im *IM) saveDir(txn *dm.Txn, dir *hashDir, from int) error {
+	start := from / DIR_CAPACITY
+
+	for len(dir.pages)*DIR_CAPACITY < len(dir.buckets) {
+		pgNo, err := im.allocBody(txn, func(body []byte) {})
+		if err != nil {
+			return err
+		}
+		dir.pages = append(dir.pages, pgNo)
+
+		// the page before has to point at the new one.
+		if len(dir.pages)-2 < start {
+			start = len(dir.pages) - 2
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	for k := start; k < len(dir.pages); k++ {
+		next := uint64(dm.NO_PAGE)
+		if k+1 < len(dir.pages) {
+			next = dir.pages[k+1]
+		}
+
+		buckets := dir.buckets[k*DIR_CAPACITY:]
+		if len(buckets) > DIR_CAPACITY {
+			buckets = buckets[:DIR_CAPACITY]
+		}
+
+		err := im.writeBody(txn, dir.pages[k], func(body []byte) {
+			for i := range body {
+				body[i] = 0
+			}
+			binary.BigEndian.PutUint64(body, next)
+			binary.BigEndian.PutUint16(body[dm.SIZE_OF_PGNO:], uint16(len(buckets)))
+			for i, pgNo := range buckets {
+				binary.BigEndian.PutUint64(body[SIZE_OF_DIR_HEAD+i*dm.SIZE_OF_PGNO:], pgNo)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashOf(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// bucketOf returns the bucket holding key.
+func (dir *hashDir) bucketOf(key []byte) uint64 {
+	h, n := hashOf(key), uint64(INITIAL_BUCKETS)<<dir.level
+	if b := h % n; b >= dir.split {
+		return b
+	}
+	return h % (2 * n)
+}
+
+// chain returns the pages of a bucket and its entries.
+func (im *IM) chain(dir *hashDir, bucket uint64) ([]uint64, []*node, error) {
+	pages, nodes := make([]uint64, 0), make([]*node, 0)
+
+	for pgNo := dir.buckets[bucket]; pgNo != dm.NO_PAGE; {
+		if len(pages) > int(im.file.NumOfPages()) {
+			return nil, nil, ErrIndexCorrupt
+		}
+
+		n, err := im.read(pgNo)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !n.leaf {
+			return nil, nil, ErrIndexCorrupt
+		}
+
+		pages, nodes = append(pages, pgNo), append(nodes, n)
+		pgNo = n.next
+	}
+	return pages, nodes, nil
+}
+
+// hashInsert puts e into its bucket. If the bucket has to grow, the next
+// bucket in turn is split.
+func (im *IM) hashInsert(txn *dm.Txn, e entry) error {
+	dir, err := im.readDir()
+	if err != nil {
+		return err
+	}
+
+	pages, nodes, err := im.chain(dir, dir.bucketOf(e.key))
+	if err != nil {
+		return err
+	}
+
+	room := -1
+	for i, n := range nodes {
+		j := n.search(e)
+		if j < len(n.entries) && n.entries[j].compare(e) == 0 {
+			return nil
+		}
+		if room == -1 && n.size()+n.sizeOf(e) <= NODE_CAPACITY {
+			room = i
+		}
+	}
+
+	if room != -1 {
+		n := nodes[room]
+		j := n.search(e)
+		n.entries = append(n.entries, entry{})
+		copy(n.entries[j+1:], n.entries[j:])
+		n.entries[j] = e
+		return im.write(txn, pages[room], n)
+	}
+
+	pgNo, err := im.alloc(txn, &node{leaf: true, next: dm.NO_PAGE, entries: []entry{e}})
+	if err != nil {
+		return err
+	}
+	last := nodes[len(nodes)-1]
+	last.next = pgNo
+	if err := im.write(txn, pages[len(pages)-1], last); err != nil {
+		return err
+	}
+	return im.splitBucket(txn, dir)
+}
+
+// splitBucket moves the entries of the next bucket to split that hash to a
+// new bucket there.
+func (im *IM) splitBucket(txn *dm.Txn, dir *hashDir) error {
+	n := uint64(INITIAL_BUCKETS) << dir.level
+
+	pages, nodes, err := im.chain(dir, dir.split)
+	if err != nil {
+		return err
+	}
+
+	stay, move := make([]entry, 0), make([]entry, 0)
+	for _, nd := range nodes {
+		for _, e := range nd.entries {
+			if hashOf(e.key)%(2*n) == dir.split {
+				stay = append(stay, e)
+			} else {
+				move = append(move, e)
+			}
+		}
+	}
+
+	moved, err := im.writeChain(txn, nil, move)
+	if err != nil {
+		return err
+	}
+	if _, err := im.writeChain(txn, pages, stay); err != nil {
+		return err
+	}
+
+	dir.buckets = append(dir.buckets, moved[0])
+	if dir.split++; dir.split == n {
+		dir.level++
+		dir.split = 0
+	}
+
+	if err := im.saveDir(txn, dir, len(dir.buckets)-1); err != nil {
+		return err
+	}
+	return im.writeBody(txn, ROOT, dir.encodeHead)
+}
+
+// writeChain writes entries over the pages of a bucket, adding pages if they
+// don't fit, and returns the pages. Pages left over stay at the end, empty.
+func (im *IM) writeChain(txn *dm.Txn, pages []uint64, entries []entry) ([]uint64, error) {
+	sort.Slice(entries, func(i int, j int) bool {
+		return entries[i].compare(entries[j]) < 0
+	})
+
+	n := &node{leaf: true}
+	nodes, size := []*node{n}, n.size()
+	for _, e := range entries {
+		if len(n.entries) > 0 && size+n.sizeOf(e) > NODE_CAPACITY {
+			n = &node{leaf: true}
+			nodes, size = append(nodes, n), n.size()
+		}
+		n.entries = append(n.entries, e)
+		size += n.sizeOf(e)
+	}
+	for len(nodes) < len(pages) {
+		nodes = append(nodes, &node{leaf: true})
+	}
+
+	pages = pages[:len(pages):len(pages)]
+	for len(pages) < len(nodes) {
+		pgNo, err := im.alloc(txn, &node{leaf: true, next: dm.NO_PAGE})
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, pgNo)
+	}
+
+	for i, n := range nodes {
+		n.next = dm.NO_PAGE
+		if i+1 < len(nodes) {
+			n.next = pages[i+1]
+		}
+		if err := im.write(txn, pages[i], n); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// hashRemove takes e out of its bucket, if it is there.
+func (im *IM) hashRemove(txn *dm.Txn, e entry) error {
+	dir, err := im.readDir()
+	if err != nil {
+		return err
+	}
+
+	pages, nodes, err := im.chain(dir, dir.bucketOf(e.key))
+	if err != nil {
+		return err
+	}
+
+	for i, n := range nodes {
+		j := n.search(e)
+		if j < len(n.entries) && n.entries[j].compare(e) == 0 {
+			n.entries = append(n.entries[:j], n.entries[j+1:]...)
+			return im.write(txn, pages[i], n)
+		}
+	}
+	return nil
+}
+
+// hashLookup returns the positions of the records with the key, in the
+// order of the records in the table.
+func (im *IM) hashLookup(key []byte) ([]dm.RID, error) {
+	dir, err := im.readDir()
+	if err != nil {
+		return nil, err
+	}
+
+	_, nodes, err := im.chain(dir, dir.bucketOf(key))
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]entry, 0)
+	for _, n := range nodes {
+		for _, e := range n.entries {
+			if bytes.Equal(e.key, key) {
+				found = append(found, e)
+			}
+		}
+	}
+	sort.Slice(found, func(i int, j int) bool {
+		return found[i].compare(found[j]) < 0
+	})
+
+	rids := make([]dm.RID, len(found))
+	for i, e := range found {
+		rids[i] = e.rid
+	}
+	return rids, nil
+}
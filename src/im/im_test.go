@@ -0,0 +1,337 @@
+package im
+
+import (
+	"../dm"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "im")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testKey is the key (a, b) of the record at rid, b being wide enough that
+// a page holds a few dozen of them.
+type testKey struct {
+	a   int64
+	b   string
+	rid dm.RID
+}
+
+func (k testKey) values() []interface{} {
+	return []interface{}{k.a, k.b}
+}
+
+func testKeys(n int) []testKey {
+	keys := make([]testKey, n)
+	for i := range keys {
+		keys[i] = testKey{
+			a:   int64(i % 50),
+			b:   strings.Repeat(string(rune('a'+i%7)), 100),
+			rid: dm.RID{PgNo: uint64(i), Slot: uint16(i % 3)},
+		}
+	}
+	return keys
+}
+
+// ridsBetween returns the rids of the keys whose a is in [lo, hi), in the
+// order of the keys.
+func ridsBetween(keys []testKey, lo int64, hi int64) []dm.RID {
+	in := make([]testKey, 0)
+	for _, k := range keys {
+		if k.a >= lo && k.a < hi {
+			in = append(in, k)
+		}
+	}
+	sort.Slice(in, func(i, j int) bool {
+		x, y := in[i], in[j]
+		if x.a != y.a {
+			return x.a < y.a
+		}
+		if x.b != y.b {
+			return x.b < y.b
+		}
+		if x.rid.PgNo != y.rid.PgNo {
+			return x.rid.PgNo < y.rid.PgNo
+		}
+		return x.rid.Slot < y.rid.Slot
+	})
+
+	rids := make([]dm.RID, len(in))
+	for i, k := range in {
+		rids[i] = k.rid
+	}
+	return rids
+}
+
+// depthOf returns the levels of the tree, 1 for a root that is a leaf.
+func depthOf(t *testing.T, index *IM) int {
+	depth := 1
+	for pgNo := uint64(ROOT); ; depth++ {
+		n, err := index.read(pgNo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.leaf {
+			return depth
+		}
+		pgNo = n.first
+	}
+}
+
+func checkRanges(t *testing.T, index *IM, keys []testKey) {
+	cases := []struct {
+		lo, hi *Bound
+		from   int64
+		to     int64
+	}{
+		{nil, nil, 0, 50},
+		{&Bound{[]interface{}{int64(10)}, true}, &Bound{[]interface{}{int64(12)}, false}, 10, 12},
+		{&Bound{[]interface{}{int64(10)}, false}, &Bound{[]interface{}{int64(12)}, true}, 11, 13},
+		{nil, &Bound{[]interface{}{int64(3)}, false}, 0, 3},
+		{&Bound{[]interface{}{int64(45)}, true}, nil, 45, 50},
+		{&Bound{[]interface{}{int64(20)}, true}, &Bound{[]interface{}{int64(20)}, true}, 20, 21},
+	}
+
+	for i, c := range cases {
+		rids, err := index.Range(c.lo, c.hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := ridsBetween(keys, c.from, c.to); !reflect.DeepEqual(rids, want) {
+			t.Fatalf("range %d: got %d rids, want %d in key order", i, len(rids), len(want))
+		}
+	}
+}
+
+func TestBTreeSplitAndRange(t *testing.T) {
+	def := dm.IndexDef{Name: "ab", Cols: []string{"a", "b"}}
+	index, err := NewIndexManager("bt", def, []string{"INT", "STRING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeys(3000)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(len(keys)) {
+		if err := index.Insert(nil, keys[i].values(), keys[i].rid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the leaves and the nodes above them have split.
+	if depth := depthOf(t, index); depth < 3 {
+		t.Fatalf("the tree has %d levels, want 3 at least", depth)
+	}
+	checkRanges(t, index, keys)
+
+	rids, err := index.Lookup(keys[57].values())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rids) != 9 { // i%50 == 7 && i%7 == 1 once in 350
+		t.Fatalf("lookup found %d rids, want 9", len(rids))
+	}
+
+	// the tree reads back the same.
+	if err := index.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = GetIndexManager("bt", def, []string{"INT", "STRING"}); err != nil {
+		t.Fatal(err)
+	}
+	checkRanges(t, index, keys)
+}
+
+func TestBTreeDeleteEmptiesLeaves(t *testing.T) {
+	def := dm.IndexDef{Name: "ab", Cols: []string{"a", "b"}}
+	index, err := NewIndexManager("bd", def, []string{"INT", "STRING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeys(3000)
+	for _, k := range keys {
+		if err := index.Insert(nil, k.values(), k.rid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// leaves are not merged, the scans step over the empty ones.
+	left := make([]testKey, 0)
+	for _, k := range keys {
+		if k.a >= 5 && k.a < 45 {
+			if err := index.Delete(nil, k.values(), k.rid); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			left = append(left, k)
+		}
+	}
+	checkRanges(t, index, left)
+
+	if rids, err := index.Lookup(keys[20].values()); err != nil || len(rids) != 0 {
+		t.Fatalf("lookup of a deleted key found %v, %v", rids, err)
+	}
+
+	// the empty leaves fill again.
+	for _, k := range keys[:500] {
+		if err := index.Insert(nil, k.values(), k.rid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range keys[:500] {
+		if k.a >= 5 && k.a < 45 {
+			left = append(left, k)
+		}
+	}
+	checkRanges(t, index, left)
+}
+
+func TestHashBucketSplits(t *testing.T) {
+	def := dm.IndexDef{Name: "a", Cols: []string{"a"}, Using: USING_HASH}
+	index, err := NewIndexManager("h", def, []string{"INT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 5000
+	for i := 0; i < n; i++ {
+		rid := dm.RID{PgNo: uint64(i)}
+		if err := index.Insert(nil, []interface{}{int64(i)}, rid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a key of several records.
+	for slot := uint16(1); slot < 4; slot++ {
+		if err := index.Insert(nil, []interface{}{int64(7)}, dm.RID{PgNo: 7, Slot: slot}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := dirOf(t, index)
+	if buckets := len(dir.buckets); buckets <= INITIAL_BUCKETS || dir.level == 0 {
+		t.Fatalf("%d buckets at level %d, want the buckets to have split", buckets, dir.level)
+	}
+
+	check := func(index *IM) {
+		for i := 0; i < n; i++ {
+			rids, err := index.Lookup([]interface{}{int64(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []dm.RID{{PgNo: uint64(i)}}
+			if i == 7 {
+				want = []dm.RID{{7, 0}, {7, 1}, {7, 2}, {7, 3}}
+			}
+			if !reflect.DeepEqual(rids, want) {
+				t.Fatalf("lookup of %d found %v, want %v", i, rids, want)
+			}
+		}
+	}
+	check(index)
+
+	b := &Bound{[]interface{}{int64(1)}, true}
+	if _, err := index.Range(b, nil); err != ErrNotOrdered {
+		t.Fatalf("a range over a hash index gave %v", err)
+	}
+
+	if err := index.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := GetIndexManager("h", def, []string{"INT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets := len(dirOf(t, reopened).buckets); buckets != len(dir.buckets) {
+		t.Fatalf("reopened with %d buckets, want %d", buckets, len(dir.buckets))
+	}
+	check(reopened)
+
+	if err := reopened.Delete(nil, []interface{}{int64(7)}, dm.RID{PgNo: 7, Slot: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if rids, _ := reopened.Lookup([]interface{}{int64(7)}); len(rids) != 3 {
+		t.Fatalf("after a delete found %v, want 3 rids", rids)
+	}
+}
+
+func dirOf(t *testing.T, index *IM) *hashDir {
+	dir, err := index.readDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// The buckets split by a transaction rolled back are as they were before.
+func TestHashRollback(t *testing.T) {
+	def := dm.IndexDef{Name: "a", Cols: []string{"a"}, Using: USING_HASH}
+	index, err := NewIndexManager("hr", def, []string{"INT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := index.Insert(nil, []interface{}{int64(i)}, dm.RID{PgNo: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before := dirOf(t, index)
+
+	txn, _ := dm.Begin()
+	if err := txn.LockForWrite(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 3000; i++ {
+		if err := index.Insert(txn, []interface{}{int64(i)}, dm.RID{PgNo: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dirOf(t, index).buckets) == len(before.buckets) {
+		t.Fatal("no bucket has split")
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dir := dirOf(t, index); !reflect.DeepEqual(dir, before) {
+		t.Fatalf("after the rollback %d buckets at level %d, want %d at level %d",
+			len(dir.buckets), dir.level, len(before.buckets), before.level)
+	}
+
+	for i := 100; i < 200; i++ {
+		if err := index.Insert(nil, []interface{}{int64(i)}, dm.RID{PgNo: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 300; i++ {
+		rids, err := index.Lookup([]interface{}{int64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []dm.RID{}
+		if i < 200 {
+			want = []dm.RID{{PgNo: uint64(i)}}
+		}
+		if !reflect.DeepEqual(rids, want) {
+			t.Fatalf("lookup of %d found %v, want %v", i, rids, want)
+		}
+	}
+}
@@ -1,63 +1,247 @@
 package im
 
 import (
-	"errors"
-	"github.com/datastream/btree"
+	"../dm"
+	"bytes"
 	"os"
+	"sync"
 )
 
-const SUFFIX_INDEX = ".index"
+const (
+	SUFFIX_INDEX = ".index"
+	INDEX_MAGIC  = "lipDB.ik" // keys of one column without NULL were "lipDB.ix"
+)
 
 type IndexManager interface {
+	Insert(txn *dm.Txn, key []interface{}, rid dm.RID) error
+	Delete(txn *dm.Txn, key []interface{}, rid dm.RID) error
+	Lookup(key []interface{}) ([]dm.RID, error)
+	Range(lo *Bound, hi *Bound) ([]dm.RID, error)
+	Boom() error
+}
+
+// Bound limits a Range by the values of the leading columns of the keys, a
+// nil Bound leaves that end open.
+type Bound struct {
+	Key       []interface{}
+	Inclusive bool
 }
 
 type IM struct {
 	tableName string
-	indexName string
-	TR        *btree.Btree
+	def       dm.IndexDef
+	keyTypes  []string
+	file      *dm.PageFile
+	mu        sync.RWMutex // readers share the tree, a writer changes it alone
+}
+
+func pathOf(tableName string, index string) string {
+	return tableName + "_" + index + SUFFIX_INDEX
 }
 
-func NewIndexManager(tableName string, index string) (*IM, error) {
-	if _, err :=
-		btree.Unmarshal(tableName + "_" + index + SUFFIX_INDEX); err != nil {
-		return nil, errors.New("Index_Manager has already existed.")
+// NewIndexManager creates an empty index on the columns of def, of the types
+// keyTypes. A file left by an index the table does not know anymore is
+// replaced.
+func NewIndexManager(tableName string, def dm.IndexDef, keyTypes []string) (*IM, error) {
+	if len(keyTypes) != len(def.Cols) {
+		return nil, ErrKeyType
+	}
+	for _, tp := range keyTypes {
+		if !Indexable(tp) {
+			return nil, ErrUnindexable
+		}
+	}
+
+	os.Remove(pathOf(tableName, def.Name))
+	file, err := dm.CreatePageFile(pathOf(tableName, def.Name), magicOf(def))
+	if err != nil {
+		return nil, err
 	}
+	file.BelongsTo(tableName, def.Name)
+
+	im := &IM{tableName: tableName, def: def, keyTypes: keyTypes, file: file}
 
-	b := btree.NewBtree()
-	if err := b.Marshal(tableName + "_" + index + SUFFIX_INDEX); err != nil {
-		return nil, errors.New("Create_Index")
+	if def.Using == USING_HASH {
+		err = im.createHash(nil)
+	} else {
+		// the root starts as an empty leaf.
+		_, err = im.alloc(nil, &node{leaf: true, next: dm.NO_PAGE})
+	}
+	if err != nil {
+		file.Remove()
+		return nil, err
 	}
-	return &IM{
-		tableName,
-		index,
-		b,
-	}, nil
+	if err := file.Flush(); err != nil {
+		file.Remove()
+		return nil, err
+	}
+	return im, nil
 }
 
-func GetIndexManager(tableName string, index string) (*IM, error) {
-	b, err := btree.Unmarshal(tableName + "_" + index + SUFFIX_INDEX)
+func GetIndexManager(tableName string, def dm.IndexDef, keyTypes []string) (*IM, error) {
+	file, err := dm.OpenPageFile(pathOf(tableName, def.Name), magicOf(def))
 	if err != nil {
-		return nil, errors.New("No such index")
+		return nil, err
+	}
+	file.BelongsTo(tableName, def.Name)
+
+	if file.NumOfPages() <= ROOT {
+		file.Close()
+		return nil, ErrIndexCorrupt
 	}
-	return &IM{
-		tableName,
-		index,
-		b,
-		},nil
+
+	im := &IM{tableName: tableName, def: def, keyTypes: keyTypes, file: file}
+	if def.Using == USING_HASH {
+		if _, err := im.readDir(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return im, nil
+}
+
+func magicOf(def dm.IndexDef) string {
+	if def.Using == USING_HASH {
+		return HASH_MAGIC
+	}
+	return INDEX_MAGIC
 }
 
-func (im IM) Boom() error {
-	return os.Remove(im.tableName + "_" + im.indexName + SUFFIX_INDEX)
+func (im *IM) Name() string {
+	return im.def.Name
 }
 
-//func (im IM) GetPositions(key uint16) []uint16 {
-//	var bts []byte
-//	binary.BigEndian.PutUint16(bts, key)
-//	im.TR.Search(bts)
-//}
+func (im *IM) Cols() []string {
+	return im.def.Cols
+}
+
+func (im *IM) Unique() bool {
+	return im.def.Unique
+}
 
-//func (im IM) InsertValue(pos uint16, val ) []uint16 {
-//	var bts []byte
-//	binary.BigEndian.PutUint16(bts, pos)
-//	im.TR.Search()
-//}
+// Constraint returns the kind of constraint the index backs, if any.
+func (im *IM) Constraint() string {
+	return im.def.Constraint
+}
+
+// Ordered reports whether the index can find keys in order, a hash index
+// can't.
+func (im *IM) Ordered() bool {
+	return im.def.Using != USING_HASH
+}
+
+// Flush writes the pages of an index built without a transaction back.
+func (im *IM) Flush() error {
+	return im.file.Flush()
+}
+
+// Insert adds the position of a record with the key, the values of all the
+// columns of the index.
+func (im *IM) Insert(txn *dm.Txn, key []interface{}, rid dm.RID) error {
+	bts, err := im.encode(key)
+	if err != nil {
+		return err
+	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if !im.Ordered() {
+		return im.hashInsert(txn, entry{key: bts, rid: rid})
+	}
+
+	up, err := im.insert(txn, ROOT, entry{key: bts, rid: rid})
+	if up == nil || err != nil {
+		return err
+	}
+	return im.growRoot(txn, up)
+}
+
+// Delete takes the position of a record with the key out.
+func (im *IM) Delete(txn *dm.Txn, key []interface{}, rid dm.RID) error {
+	bts, err := im.encode(key)
+	if err != nil {
+		return err
+	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if !im.Ordered() {
+		return im.hashRemove(txn, entry{key: bts, rid: rid})
+	}
+	return im.remove(txn, entry{key: bts, rid: rid})
+}
+
+// Lookup returns the positions of the records with the key, in the order of
+// the records in the table. Some of them may not be visible to a snapshot.
+func (im *IM) Lookup(key []interface{}) ([]dm.RID, error) {
+	b := &Bound{key, true}
+	return im.Range(b, b)
+}
+
+// Range returns the positions of the records with keys between lo and hi,
+// in the order of the keys. A key is compared with a bound by as many columns
+// as the bound has. A hash index only takes two equal bounds of whole keys.
+func (im *IM) Range(lo *Bound, hi *Bound) ([]dm.RID, error) {
+	var from, to []byte
+	var err error
+
+	if lo != nil {
+		if from, err = encodeKey(im.keyTypes, lo.Key); err != nil {
+			return nil, err
+		}
+		// a column starts with 0x00 or 0x01, so this is past every key
+		// starting with from.
+		if !lo.Inclusive {
+			from = append(from, 0xFF)
+		}
+	}
+	if hi != nil {
+		if to, err = encodeKey(im.keyTypes, hi.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+
+	if !im.Ordered() {
+		if lo == nil || hi == nil || !lo.Inclusive || !hi.Inclusive ||
+			len(lo.Key) != len(im.keyTypes) || !bytes.Equal(from, to) {
+			return nil, ErrNotOrdered
+		}
+		return im.hashLookup(from)
+	}
+
+	rids := make([]dm.RID, 0)
+	err = im.scan(entry{key: from}, func(e entry) bool {
+		if hi != nil {
+			if bytes.HasPrefix(e.key, to) {
+				if !hi.Inclusive {
+					return false
+				}
+			} else if bytes.Compare(e.key, to) > 0 {
+				return false
+			}
+		}
+		rids = append(rids, e.rid)
+		return true
+	})
+	return rids, err
+}
+
+// encode encodes a whole key.
+func (im *IM) encode(key []interface{}) ([]byte, error) {
+	if len(key) != len(im.keyTypes) {
+		return nil, ErrKeyType
+	}
+	return encodeKey(im.keyTypes, key)
+}
+
+func (im *IM) Boom() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	return im.file.Remove()
+}
@@ -0,0 +1,118 @@
+package im
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// 键编码：键按字节序比较时的先后与值的先后相同。
+// INT：int64翻转符号位后大端存放；DOUBLE：正数翻转符号位，负数各位取反；
+// STRING：0x00写成0x00 0xFF，以0x00 0x01结尾，所以前缀总排在前面。
+// 多列的键把各列依次接起来，每列前有一字节：NULL为0x00，其余为0x01，NULL排在最前。
+// 每列的编码都能自行断开，所以前几列的编码就是整个键的前缀。
+
+const MAX_SIZE_OF_KEY = 1000
+
+var (
+	ErrUnindexable  = errors.New("Only INT, DOUBLE and STRING columns can be indexed.")
+	ErrKeyType      = errors.New("The key does not match the type of the index.")
+	ErrKeyTooLarge  = errors.New("The key is too large for an index.")
+	ErrIndexCorrupt = errors.New("The index is corrupted.")
+)
+
+// Indexable reports whether columns of type tp can be indexed.
+func Indexable(tp string) bool {
+	return tp == "INT" || tp == "DOUBLE" || tp == "STRING"
+}
+
+// KeyWidth returns the most bytes a key on columns of the types tps, of the
+// lengths lens, can take: a STRING doubles its 0x00 bytes at worst.
+func KeyWidth(tps []string, lens []uint16) int {
+	width := 0
+	for i, tp := range tps {
+		width++
+		switch tp {
+		case "INT", "DOUBLE":
+			width += 8
+		case "STRING":
+			width += 2*int(lens[i]) + 2
+		}
+	}
+	return width
+}
+
+// encodeKey encodes the values of the leading columns of a key, the columns
+// being of the types tps.
+func encodeKey(tps []string, values []interface{}) ([]byte, error) {
+	if len(values) > len(tps) {
+		return nil, ErrKeyType
+	}
+
+	key := make([]byte, 0)
+	for i, value := range values {
+		if value == nil {
+			key = append(key, 0)
+			continue
+		}
+
+		var err error
+		if key, err = appendKey(append(key, 1), tps[i], value); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(key) > MAX_SIZE_OF_KEY {
+		return nil, ErrKeyTooLarge
+	}
+	return key, nil
+}
+
+// appendKey appends the encoding of value, of the column type tp, to key.
+func appendKey(key []byte, tp string, value interface{}) ([]byte, error) {
+	switch tp {
+	case "INT":
+		v, ok := value.(int64)
+		if !ok {
+			return nil, ErrKeyType
+		}
+		bts := make([]byte, 8)
+		binary.BigEndian.PutUint64(bts, uint64(v)^1<<63)
+		key = append(key, bts...)
+
+	case "DOUBLE":
+		v, ok := value.(float64)
+		if !ok {
+			return nil, ErrKeyType
+		}
+		if v == 0 { // -0 is 0.
+			v = 0
+		}
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits ^= 1 << 63
+		}
+		bts := make([]byte, 8)
+		binary.BigEndian.PutUint64(bts, bits)
+		key = append(key, bts...)
+
+	case "STRING":
+		v, ok := value.(string)
+		if !ok {
+			return nil, ErrKeyType
+		}
+		for i := 0; i < len(v); i++ {
+			key = append(key, v[i])
+			if v[i] == 0 {
+				key = append(key, 0xFF)
+			}
+		}
+		key = append(key, 0, 1)
+
+	default:
+		return nil, ErrUnindexable
+	}
+	return key, nil
+}
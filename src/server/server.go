@@ -1,13 +1,27 @@
 package main
 
 import (
+	"../dm"
 	"../sql/parser"
 	"../sql/planner"
+	"bufio"
+	"flag"
 	"log"
 	"net"
+	"strings"
 )
 
 func main() {
+	policy := flag.String("policy", dm.POLICY_LRU_K, "buffer pool replacement policy, LRU-K or CLOCK")
+	budget := flag.Int64("pool", dm.POOL_BUDGET, "bytes of pages the buffer pool may keep in memory")
+	flag.Parse()
+
+	if err := dm.SetReplacePolicy(*policy); err != nil {
+		log.Fatal(err)
+	}
+	if err := dm.SetPoolBudget(*budget); err != nil {
+		log.Fatal(err)
+	}
 
 	l, err := net.Listen("tcp", ":2000")
 	if err != nil {
@@ -21,29 +35,43 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		var buf []byte
-		n, err := conn.Read(buf)
-		if err != nil {
-			conn.Close()
+
+		go serve(conn)
+	}
+
+}
+
+// serve runs one session per connection. Every line is a statement and
+// every statement gets one line of result.
+func serve(conn net.Conn) {
+	defer conn.Close()
+
+	session := planner.NewSession()
+	defer session.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		sql := strings.TrimSpace(scanner.Text())
+		if sql == "" {
+			continue
 		}
 
-		sql := string(buf[:n])
-		result, err := Eval(sql)
+		result, err := Eval(session, sql)
 
 		if err != nil {
 			result = err.Error()
 		}
 
-		conn.Write([]byte(result))
-		conn.Close()
+		if _, err := conn.Write([]byte(result + "\n")); err != nil {
+			return
+		}
 	}
-
 }
 
-func Eval(sql string) (string, error) {
+func Eval(session *planner.Session, sql string) (string, error) {
 	appliable, err := parser.Parse(sql)
 	if err != nil {
 		return "Wrong SQL", parser.ParsedErr
 	}
-	return planner.Eval(appliable), nil
+	return session.Eval(appliable), nil
 }
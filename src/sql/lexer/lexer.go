@@ -20,6 +20,7 @@ type (
 	LexerImp struct {
 		Text                       string
 		Pos, Mark, TextLen, BufPos int
+		Start                      int // where the current token begins
 		Tken                       Token
 	}
 
@@ -82,9 +83,16 @@ var (
 		"FOREIGN":    "FOREIGN",
 		"REFERENCES": "REFERENCES",
 
+		"BEGIN":       "BEGIN",
+		"COMMIT":      "COMMIT",
+		"ROLLBACK":    "ROLLBACK",
+		"TRANSACTION": "TRANSACTION",
+
 		"EXPLAIN": "EXPLAIN",
 		"FOR":     "FOR",
 		"IF":      "IF",
+		"VERIFY":  "VERIFY",
+		"VACUUM":  "VACUUM",
 
 		"ALL":       "ALL",
 		"UNION":     "UNION",
@@ -98,6 +106,7 @@ var (
 		"OUTER":     "OUTER",
 		"JOIN":      "JOIN",
 		"ON":        "ON",
+		"USING":     "USING",
 		"SCHEMA":    "SCHEMA",
 		"CAST":      "CAST",
 		"COLUMN":    "COLUMN",
@@ -223,7 +232,7 @@ func (imp *LexerImp) ScanNumber() error {
 		pos++
 	}
 
-	if pos == textLen {
+	if pos == textLen || text[pos] != '.' {
 		imp.Pos = pos
 		parsedInt, err := strconv.ParseInt(text[(imp.Mark):(imp.Mark+bufPos)], 10, 64)
 
@@ -236,18 +245,12 @@ func (imp *LexerImp) ScanNumber() error {
 		return nil
 	}
 
-	isDouble := false
-
-	if text[pos] != '.' {
-		return LexerParseError{}
-	}
-
 	bufPos++
 	pos++
-	isDouble = true
+	isDouble := true
 
 	for {
-		if imp.Pos == textLen {
+		if pos == textLen {
 			break
 		}
 
@@ -298,7 +301,7 @@ func (imp *LexerImp) ScanIdentifier() error {
 			break
 		}
 
-		if !IsLetter(text[pos]) {
+		if !IsLetter(text[pos]) && !IsNumber(text[pos]) && text[pos] != '_' {
 			break
 		}
 
@@ -319,6 +322,15 @@ func (imp *LexerImp) ScanIdentifier() error {
 	return nil
 }
 
+// afterValue reports whether the last token ends a value.
+func (imp *LexerImp) afterValue() bool {
+	switch imp.Tken.TypeInfo {
+	case "IDENTIFIER", "INT", "DOUBLE", "STRING", "NULL", "RPAREN":
+		return true
+	}
+	return false
+}
+
 func (imp *LexerImp) Token() Token {
 	return imp.Tken
 }
@@ -333,16 +345,34 @@ func (imp *LexerImp) NextToken() error {
 	}
 
 	if imp.Pos == textLen {
+		imp.Start = textLen
 		imp.Tken = Token{"EOF", nil}
 		return nil
 	}
 
 	for ; IsWhiteSpace(text[imp.Pos]); imp.Pos += 1 {
 	}
+	imp.Start = imp.Pos
 
 	switch text[imp.Pos] {
-	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '-':
-		imp.ScanNumber()
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return imp.ScanNumber()
+	case '-':
+		// after a value it subtracts, as in a - 1, or else it may be a sign.
+		if !imp.afterValue() && imp.Pos+1 < textLen && IsNumber(text[imp.Pos+1]) {
+			return imp.ScanNumber()
+		}
+		imp.Pos += 1
+		imp.Tken = Token{"MINUS", "-"}
+	case '+':
+		imp.Pos += 1
+		imp.Tken = Token{"PLUS", "+"}
+	case '/':
+		imp.Pos += 1
+		imp.Tken = Token{"SLASH", "/"}
+	case '%':
+		imp.Pos += 1
+		imp.Tken = Token{"PERCENT", "%"}
 	case ',':
 		imp.Pos += 1
 		imp.Tken = Token{"COMMA", ","}
@@ -352,10 +382,13 @@ func (imp *LexerImp) NextToken() error {
 	case '"':
 		imp.Pos += 1
 
-		for imp.BufPos = imp.Pos; imp.Text[imp.BufPos] != '"' && !imp.IsEOF(); {
+		for imp.BufPos = imp.Pos; imp.BufPos < textLen && imp.Text[imp.BufPos] != '"'; {
 			imp.BufPos++
 		}
-		imp.Tken = Token{"", imp.Text[imp.Pos:imp.BufPos]}
+		if imp.BufPos == textLen {
+			return LexerParseError{}
+		}
+		imp.Tken = Token{"STRING", imp.Text[imp.Pos:imp.BufPos]}
 		imp.Pos = imp.BufPos + 1
 	case '(':
 		imp.Pos += 1
@@ -392,6 +425,33 @@ func (imp *LexerImp) NextToken() error {
 		} else {
 			imp.Tken = Token{"EQ", "="}
 		}
+	case '<':
+		imp.Pos += 1
+		if imp.Pos < textLen && text[imp.Pos] == '=' {
+			imp.Pos += 1
+			imp.Tken = Token{"LE", "<="}
+		} else if imp.Pos < textLen && text[imp.Pos] == '>' {
+			imp.Pos += 1
+			imp.Tken = Token{"NE", "!="}
+		} else {
+			imp.Tken = Token{"LT", "<"}
+		}
+	case '!':
+		imp.Pos += 1
+		if imp.Pos < textLen && text[imp.Pos] == '=' {
+			imp.Pos += 1
+			imp.Tken = Token{"NE", "!="}
+		} else {
+			return LexerInitError{}
+		}
+	case '>':
+		imp.Pos += 1
+		if imp.Pos < textLen && text[imp.Pos] == '=' {
+			imp.Pos += 1
+			imp.Tken = Token{"GE", ">="}
+		} else {
+			imp.Tken = Token{"GT", ">"}
+		}
 	default:
 		if IsLetter(text[imp.Pos]) {
 			imp.ScanIdentifier()
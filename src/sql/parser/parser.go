@@ -4,6 +4,7 @@ import (
 	. "../lexer"
 	. "./statements"
 	"errors"
+	"strings"
 )
 
 var (
@@ -17,15 +18,18 @@ type (
 )
 
 func Parse(s string) (AppliableStatement, error) {
+	return newParser(s).ParseLine()
+}
+
+func newParser(s string) *Parser {
 	parser := &Parser{
 		&LexerImp{
-			s,
-			0, 0, 0, 0,
-			Token{"BEGIN", nil},
+			Text: s,
+			Tken: Token{"BEGIN", nil},
 		},
 	}
 	parser.Init()
-	return parser.ParseLine()
+	return parser
 }
 
 func (parser *Parser) Init() error {
@@ -41,6 +45,12 @@ func (parser *Parser) ParseLine() (AppliableStatement, error) {
 	}
 
 	if parser.matchSimple(tok, "CREATE") {
+		if next := parser.Lexer.Token(); next.TypeInfo == "UNIQUE" || next.TypeInfo == "INDEX" {
+			return parser.ParseCreateIndex()
+		}
+		if parser.matchSimple(parser.Lexer.Token(), "TABLE") {
+			return parser.ParseCreateAs()
+		}
 		return parser.ParseCreate()
 	}
 
@@ -57,9 +67,32 @@ func (parser *Parser) ParseLine() (AppliableStatement, error) {
 	}
 
 	if parser.matchSimple(tok, "DROP") {
+		if parser.matchSimple(parser.Lexer.Token(), "INDEX") {
+			return parser.ParseDropIndex()
+		}
 		return parser.ParseDrop()
 	}
 
+	if parser.matchSimple(tok, "VERIFY") {
+		return parser.ParseVerify()
+	}
+
+	if parser.matchSimple(tok, "VACUUM") {
+		return parser.ParseVacuum()
+	}
+
+	if parser.matchSimple(tok, "BEGIN") {
+		return BeginStatement{}, parser.parseTransactionEnd()
+	}
+
+	if parser.matchSimple(tok, "COMMIT") {
+		return CommitStatement{}, parser.parseTransactionEnd()
+	}
+
+	if parser.matchSimple(tok, "ROLLBACK") {
+		return RollbackStatement{}, parser.parseTransactionEnd()
+	}
+
 	if parser.matchSemi(tok) {
 		return nil, nil
 	}
@@ -85,6 +118,161 @@ func (parser *Parser) ParseDrop() (DropStatement, error) {
 	return dropStat, nil
 }
 
+// ParseCreateAs parses t AS SELECT ... after CREATE TABLE.
+func (parser *Parser) ParseCreateAs() (CreateStatement, error) {
+	createStat := CreateStatement{}
+
+	tableName := parser.Lexer.Token()
+	if !parser.matchType(tableName, "IDENTIFIER") {
+		return createStat, ParsedErr
+	}
+	createStat.TableName = tableName.Value.(string)
+
+	if !parser.matchSimple(parser.Lexer.Token(), "AS") ||
+		!parser.matchSimple(parser.Lexer.Token(), "SELECT") {
+		return createStat, ParsedErr
+	}
+
+	sel, err := parser.ParseSelect()
+	if err != nil {
+		return createStat, ParsedErr
+	}
+	createStat.As = &sel
+
+	return createStat, nil
+}
+
+func (parser *Parser) ParseCreateIndex() (CreateIndexStatement, error) {
+	createStat := CreateIndexStatement{}
+
+	createStat.Unique = parser.matchSimple(parser.Lexer.Token(), "UNIQUE")
+	if !parser.matchSimple(parser.Lexer.Token(), "INDEX") {
+		return CreateIndexStatement{}, ParsedErr
+	}
+
+	indexName := parser.Lexer.Token()
+	if !parser.matchType(indexName, "IDENTIFIER") {
+		return CreateIndexStatement{}, ParsedErr
+	}
+	createStat.IndexName = indexName.Value.(string)
+
+	if !parser.matchSimple(parser.Lexer.Token(), "ON") {
+		return CreateIndexStatement{}, ParsedErr
+	}
+
+	tableName := parser.Lexer.Token()
+	if !parser.matchType(tableName, "IDENTIFIER") {
+		return CreateIndexStatement{}, ParsedErr
+	}
+	createStat.TableName = tableName.Value.(string)
+
+	if !parser.match(parser.Lexer.Token(), "LPAREN", "(") {
+		return CreateIndexStatement{}, ParsedErr
+	}
+
+	for {
+		col := parser.Lexer.Token()
+		if !parser.matchType(col, "IDENTIFIER") {
+			return CreateIndexStatement{}, ParsedErr
+		}
+		createStat.Cols = append(createStat.Cols, col.Value.(string))
+
+		if !parser.match(parser.Lexer.Token(), "COMMA", ",") {
+			break
+		}
+	}
+
+	if !parser.match(parser.Lexer.Token(), "RPAREN", ")") {
+		return CreateIndexStatement{}, ParsedErr
+	}
+
+	if parser.matchSimple(parser.Lexer.Token(), "USING") {
+		using := parser.Lexer.Token()
+		if !parser.matchType(using, "IDENTIFIER") {
+			return CreateIndexStatement{}, ParsedErr
+		}
+		createStat.Using = using.Value.(string)
+	}
+
+	if !parser.matchSemi(parser.Lexer.Token()) {
+		return CreateIndexStatement{}, ParsedErr
+	}
+
+	return createStat, nil
+}
+
+func (parser *Parser) ParseDropIndex() (DropIndexStatement, error) {
+	dropStat := DropIndexStatement{}
+
+	indexName := parser.Lexer.Token()
+	if !parser.matchType(indexName, "IDENTIFIER") {
+		return DropIndexStatement{}, ParsedErr
+	}
+	dropStat.IndexName = indexName.Value.(string)
+
+	if parser.matchSimple(parser.Lexer.Token(), "ON") {
+		tableName := parser.Lexer.Token()
+		if !parser.matchType(tableName, "IDENTIFIER") {
+			return DropIndexStatement{}, ParsedErr
+		}
+		dropStat.TableName = tableName.Value.(string)
+	}
+
+	if !parser.matchSemi(parser.Lexer.Token()) {
+		return DropIndexStatement{}, ParsedErr
+	}
+
+	return dropStat, nil
+}
+
+func (parser *Parser) ParseVerify() (VerifyStatement, error) {
+	verifyStat := VerifyStatement{}
+
+	if !parser.matchSimple(parser.Lexer.Token(), "TABLE") {
+		return VerifyStatement{}, ParsedErr
+	}
+
+	tableName := parser.Lexer.Token()
+	if !parser.matchType(tableName, "IDENTIFIER") {
+		return VerifyStatement{}, ParsedErr
+	}
+
+	verifyStat.TableName = tableName.Value.(string)
+
+	if !parser.matchSemi(parser.Lexer.Token()) {
+		return VerifyStatement{}, ParsedErr
+	}
+
+	return verifyStat, nil
+}
+
+func (parser *Parser) ParseVacuum() (VacuumStatement, error) {
+	vacuumStat := VacuumStatement{}
+
+	tableName := parser.Lexer.Token()
+	if !parser.matchType(tableName, "IDENTIFIER") {
+		return VacuumStatement{}, ParsedErr
+	}
+
+	vacuumStat.TableName = tableName.Value.(string)
+
+	if !parser.matchSemi(parser.Lexer.Token()) {
+		return VacuumStatement{}, ParsedErr
+	}
+
+	return vacuumStat, nil
+}
+
+// parseTransactionEnd accepts the optional TRANSACTION and the closing semicolon.
+func (parser *Parser) parseTransactionEnd() error {
+	parser.matchSimple(parser.Lexer.Token(), "TRANSACTION")
+
+	if !parser.matchSemi(parser.Lexer.Token()) {
+		return ParsedErr
+	}
+	return nil
+}
+
 func (parser *Parser) ParseSelect() (SelectStatement, error) {
 	selectStat := SelectStatement{}
 
@@ -116,10 +304,22 @@ func (parser *Parser) ParseSelect() (SelectStatement, error) {
 	}
 	selectStat.From = from
 
-	if where, err := parser.ParseWhere(); err == nil {
+	if parser.Lexer.Token().TypeInfo == "WHERE" {
+		where, err := parser.ParseWhere()
+		if err != nil {
+			return selectStat, ParsedErr
+		}
 		selectStat.Where = where
 	}
 
+	if parser.matchSimple(parser.Lexer.Token(), "ORDER") {
+		orderBy, err := parser.ParseOrderBy()
+		if err != nil {
+			return selectStat, ParsedErr
+		}
+		selectStat.OrderBy = orderBy
+	}
+
 	if !parser.matchSemi(parser.Lexer.Token()) {
 		return selectStat, ParsedErr
 	}
@@ -128,56 +328,146 @@ func (parser *Parser) ParseSelect() (SelectStatement, error) {
 	return selectStat, nil
 }
 
+// ParseOrderBy parses BY a [ASC|DESC], b ..., after ORDER. ASC is the default.
+func (parser *Parser) ParseOrderBy() ([]OrderByStatement, error) {
+	if !parser.matchSimple(parser.Lexer.Token(), "BY") {
+		return nil, ParsedErr
+	}
+
+	orderBy := make([]OrderByStatement, 0)
+	for {
+		field := parser.Lexer.Token()
+		if !parser.matchType(field, "IDENTIFIER") {
+			return nil, ParsedErr
+		}
+
+		order := parser.Lexer.Token()
+		if !parser.matchSimple(order, "ASC") && !parser.matchSimple(order, "DESC") {
+			order = Token{TypeInfo: "ASC", Value: "ASC"}
+		}
+
+		orderBy = append(orderBy, OrderByStatement{Field: Field{Token: field}, Order: Order{order}})
+
+		if !parser.match(parser.Lexer.Token(), "COMMA", ",") {
+			break
+		}
+	}
+	return orderBy, nil
+}
+
+// ParseUpdate parses t SET a = Expr, b = Expr ... (WHERE ...) after UPDATE.
 func (parser *Parser) ParseUpdate() (UpdateStatement, error) {
 	upStat := UpdateStatement{}
 
-	if !parser.match(parser.Lexer.Token(), "LPAREN", "(") {
+	tableName := parser.Lexer.Token()
+	if !parser.matchType(tableName, "IDENTIFIER") {
 		return upStat, ParsedErr
 	}
+	upStat.TableName = tableName.Value.(string)
 
-	col := parser.Lexer.Token()
-	if !parser.matchType(col, "IDENTIFIER") {
+	if !parser.matchSimple(parser.Lexer.Token(), "SET") {
 		return upStat, ParsedErr
 	}
-	upStat.Col = col.Value.(string)
 
-	if !parser.match(parser.Lexer.Token(), "EQ", "=") {
-		return upStat, ParsedErr
+	for {
+		col := parser.Lexer.Token()
+		if !parser.matchType(col, "IDENTIFIER") {
+			return upStat, ParsedErr
+		}
+
+		if !parser.match(parser.Lexer.Token(), "EQ", "=") {
+			return upStat, ParsedErr
+		}
+
+		value, err := parser.ParseExpr()
+		if err != nil {
+			return upStat, ParsedErr
+		}
+		upStat.Sets = append(upStat.Sets, Assignment{col.Value.(string), value})
+
+		if !parser.match(parser.Lexer.Token(), "COMMA", ",") {
+			break
+		}
 	}
 
-	value := parser.Lexer.Token()
-	if parser.matchType(value, "STRING") ||
-		parser.matchType(value, "INT") ||
-		parser.matchType(value, "DOUBLE") {
-		upStat.Value = value
-	} else {
-		return upStat, ParsedErr
+	if parser.Lexer.Token().TypeInfo == "WHERE" {
+		where, err := parser.ParseWhere()
+		if err != nil {
+			return upStat, ParsedErr
+		}
+		upStat.Where = &where
 	}
 
-	if !parser.match(parser.Lexer.Token(), "RPAREN", ")") {
+	if !parser.matchSemi(parser.Lexer.Token()) {
 		return upStat, ParsedErr
 	}
+	return upStat, nil
+}
 
-	if !parser.matchSimple(parser.Lexer.Token(), "FROM") {
-		return upStat, ParsedErr
+// ParseArith parses an expression giving a value, * / % before + -.
+func (parser *Parser) ParseArith() (Expr, error) {
+	l, err := parser.parseTerm()
+	if err != nil {
+		return nil, ParsedErr
 	}
 
-	tableName := parser.Lexer.Token()
-	if !parser.matchType(tableName, "IDENTIFIER") {
-		return upStat, ParsedErr
+	for {
+		op := parser.Lexer.Token()
+		if op.TypeInfo != "PLUS" && op.TypeInfo != "MINUS" {
+			return l, nil
+		}
+		parser.Lexer.NextToken()
+
+		r, err := parser.parseTerm()
+		if err != nil {
+			return nil, ParsedErr
+		}
+		l = Binary{Operator{op}, l, r}
 	}
-	upStat.TableName = tableName.Value.(string)
+}
 
-	where, err := parser.ParseWhere()
+func (parser *Parser) parseTerm() (Expr, error) {
+	l, err := parser.parseOperand()
 	if err != nil {
-		return upStat, ParsedErr
+		return nil, ParsedErr
 	}
-	upStat.Where = &where
 
-	if !parser.matchSemi(parser.Lexer.Token()) {
-		return upStat, ParsedErr
+	for {
+		op := parser.Lexer.Token()
+		if op.TypeInfo != "STAR" && op.TypeInfo != "SLASH" && op.TypeInfo != "PERCENT" {
+			return l, nil
+		}
+		parser.Lexer.NextToken()
+
+		r, err := parser.parseOperand()
+		if err != nil {
+			return nil, ParsedErr
+		}
+		l = Binary{Operator{op}, l, r}
 	}
-	return upStat, nil
+}
+
+func (parser *Parser) parseOperand() (Expr, error) {
+	tok := parser.Lexer.Token()
+
+	switch {
+	case parser.match(tok, "LPAREN", "("):
+		x, err := parser.ParseExpr()
+		if err != nil || !parser.match(parser.Lexer.Token(), "RPAREN", ")") {
+			return nil, ParsedErr
+		}
+		return x, nil
+	case parser.match(tok, "MINUS", "-"):
+		x, err := parser.parseOperand()
+		if err != nil {
+			return nil, ParsedErr
+		}
+		return Unary{Operator{tok}, x}, nil
+	case isLiteral(tok) || tok.TypeInfo == "IDENTIFIER":
+		parser.Lexer.NextToken()
+		return Value{tok}, nil
+	}
+	return nil, ParsedErr
 }
 
 func (parser *Parser) ParseDelete() (DeleteStatement, error) {
@@ -194,8 +484,11 @@ func (parser *Parser) ParseDelete() (DeleteStatement, error) {
 	}
 	delStat.TableName = tableName.Value.(string)
 
-	where, err := parser.ParseWhere()
-	if err == nil {
+	if parser.Lexer.Token().TypeInfo == "WHERE" {
+		where, err := parser.ParseWhere()
+		if err != nil {
+			return delStat, ParsedErr
+		}
 		delStat.Where = &where
 	}
 
@@ -205,15 +498,32 @@ func (parser *Parser) ParseDelete() (DeleteStatement, error) {
 	return delStat, nil
 }
 
+// ParseFields parses the fields of a SELECT, each an Expr with an optional
+// AS name.
 func (parser *Parser) ParseFields() (Fields, error) {
 	fields := make([]Field, 0)
 	for {
-		field := parser.Lexer.Token()
-		if !IsField(field) {
+		first := parser.Lexer.Token()
+		expr, err := parser.ParseExpr()
+		if err != nil {
 			return Fields{}, ParsedErr
 		}
 
-		fields = append(fields, Field{field})
+		field := Field{Expr: expr}
+		if v, ok := expr.(Value); ok && v.Value.(Token) == first && first.TypeInfo == "IDENTIFIER" {
+			field.Token = first
+		}
+
+		if parser.Lexer.Token().TypeInfo == "AS" {
+			parser.Lexer.NextToken()
+			as := parser.Lexer.Token()
+			if !parser.matchType(as, "IDENTIFIER") {
+				return Fields{}, ParsedErr
+			}
+			field.As = as.Value.(string)
+		}
+
+		fields = append(fields, field)
 
 		if !parser.matchValue(parser.Lexer.Token(), ",") {
 			break
@@ -293,6 +603,23 @@ func (parser *Parser) ParseCreate() (CreateStatement, error) {
 	}
 
 	for {
+		// e.g. CREATE t { a INT, b INT, PRIMARY KEY (a, b);
+		if parser.startsConstraint(parser.Lexer.Token()) {
+			constraint, err := parser.ParseConstraint(true)
+			if err != nil {
+				return createStat, ParsedErr
+			}
+			createStat.Constraints = append(createStat.Constraints, constraint)
+
+			comma := parser.Lexer.Token()
+			if parser.match(comma, "COMMA", ",") {
+				continue
+			} else if comma.TypeInfo == "SEMI" && comma.Value == ";" || comma.Value == "Index" {
+				break
+			}
+			return createStat, ParsedErr
+		}
+
 		col := parser.Lexer.Token()
 		if !parser.matchType(col, "IDENTIFIER") {
 			return createStat, ParsedErr
@@ -302,24 +629,29 @@ func (parser *Parser) ParseCreate() (CreateStatement, error) {
 		t := parser.Lexer.Token()
 		if (t.Value != "STRING" &&
 			t.Value != "INT" &&
-			t.Value != "DOUBLE") ||
+			t.Value != "DOUBLE" &&
+			t.Value != "TEXT" &&
+			t.Value != "BLOB") ||
 			!parser.matchType(t, "IDENTIFIER") {
 			return createStat, ParsedErr
 		}
 
 		if t.Value == "STRING" {
 			num := parser.Lexer.Token()
-			if num.TypeInfo != "INT" || num.Value.(int) <= 0 || num.Value.(int) > 1024 {
+			if num.TypeInfo != "INT" || num.Value.(int64) <= 0 || num.Value.(int64) > 1024 {
 				return createStat, ParsedErr
 			}
 
-			createStat.Lens = append(createStat.Lens, num.Value.(uint16))
+			createStat.Lens = append(createStat.Lens, uint16(num.Value.(int64)))
 			parser.Lexer.NextToken()
 		} else {
-			if t.Value == "INT" {
+			switch t.Value {
+			case "INT":
 				createStat.Lens = append(createStat.Lens, 2)
-			} else {
-				createStat.Lens = append(createStat.Lens, 4)
+			case "DOUBLE":
+				createStat.Lens = append(createStat.Lens, 8)
+			default: // TEXT and BLOB have no limit.
+				createStat.Lens = append(createStat.Lens, 0)
 			}
 		}
 
@@ -333,29 +665,59 @@ func (parser *Parser) ParseCreate() (CreateStatement, error) {
 			createStat.Nullable = append(createStat.Nullable, false)
 		}
 
+		// e.g. CREATE t { a INT PRIMARY KEY, b STRING 8 UNIQUE DEFAULT "x";
+		def := ""
+		for {
+			if parser.Lexer.Token().TypeInfo == "DEFAULT" {
+				value, err := parser.parseDefault()
+				if err != nil || def != "" {
+					return createStat, ParsedErr
+				}
+				def = value
+				continue
+			}
+
+			if !parser.startsConstraint(parser.Lexer.Token()) {
+				break
+			}
+			constraint, err := parser.ParseConstraint(false)
+			if err != nil {
+				return createStat, ParsedErr
+			}
+			constraint.Cols = []string{col.Value.(string)}
+			createStat.Constraints = append(createStat.Constraints, constraint)
+		}
+		createStat.Defaults = append(createStat.Defaults, def)
+
 		comma := parser.Lexer.Token()
 		if parser.match(comma, "COMMA", ",") {
 			continue
 		} else if comma.TypeInfo == "SEMI" && comma.Value == ";" {
 			break
+		} else if comma.Value == "Index" {
+			break
 		}
 		return createStat, ParsedErr
 
 	}
 
+	// e.g. CREATE t { a INT, b STRING 8 Index a, b;
 	index := parser.Lexer.Token()
 	if index.Value == "Index" {
 		parser.Lexer.NextToken()
 
 		for {
 			indexCol := parser.Lexer.Token()
-			if indexCol.TypeInfo != "IDENTIFIER" &&
-				indexCol.TypeInfo != "SEMI" {
+			if !parser.matchType(indexCol, "IDENTIFIER") {
 				return createStat, ParsedErr
 			}
 
 			createStat.Indexes = append(createStat.Indexes,
 				indexCol.Value.(string))
+
+			if !parser.match(parser.Lexer.Token(), "COMMA", ",") {
+				break
+			}
 		}
 	}
 
@@ -366,6 +728,203 @@ func (parser *Parser) ParseCreate() (CreateStatement, error) {
 	return createStat, nil
 }
 
+func (parser *Parser) startsConstraint(token Token) bool {
+	return token.TypeInfo == "CONSTRAINT" ||
+		token.TypeInfo == "PRIMARY" ||
+		token.TypeInfo == "UNIQUE" ||
+		token.TypeInfo == "FOREIGN" ||
+		token.TypeInfo == "REFERENCES" ||
+		token.TypeInfo == "CHECK"
+}
+
+// ParseConstraint parses a PRIMARY KEY, UNIQUE, FOREIGN KEY or CHECK
+// constraint, with the columns in parentheses if withCols. A CHECK has none.
+func (parser *Parser) ParseConstraint(withCols bool) (Constraint, error) {
+	constraint := Constraint{}
+
+	if parser.matchSimple(parser.Lexer.Token(), "CONSTRAINT") {
+		name := parser.Lexer.Token()
+		if !parser.matchType(name, "IDENTIFIER") {
+			return Constraint{}, ParsedErr
+		}
+		constraint.Name = name.Value.(string)
+	}
+
+	switch {
+	case parser.matchSimple(parser.Lexer.Token(), "PRIMARY"):
+		if !parser.matchSimple(parser.Lexer.Token(), "KEY") {
+			return Constraint{}, ParsedErr
+		}
+		constraint.Kind = PRIMARY_KEY
+	case parser.matchSimple(parser.Lexer.Token(), "UNIQUE"):
+		constraint.Kind = UNIQUE
+	case withCols && parser.matchSimple(parser.Lexer.Token(), "FOREIGN"):
+		if !parser.matchSimple(parser.Lexer.Token(), "KEY") {
+			return Constraint{}, ParsedErr
+		}
+		constraint.Kind = FOREIGN_KEY
+	case !withCols && parser.Lexer.Token().TypeInfo == "REFERENCES":
+		constraint.Kind = FOREIGN_KEY
+	case parser.matchSimple(parser.Lexer.Token(), "CHECK"):
+		check, err := parser.parseCheck()
+		if err != nil {
+			return Constraint{}, ParsedErr
+		}
+		constraint.Kind = CHECK
+		constraint.Check = check
+		return constraint, nil
+	default:
+		return Constraint{}, ParsedErr
+	}
+
+	if withCols {
+		cols, err := parser.parseCols()
+		if err != nil {
+			return Constraint{}, ParsedErr
+		}
+		constraint.Cols = cols
+	}
+
+	if constraint.Kind == FOREIGN_KEY {
+		if err := parser.parseReferences(&constraint); err != nil {
+			return Constraint{}, ParsedErr
+		}
+	}
+	return constraint, nil
+}
+
+// parseCheck parses ( Expr ) and returns the text of the Expr.
+func (parser *Parser) parseCheck() (string, error) {
+	if parser.Lexer.Token().TypeInfo != "LPAREN" {
+		return "", ParsedErr
+	}
+	from := parser.Lexer.Pos
+	parser.Lexer.NextToken()
+
+	if _, err := parser.ParseExpr(); err != nil {
+		return "", ParsedErr
+	}
+
+	if parser.Lexer.Token().TypeInfo != "RPAREN" {
+		return "", ParsedErr
+	}
+	text := parser.Lexer.Text[from : parser.Lexer.Pos-1]
+	parser.Lexer.NextToken()
+
+	return strings.TrimSpace(text), nil
+}
+
+// parseDefault parses DEFAULT Expr and returns the text of the Expr.
+func (parser *Parser) parseDefault() (string, error) {
+	from := parser.Lexer.Pos
+	parser.Lexer.NextToken()
+
+	if _, err := parser.ParseExpr(); err != nil {
+		return "", ParsedErr
+	}
+	text := parser.Lexer.Text[from:parser.Lexer.Start]
+
+	return strings.TrimSpace(text), nil
+}
+
+func isLiteral(token Token) bool {
+	return token.TypeInfo == "INT" ||
+		token.TypeInfo == "DOUBLE" ||
+		token.TypeInfo == "STRING" ||
+		token.TypeInfo == "NULL"
+}
+
+// ParseCheck parses the text of a CHECK, as kept with the table.
+func ParseCheck(s string) (Expr, error) {
+	return parseText(s)
+}
+
+// ParseDefault parses the text of a DEFAULT, as kept with the table.
+func ParseDefault(s string) (Expr, error) {
+	return parseText(s)
+}
+
+// parseText parses an Expr which is all of s.
+func parseText(s string) (Expr, error) {
+	parser := newParser(s)
+
+	expr, err := parser.ParseExpr()
+	if err != nil || parser.Lexer.Token().TypeInfo != "EOF" {
+		return nil, ParsedErr
+	}
+	return expr, nil
+}
+
+// parseReferences parses REFERENCES p [(cols)] [ON DELETE action].
+func (parser *Parser) parseReferences(constraint *Constraint) error {
+	if !parser.matchSimple(parser.Lexer.Token(), "REFERENCES") {
+		return ParsedErr
+	}
+
+	parent := parser.Lexer.Token()
+	if !parser.matchType(parent, "IDENTIFIER") {
+		return ParsedErr
+	}
+	constraint.Parent = parent.Value.(string)
+
+	if parser.Lexer.Token().TypeInfo == "LPAREN" {
+		cols, err := parser.parseCols()
+		if err != nil {
+			return ParsedErr
+		}
+		constraint.ParentCols = cols
+	}
+
+	if !parser.matchSimple(parser.Lexer.Token(), "ON") {
+		return nil
+	}
+	if !parser.matchSimple(parser.Lexer.Token(), "DELETE") {
+		return ParsedErr
+	}
+
+	action := parser.Lexer.Token()
+	switch {
+	case parser.matchSimple(action, "SET"):
+		if !parser.matchSimple(parser.Lexer.Token(), "NULL") {
+			return ParsedErr
+		}
+		constraint.OnDelete = "SET NULL"
+	case action.Value == "CASCADE" || action.Value == "RESTRICT":
+		parser.Lexer.NextToken()
+		constraint.OnDelete = action.Value.(string)
+	default:
+		return ParsedErr
+	}
+	return nil
+}
+
+// parseCols parses ( a, b ).
+func (parser *Parser) parseCols() ([]string, error) {
+	if !parser.match(parser.Lexer.Token(), "LPAREN", "(") {
+		return nil, ParsedErr
+	}
+
+	cols := make([]string, 0)
+	for {
+		col := parser.Lexer.Token()
+		if !parser.matchType(col, "IDENTIFIER") {
+			return nil, ParsedErr
+		}
+		cols = append(cols, col.Value.(string))
+
+		if !parser.match(parser.Lexer.Token(), "COMMA", ",") {
+			break
+		}
+	}
+
+	if !parser.match(parser.Lexer.Token(), "RPAREN", ")") {
+		return nil, ParsedErr
+	}
+	return cols, nil
+}
+
+// ParseInsert parses INTO t ((a, b)) VALUES (v, v), (v, v) ... or
+// INTO t ((a, b)) SELECT ... after INSERT.
 func (parser *Parser) ParseInsert() (InsertStatement, error) {
 	insertStat := InsertStatement{}
 	if !parser.matchSimple(parser.Lexer.Token(), "INTO") {
@@ -378,27 +937,37 @@ func (parser *Parser) ParseInsert() (InsertStatement, error) {
 
 	insertStat.TableName = tableName.Value.(string)
 
-	if !parser.matchSimple(parser.Lexer.Token(), "VALUES") {
-		return insertStat, ParsedErr
+	if parser.Lexer.Token().TypeInfo == "LPAREN" {
+		cols, err := parser.parseCols()
+		if err != nil {
+			return insertStat, ParsedErr
+		}
+		insertStat.Cols = cols
 	}
 
-	if !parser.match(parser.Lexer.Token(), "LPAREN", "(") {
+	if parser.matchSimple(parser.Lexer.Token(), "SELECT") {
+		sel, err := parser.ParseSelect()
+		if err != nil {
+			return insertStat, ParsedErr
+		}
+		insertStat.Select = &sel
+		return insertStat, nil
+	}
+
+	if !parser.matchSimple(parser.Lexer.Token(), "VALUES") {
 		return insertStat, ParsedErr
 	}
 
 	for {
-		v := parser.Lexer.Token()
-		if parser.match(v, "RPAREN", ")") {
-			break
-		}
-		if v.TypeInfo != "INT" && v.TypeInfo != "DOUBLE" &&
-			v.TypeInfo != "STRING" && v.TypeInfo != "NULL" {
+		row, err := parser.parseRow()
+		if err != nil {
 			return insertStat, ParsedErr
 		}
+		insertStat.Rows = append(insertStat.Rows, row)
 
-		insertStat.Values = append(insertStat.Values, v)
-
-		parser.Lexer.NextToken()
+		if !parser.match(parser.Lexer.Token(), "COMMA", ",") {
+			break
+		}
 	}
 
 	if !parser.matchSemi(parser.Lexer.Token()) {
@@ -407,88 +976,114 @@ func (parser *Parser) ParseInsert() (InsertStatement, error) {
 	return insertStat, nil
 }
 
-func (parser *Parser) ParseExpr() (Expr, error) {
-	expr := Expr{}
+// parseRow parses ( v, v ) of VALUES, a value may be DEFAULT.
+func (parser *Parser) parseRow() ([]interface{}, error) {
+	if !parser.match(parser.Lexer.Token(), "LPAREN", "(") {
+		return nil, ParsedErr
+	}
 
+	row := make([]interface{}, 0)
 	for {
-		condition, err := parser.ParseCondition()
-		if err != nil {
-			break
+		v := parser.Lexer.Token()
+		if !isLiteral(v) && v.TypeInfo != "DEFAULT" {
+			return nil, ParsedErr
 		}
-		expr.Conditions = append(expr.Conditions, condition)
+		row = append(row, v)
+		parser.Lexer.NextToken()
 
-		inter := parser.Lexer.Token()
-		if inter.TypeInfo != "AND" &&
-			inter.TypeInfo != "OR" &&
-			inter.TypeInfo != "NOT" {
+		if !parser.match(parser.Lexer.Token(), "COMMA", ",") {
 			break
 		}
-
-		expr.InterOP = append(expr.InterOP,
-			LogicOperation{inter.Value.(string)})
-
-		parser.Lexer.NextToken()
 	}
 
-	if !IsExpr(expr) {
-		return Expr{}, ParsedErr
+	if !parser.match(parser.Lexer.Token(), "RPAREN", ")") {
+		return nil, ParsedErr
 	}
-
-	return expr, nil
+	return row, nil
 }
-func (parser *Parser) ParseCondition() (Condition, error) {
-	condition := Condition{}
 
-	lval, err := parser.ParseValue()
+// ParseExpr parses an expression: OR after AND after NOT after comparisons
+// after the arithmetic, with ( ) around any part of it.
+func (parser *Parser) ParseExpr() (Expr, error) {
+	l, err := parser.parseAnd()
 	if err != nil {
-		return condition, ParsedErr
+		return nil, ParsedErr
 	}
-	condition.LVal = lval
 
-	lop, err := parser.ParseLogicOperation()
-	if err != nil {
-		return condition, ParsedErr
+	for {
+		op := parser.Lexer.Token()
+		if op.TypeInfo != "OR" {
+			return l, nil
+		}
+		parser.Lexer.NextToken()
+
+		r, err := parser.parseAnd()
+		if err != nil {
+			return nil, ParsedErr
+		}
+		l = Binary{Operator{op}, l, r}
 	}
-	condition.Op = lop
+}
 
-	rval, err := parser.ParseValue()
+func (parser *Parser) parseAnd() (Expr, error) {
+	l, err := parser.parseNot()
 	if err != nil {
-		return condition, ParsedErr
+		return nil, ParsedErr
 	}
-	condition.RVal = rval
 
-	if !IsCondition(condition) {
-		return condition, ParsedErr
-	}
+	for {
+		op := parser.Lexer.Token()
+		if op.TypeInfo != "AND" && op.TypeInfo != "NOT" {
+			return l, nil
+		}
+		parser.Lexer.NextToken()
 
-	return condition, nil
+		r, err := parser.parseNot()
+		if err != nil {
+			return nil, ParsedErr
+		}
+		if op.TypeInfo == "NOT" {
+			r = Unary{Operator{op}, r}
+		}
+		l = Binary{Operator{Token{"AND", "AND"}}, l, r}
+	}
 }
-func (parser *Parser) ParseLogicOperation() (LogicOperation, error) {
+
+func (parser *Parser) parseNot() (Expr, error) {
 	op := parser.Lexer.Token()
-	if op.Value != ">" &&
-		op.Value != "<" &&
-		op.Value != ">=" &&
-		op.Value != "<=" &&
-		op.Value != "==" {
-		return LogicOperation{}, ParsedErr
+	if op.TypeInfo != "NOT" {
+		return parser.parseComparison()
 	}
-
 	parser.Lexer.NextToken()
-	return LogicOperation{op.Value.(string)}, nil
+
+	x, err := parser.parseNot()
+	if err != nil {
+		return nil, ParsedErr
+	}
+	return Unary{Operator{op}, x}, nil
 }
 
-func (parser *Parser) ParseValue() (Value, error) {
-	op := parser.Lexer.Token()
-	if op.TypeInfo != "INT" &&
-		op.TypeInfo != "DOUBLE" &&
-		op.TypeInfo != "STRING" &&
-		op.TypeInfo != "IDENTIFIER" {
-		return Value{}, ParsedErr
+func (parser *Parser) parseComparison() (Expr, error) {
+	l, err := parser.ParseArith()
+	if err != nil {
+		return nil, ParsedErr
 	}
 
+	op := parser.Lexer.Token()
+	switch op.TypeInfo {
+	case "EQ", "EQEQ":
+		op = Token{"EQEQ", "=="}
+	case "NE", "LT", "LE", "GT", "GE":
+	default:
+		return l, nil
+	}
 	parser.Lexer.NextToken()
 
-	return Value{op.Value}, nil
+	r, err := parser.ParseArith()
+	if err != nil {
+		return nil, ParsedErr
+	}
+	return Binary{Operator{op}, l, r}, nil
 }
 
 func (parser *Parser) match(token Token, typeInfo string, value string) bool {
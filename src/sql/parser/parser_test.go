@@ -0,0 +1,316 @@
+package parser
+
+import (
+	. "../lexer"
+	. "./statements"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func parse(t *testing.T, sql string) AppliableStatement {
+	stat, err := Parse(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return stat
+}
+
+// show writes an expression out with every operation in parentheses.
+func show(expr Expr) string {
+	switch e := expr.(type) {
+	case Value:
+		return fmt.Sprint(e.Value.(Token).Value)
+	case Unary:
+		return fmt.Sprintf("(%v %s)", e.Op.Token.Value, show(e.X))
+	case Binary:
+		return fmt.Sprintf("(%s %v %s)", show(e.L), e.Op.Token.Value, show(e.R))
+	}
+	return fmt.Sprintf("%#v", expr)
+}
+
+// checkStatements parses each sql and compares it with the statement it
+// should give.
+func checkStatements(t *testing.T, cases map[string]AppliableStatement) {
+	for sql, want := range cases {
+		if got := parse(t, sql); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s\ngot  %#v\nwant %#v", sql, got, want)
+		}
+	}
+}
+
+// checkRejected makes sure none of sqls parses.
+func checkRejected(t *testing.T, sqls ...string) {
+	for _, sql := range sqls {
+		if _, err := Parse(sql); err != ParsedErr {
+			t.Errorf("%s: got %v, want ParsedErr", sql, err)
+		}
+	}
+}
+
+func TestTransactionStatements(t *testing.T) {
+	checkStatements(t, map[string]AppliableStatement{
+		`BEGIN;`:              BeginStatement{},
+		`BEGIN TRANSACTION;`:  BeginStatement{},
+		`COMMIT TRANSACTION;`: CommitStatement{},
+		`ROLLBACK;`:           RollbackStatement{},
+	})
+	checkRejected(t, `BEGIN WORK;`, `COMMIT`)
+}
+
+func TestVerify(t *testing.T) {
+	checkStatements(t, map[string]AppliableStatement{
+		`VERIFY TABLE t;`: VerifyStatement{TableName: "t"},
+	})
+	checkRejected(t, `VERIFY t;`)
+}
+
+func TestVacuum(t *testing.T) {
+	checkStatements(t, map[string]AppliableStatement{
+		`VACUUM t;`: VacuumStatement{TableName: "t"},
+	})
+	checkRejected(t, `VACUUM;`)
+}
+
+func TestWhereConditions(t *testing.T) {
+	stat := parse(t, `SELECT * FROM t WHERE a >= 1 AND b < 2.5 AND "x" <= c AND d > 4 AND e = f;`)
+	got := Conditions(stat.(SelectStatement).Where.Expr)
+
+	idf := func(name string) Value { return Value{Token{"IDENTIFIER", name}} }
+	want := []Condition{
+		{idf("a"), Value{Token{"INT", int64(1)}}, LogicOperation{">="}},
+		{idf("b"), Value{Token{"DOUBLE", 2.5}}, LogicOperation{"<"}},
+		{Value{Token{"STRING", "x"}}, idf("c"), LogicOperation{"<="}},
+		{idf("d"), Value{Token{"INT", int64(4)}}, LogicOperation{">"}},
+		{idf("e"), idf("f"), LogicOperation{"=="}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got  %#v\nwant %#v", got, want)
+	}
+}
+
+func TestIndexStatements(t *testing.T) {
+	checkStatements(t, map[string]AppliableStatement{
+		`CREATE INDEX i ON t (a);`:                      CreateIndexStatement{IndexName: "i", TableName: "t", Cols: []string{"a"}},
+		`CREATE UNIQUE INDEX i ON t (a);`:               CreateIndexStatement{IndexName: "i", TableName: "t", Cols: []string{"a"}, Unique: true},
+		`CREATE INDEX i ON t (a) USING BTREE;`:          CreateIndexStatement{IndexName: "i", TableName: "t", Cols: []string{"a"}, Using: "BTREE"},
+		`CREATE UNIQUE INDEX i ON t (a, b) USING HASH;`: CreateIndexStatement{IndexName: "i", TableName: "t", Cols: []string{"a", "b"}, Unique: true, Using: "HASH"},
+		`DROP INDEX i ON t;`:                            DropIndexStatement{IndexName: "i", TableName: "t"},
+		`DROP INDEX i;`:                                 DropIndexStatement{IndexName: "i"},
+	})
+	checkRejected(t, `CREATE INDEX i ON t ();`, `CREATE INDEX ON t (a);`, `DROP INDEX;`)
+}
+
+func TestOrderBy(t *testing.T) {
+	stat := parse(t, `SELECT * FROM t WHERE a = 1 ORDER BY a, b DESC, c ASC;`)
+	orderBy := stat.(SelectStatement).OrderBy
+
+	got := make([]string, len(orderBy))
+	for i, o := range orderBy {
+		got[i] = o.Name()
+		if o.Desc() {
+			got[i] += " DESC"
+		}
+	}
+	if want := []string{"a", "b DESC", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	checkRejected(t, `SELECT * FROM t ORDER BY;`, `SELECT * FROM t ORDER a;`)
+}
+
+// constraintsOf parses a CREATE and returns its constraints.
+func constraintsOf(t *testing.T, sql string) []Constraint {
+	return parse(t, sql).(CreateStatement).Constraints
+}
+
+func checkConstraints(t *testing.T, sql string, want []Constraint) {
+	got := constraintsOf(t, sql)
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d constraints, want %d", sql, len(got), len(want))
+	}
+	for i, c := range got {
+		if !reflect.DeepEqual(c, want[i]) {
+			t.Errorf("%s: constraint %d\ngot  %#v\nwant %#v", sql, i, c, want[i])
+		}
+	}
+}
+
+func TestKeyConstraints(t *testing.T) {
+	checkConstraints(t, `CREATE t { id INT PRIMARY KEY, name STRING 8 Nullable UNIQUE, `+
+		`CONSTRAINT ab UNIQUE (name, id) ;`, []Constraint{
+		{Kind: PRIMARY_KEY, Cols: []string{"id"}},
+		{Kind: UNIQUE, Cols: []string{"name"}},
+		{Name: "ab", Kind: UNIQUE, Cols: []string{"name", "id"}},
+	})
+	checkConstraints(t, `CREATE t { a INT, b INT, PRIMARY KEY (a, b) ;`, []Constraint{
+		{Kind: PRIMARY_KEY, Cols: []string{"a", "b"}},
+	})
+	checkRejected(t, `CREATE t { a INT PRIMARY ;`, `CREATE t { a INT, UNIQUE () ;`, `CREATE t { a INT, CONSTRAINT UNIQUE (a) ;`)
+}
+
+func TestForeignKeys(t *testing.T) {
+	checkConstraints(t, `CREATE t { id INT PRIMARY KEY, p INT Nullable REFERENCES u ON DELETE CASCADE, `+
+		`q INT REFERENCES u (b), FOREIGN KEY (p, q) REFERENCES v (a, b) ON DELETE SET NULL, `+
+		`CONSTRAINT r FOREIGN KEY (q) REFERENCES w ON DELETE RESTRICT ;`, []Constraint{
+		{Kind: PRIMARY_KEY, Cols: []string{"id"}},
+		{Kind: FOREIGN_KEY, Cols: []string{"p"}, Parent: "u", OnDelete: "CASCADE"},
+		{Kind: FOREIGN_KEY, Cols: []string{"q"}, Parent: "u", ParentCols: []string{"b"}},
+		{Kind: FOREIGN_KEY, Cols: []string{"p", "q"}, Parent: "v", ParentCols: []string{"a", "b"}, OnDelete: "SET NULL"},
+		{Name: "r", Kind: FOREIGN_KEY, Cols: []string{"q"}, Parent: "w", OnDelete: "RESTRICT"},
+	})
+	checkRejected(t,
+		`CREATE t { a INT REFERENCES u ON DELETE NOTHING ;`,
+		`CREATE t { a INT REFERENCES ;`,
+		`CREATE t { a INT, FOREIGN KEY (a) ;`)
+}
+
+func TestCreate(t *testing.T) {
+	create := parse(t, `CREATE t { id INT PRIMARY KEY, `+
+		`name STRING 8 Nullable DEFAULT "x" UNIQUE, `+
+		`n INT DEFAULT 2 * (3 + 4) CHECK (n > 0), `+
+		`p INT Nullable REFERENCES u ON DELETE CASCADE, `+
+		`CONSTRAINT ab UNIQUE (name, n), `+
+		`FOREIGN KEY (p, n) REFERENCES v (a, b) ON DELETE SET NULL, `+
+		`CHECK (n < 100) ;`).(CreateStatement)
+
+	if !reflect.DeepEqual(create.Cols, []string{"id", "name", "n", "p"}) ||
+		!reflect.DeepEqual(create.Types, []string{"INT", "STRING", "INT", "INT"}) ||
+		create.Lens[1] != 8 ||
+		!reflect.DeepEqual(create.Nullable, []bool{false, true, false, true}) {
+		t.Fatalf("cols %v %v %v %v", create.Cols, create.Types, create.Lens, create.Nullable)
+	}
+	if want := []string{"", `"x"`, "2 * (3 + 4)", ""}; !reflect.DeepEqual(create.Defaults, want) {
+		t.Fatalf("defaults %q, want %q", create.Defaults, want)
+	}
+
+	want := []Constraint{
+		{Kind: PRIMARY_KEY, Cols: []string{"id"}},
+		{Kind: UNIQUE, Cols: []string{"name"}},
+		{Kind: CHECK, Cols: []string{"n"}, Check: "n > 0"},
+		{Kind: FOREIGN_KEY, Cols: []string{"p"}, Parent: "u", OnDelete: "CASCADE"},
+		{Name: "ab", Kind: UNIQUE, Cols: []string{"name", "n"}},
+		{Kind: FOREIGN_KEY, Cols: []string{"p", "n"}, Parent: "v", ParentCols: []string{"a", "b"}, OnDelete: "SET NULL"},
+		{Kind: CHECK, Check: "n < 100"},
+	}
+	if len(create.Constraints) != len(want) {
+		t.Fatalf("got %d constraints, want %d", len(create.Constraints), len(want))
+	}
+	for i, c := range create.Constraints {
+		if !reflect.DeepEqual(c, want[i]) {
+			t.Errorf("constraint %d\ngot  %#v\nwant %#v", i, c, want[i])
+		}
+	}
+
+	expr, err := ParseDefault(create.Defaults[2])
+	if err != nil || show(expr) != "(2 * (3 + 4))" {
+		t.Errorf("the DEFAULT of n reads back as %v, %v", expr, err)
+	}
+	if expr, err = ParseCheck(create.Constraints[2].Check); err != nil || show(expr) != "(n > 0)" {
+		t.Errorf("the CHECK of n reads back as %v, %v", expr, err)
+	}
+
+	for _, sql := range []string{
+		`CREATE t { a INT DEFAULT ;`,
+		`CREATE t { a INT CHECK a > 0 ;`,
+		`CREATE t { a INT REFERENCES u ON DELETE NOTHING ;`,
+		`CREATE t { a INT, FOREIGN KEY (a) ;`,
+	} {
+		if _, err := Parse(sql); err != ParsedErr {
+			t.Errorf("%s: got %v, want ParsedErr", sql, err)
+		}
+	}
+}
+
+func TestInsertRows(t *testing.T) {
+	insert := parse(t, `INSERT INTO t (a, b) VALUES (1, "x"), (DEFAULT, 2.5);`).(InsertStatement)
+
+	if !reflect.DeepEqual(insert.Cols, []string{"a", "b"}) || len(insert.Rows) != 2 {
+		t.Fatalf("cols %v, %d rows", insert.Cols, len(insert.Rows))
+	}
+	if tok := insert.Rows[1][0].(Token); tok.TypeInfo != "DEFAULT" {
+		t.Errorf("got %v for DEFAULT", tok)
+	}
+	if tok := insert.Rows[0][1].(Token); tok.Value != "x" {
+		t.Errorf("got %v for \"x\"", tok)
+	}
+
+	checkRejected(t,
+		`INSERT INTO t VALUES ();`,
+		`INSERT INTO t VALUES (1 2);`,
+		`INSERT INTO t VALUES (1,);`,
+		`INSERT INTO t VALUES (1, 2;`,
+		`INSERT INTO t VALUES (1), ;`)
+}
+
+func TestInsertSelect(t *testing.T) {
+	insert := parse(t, `INSERT INTO t (b, a) SELECT a + 1, b FROM u WHERE a > 1;`).(InsertStatement)
+	if insert.Select == nil || insert.Rows != nil {
+		t.Fatalf("INSERT ... SELECT lost its SELECT")
+	}
+	if !reflect.DeepEqual(insert.Cols, []string{"b", "a"}) || insert.Select.From.Table.Idf.Value != "u" {
+		t.Errorf("cols %v, from %v", insert.Cols, insert.Select.From.Table.Idf.Value)
+	}
+	if got := show(insert.Select.Where.Expr); got != "(a > 1)" {
+		t.Errorf("WHERE %s", got)
+	}
+
+	create := parse(t, `CREATE TABLE t AS SELECT a, b * 2 AS c FROM u ORDER BY a;`).(CreateStatement)
+	if create.As == nil || create.TableName != "t" || create.Cols != nil {
+		t.Fatalf("CREATE TABLE ... AS lost its SELECT")
+	}
+	if n := len(create.As.Fields.Idfs); n != 2 || len(create.As.OrderBy) != 1 {
+		t.Errorf("%d fields, %d ORDER BY", n, len(create.As.OrderBy))
+	}
+
+	checkRejected(t,
+		`INSERT INTO t SELECT;`,
+		`INSERT INTO t VALUES (1) SELECT a FROM u;`,
+		`CREATE TABLE t AS;`,
+		`CREATE TABLE t SELECT a FROM u;`)
+}
+
+func TestUpdateSets(t *testing.T) {
+	update := parse(t, `UPDATE t SET a = a + 1, b = -b * 2 WHERE c = 3;`).(UpdateStatement)
+
+	if len(update.Sets) != 2 || update.Sets[0].Col != "a" || update.Sets[1].Col != "b" {
+		t.Fatalf("sets %v", update.Sets)
+	}
+	if got := show(update.Sets[1].Value); got != "((- b) * 2)" {
+		t.Errorf("b = %s", got)
+	}
+	if got := show(update.Where.Expr); got != "(c == 3)" {
+		t.Errorf("WHERE %s", got)
+	}
+
+	checkRejected(t,
+		`UPDATE t SET a = 1, WHERE c = 3;`,
+		`UPDATE t SET a WHERE c = 3;`,
+		`UPDATE (a = 1) FROM t WHERE c = 3;`)
+}
+
+func TestExprPrecedence(t *testing.T) {
+	cases := map[string]string{
+		`a + 2 * 3 > 4`:                   `((a + (2 * 3)) > 4)`,
+		`a - 1 - 2 = b % 3 / c`:           `(((a - 1) - 2) == ((b % 3) / c))`,
+		`-(a + 1) * 2 <> 0`:               `(((- (a + 1)) * 2) != 0)`,
+		`a != 1`:                          `(a != 1)`,
+		`a = 1 OR b = 2 AND c = 3`:        `((a == 1) OR ((b == 2) AND (c == 3)))`,
+		`NOT a < 1 AND (b > 2 OR c >= 3)`: `((NOT (a < 1)) AND ((b > 2) OR (c >= 3)))`,
+		`a NOT b = 1`:                     `(a AND (NOT (b == 1)))`,
+		`a = NULL OR b <= "x"`:            `((a == NULL) OR (b <= x))`,
+	}
+	for where, want := range cases {
+		sel := parse(t, "SELECT * FROM t WHERE "+where+";").(SelectStatement)
+		if got := show(sel.Where.Expr); got != want {
+			t.Errorf("%s\ngot  %s\nwant %s", where, got, want)
+		}
+	}
+
+	checkRejected(t,
+		`SELECT * FROM t WHERE a +;`,
+		`SELECT * FROM t WHERE (a = 1;`,
+		`SELECT * FROM t WHERE a = 1);`,
+		`SELECT * FROM t WHERE a = = 1;`,
+		`SELECT * FROM t WHERE NOT;`)
+}
@@ -0,0 +1,21 @@
+package statements
+
+// Arith:= Term ((+ | -) Term)*
+// Term:= Operand ((* | / | %) Operand)*
+// Operand:= Value | IDF | NULL | ( Expr ) | - Operand
+
+type (
+	Unary struct {
+		Op Operator
+		X  Expr
+	}
+
+	Binary struct {
+		Op Operator
+		L  Expr
+		R  Expr
+	}
+)
+
+func (Unary) isExpr()  {}
+func (Binary) isExpr() {}
@@ -0,0 +1,28 @@
+package statements
+
+// Constraint:= (CONSTRAINT IDF) ( PRIMARY KEY (( Fields )) | UNIQUE (( Fields ))
+//                | FOREIGN KEY ( Fields ) References | References | CHECK ( Expr ) )
+// References:= REFERENCES Table (( Fields )) (ON DELETE ( CASCADE | SET NULL | RESTRICT ))
+// The columns are left out when the constraint is given with a column.
+
+const (
+	PRIMARY_KEY = "PRIMARY KEY"
+	UNIQUE      = "UNIQUE"
+	FOREIGN_KEY = "FOREIGN KEY"
+	CHECK       = "CHECK"
+)
+
+type Constraint struct {
+	Name string // empty if not given
+	Kind string // PRIMARY_KEY, UNIQUE, FOREIGN_KEY or CHECK
+	Cols []string
+
+	// the text of the expression of a CHECK, as in a WHERE.
+	Check string
+
+	// what a FOREIGN KEY refers to; ParentCols is empty for the PRIMARY KEY
+	// of Parent, OnDelete if not given.
+	Parent     string
+	ParentCols []string
+	OnDelete   string
+}
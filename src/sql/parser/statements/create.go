@@ -6,8 +6,15 @@ type CreateStatement struct {
 	Types     []string
 	Lens      []uint16
 	Nullable  []bool
+	Defaults  []string // the text of the DEFAULT of each col, empty if none
 
 	Indexes []string
 
+	Constraints []Constraint
+
+	// CREATE TABLE t AS SELECT ...; takes the cols of the rows selected and
+	// nothing else.
+	As *SelectStatement
+
 	Appliable
 }
@@ -1,28 +1,42 @@
 package statements
 
 import (
-	_ "../../lexer"
+	. "../../lexer"
 )
 
-// ( Value | IDF | Expr) Operator (Value | IDF | Expr)
+// Expr:= And (OR And)*
+// And:= Not ((AND | NOT) Not)*
+// Not:= NOT Not | Comparison
+// Comparison:= Arith (( == | = | != | <> | < | <= | > | >= ) Arith)
+//
+// a NOT b is a AND NOT b, as conditions were joined before there was a tree.
 
-type (
-	Expr struct {
-		Conditions []Condition
-		InterOP    []LogicOperation
-	}
-)
-
-func (expr Expr) IsExpression() bool {
-	return IsExpr(expr)
+// Expr is a tree of an expression: a Value, or an Operator on one or two
+// Exprs. = is kept as == and <> as !=.
+type Expr interface {
+	isExpr()
 }
 
-func IsExpr(expr Expr) bool {
-	for _, value := range expr.Conditions {
-		if !IsCondition(value) {
-			return false
-		}
+func (Value) isExpr() {}
+
+// Conditions returns the comparisons of a Value with a Value that expr joins
+// by AND at its top. A record expr holds for passes each of them.
+func Conditions(expr Expr) []Condition {
+	b, ok := expr.(Binary)
+	if !ok {
+		return nil
 	}
 
-	return len(expr.InterOP)+1 == len(expr.Conditions)
+	op := b.Op.Token.Value
+	if op == "AND" {
+		return append(Conditions(b.L), Conditions(b.R)...)
+	}
+
+	l, lok := b.L.(Value)
+	r, rok := b.R.(Value)
+	if !lok || !rok || !IsLogicOperation(LogicOperation{op.(string)}) ||
+		l.Value.(Token).TypeInfo == "NULL" || r.Value.(Token).TypeInfo == "NULL" {
+		return nil
+	}
+	return []Condition{{LVal: l, RVal: r, Op: LogicOperation{op.(string)}}}
 }
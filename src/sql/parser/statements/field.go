@@ -6,14 +6,28 @@ import (
 
 type (
 	Field struct {
-		Token Token
+		Token Token  // the IDF of a col, as in ORDER BY or a field that is one
+		Expr  Expr   // what a field of SELECT gives
+		As    string // the name given to a field with AS, if any
 	}
 )
 
 func (f Field) IsField() bool {
-	return IsIDF(f.Token)
+	return IsFieldStatement(f)
 }
 
 func IsFieldStatement(f Field) bool {
-	return IsIDF(f.Token)
+	return f.Expr != nil || IsIDF(f.Token)
+}
+
+// Name returns the name of a field: the one given with AS, or else the col
+// it is. It is empty for any other expression.
+func (f Field) Name() string {
+	if f.As != "" {
+		return f.As
+	}
+	if IsIDF(f.Token) {
+		return f.Token.Value.(string)
+	}
+	return ""
 }
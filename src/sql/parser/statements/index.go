@@ -0,0 +1,23 @@
+package statements
+
+// CreateIndex:= CREATE (UNIQUE) INDEX IDF ON Table ( Fields ) (USING IDF)
+// DropIndex:= DROP INDEX IDF (ON Table)
+
+type (
+	CreateIndexStatement struct {
+		IndexName string
+		TableName string
+		Cols      []string
+		Unique    bool
+		Using     string // BTREE or HASH, empty if not given
+
+		AppliableStatement
+	}
+
+	DropIndexStatement struct {
+		IndexName string
+		TableName string // empty if not given
+
+		AppliableStatement
+	}
+)
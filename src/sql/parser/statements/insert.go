@@ -2,7 +2,9 @@ package statements
 
 type InsertStatement struct {
 	TableName string
-	Values    []interface{}
+	Cols      []string         // empty if the values are of every col in order
+	Rows      [][]interface{}  // the values of each row of VALUES
+	Select    *SelectStatement // the rows to insert instead, or nil
 
 	Appliable
 }
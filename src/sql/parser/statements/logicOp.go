@@ -9,7 +9,8 @@ func IsLogicOperation(operation LogicOperation) bool {
 		operation.Op == "<" ||
 		operation.Op == ">=" ||
 		operation.Op == "<=" ||
-		operation.Op == "=="
+		operation.Op == "==" ||
+		operation.Op == "!="
 }
 
 func IsInterLogicOperation(operation LogicOperation) bool {
@@ -15,6 +15,5 @@ func (order Order) IsOrder() bool {
 }
 
 func IsOrderStatement(order Order) bool {
-	return order.Token.TypeInfo == "IDENTIFIER" &&
-		(order.Token.Value == "ASC" || order.Token.Value == "DESC")
+	return order.Token.TypeInfo == "ASC" || order.Token.TypeInfo == "DESC"
 }
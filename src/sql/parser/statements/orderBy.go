@@ -15,3 +15,12 @@ func IsOrderByStatement(orderBy OrderByStatement) bool {
 	return IsFieldStatement(orderBy.Field) &&
 		IsOrderStatement(orderBy.Order)
 }
+
+// Name returns the column ordered by.
+func (orderBy OrderByStatement) Name() string {
+	return orderBy.Field.Token.Value.(string)
+}
+
+func (orderBy OrderByStatement) Desc() bool {
+	return orderBy.Order.Token.TypeInfo == "DESC"
+}
@@ -16,7 +16,7 @@ type (
 
 		Where Where
 
-		OrderBy OrderByStatement
+		OrderBy []OrderByStatement
 
 		// TODO having HavingStatement
 
@@ -31,10 +31,15 @@ func (sel SelectStatement) IsSelect() bool {
 }
 
 func IsSelectStatement(sel SelectStatement) bool {
+	for _, orderBy := range sel.OrderBy {
+		if !IsOrderByStatement(orderBy) {
+			return false
+		}
+	}
+
 	return IsUniqueStatement(sel.Unique) &&
 		IsAllStatement(*sel.All) &&
 		IsFieldsStatement(sel.Fields) &&
 		IsFromStatement(sel.From) &&
-		IsWhereStatement(sel.Where) &&
-		IsOrderByStatement(sel.OrderBy)
+		IsWhereStatement(sel.Where)
 }
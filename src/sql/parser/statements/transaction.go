@@ -0,0 +1,19 @@
+package statements
+
+// Begin:= BEGIN (TRANSACTION)
+// Commit:= COMMIT (TRANSACTION)
+// Rollback:= ROLLBACK (TRANSACTION)
+
+type (
+	BeginStatement struct {
+		AppliableStatement
+	}
+
+	CommitStatement struct {
+		AppliableStatement
+	}
+
+	RollbackStatement struct {
+		AppliableStatement
+	}
+)
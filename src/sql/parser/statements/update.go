@@ -1,10 +1,20 @@
 package statements
 
-type UpdateStatement struct {
-	TableName string
-	Col       string
-	Value     interface{}
-	Where     *Where
-
-	Appliable
-}
+// Update:= UPDATE Table SET Assignment (, Assignment)* (Where)
+
+type (
+	UpdateStatement struct {
+		TableName string
+		Sets      []Assignment
+		Where     *Where
+
+		Appliable
+	}
+
+	// Assignment gives a col the value of an expression on the record as it
+	// was before the UPDATE.
+	Assignment struct {
+		Col   string
+		Value Expr
+	}
+)
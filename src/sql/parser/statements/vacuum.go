@@ -0,0 +1,9 @@
+package statements
+
+// Vacuum:= VACUUM Table
+
+type VacuumStatement struct {
+	TableName string
+
+	AppliableStatement
+}
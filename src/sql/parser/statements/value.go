@@ -1,6 +1,7 @@
 package statements
 
 type (
+	// Value holds the lexer.Token of a column name or of a literal.
 	Value struct {
 		Value interface{}
 	}
@@ -0,0 +1,9 @@
+package statements
+
+// Verify:= VERIFY TABLE Table
+
+type VerifyStatement struct {
+	TableName string
+
+	AppliableStatement
+}
@@ -4,7 +4,7 @@ package statements
 
 type (
 	Where struct {
-		Expr Expr
+		Expr Expr // nil if there is no WHERE
 	}
 )
 
@@ -13,5 +13,5 @@ func (where Where) IsWhere() bool {
 }
 
 func IsWhereStatement(where Where) bool {
-	return IsExpr(where.Expr)
+	return where.Expr != nil
 }
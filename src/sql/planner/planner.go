@@ -1,62 +1,194 @@
 package planner
 
 import "../parser/statements"
+import "../../dm"
 import "../../ds"
 
 type Planner struct{}
 
+// Session holds the state of one client connection, i.e. its open transaction.
+// Statements outside BEGIN ... COMMIT run in a transaction of their own, and
+// every transaction reads from its own snapshot.
+type Session struct {
+	txn *dm.Txn
+}
+
 var dataStorage = ds.NewDS()
 
+func NewSession() *Session { return &Session{} }
+
 func Eval(appliable statements.Appliable) string {
+	return NewSession().Eval(appliable)
+}
+
+func (session *Session) Eval(appliable statements.Appliable) string {
+	switch appliable.(type) {
+	case statements.BeginStatement:
+		return session.begin()
+	case statements.CommitStatement:
+		return session.commit()
+	case statements.RollbackStatement:
+		return session.rollback()
+	case statements.CreateStatement, statements.DropStatement:
+		if session.txn != nil {
+			return "DDL is not allowed inside a transaction."
+		}
+	case statements.CreateIndexStatement:
+		// indexes are built and dropped with every writer kept out.
+		if session.txn != nil {
+			return "DDL is not allowed inside a transaction."
+		}
+		create := appliable.(statements.CreateIndexStatement)
+		return dataStorage.CreateIndex(create.IndexName, create.TableName, create.Cols, create.Unique, create.Using)
+	case statements.DropIndexStatement:
+		if session.txn != nil {
+			return "DDL is not allowed inside a transaction."
+		}
+		drop := appliable.(statements.DropIndexStatement)
+		return dataStorage.DropIndex(drop.IndexName, drop.TableName)
+	case statements.VacuumStatement:
+		// VACUUM commits its work in transactions of its own.
+		if session.txn != nil {
+			return "VACUUM can not run inside a transaction."
+		}
+		return dataStorage.Vacuum(appliable.(statements.VacuumStatement).TableName)
+	}
+
+	if session.txn != nil {
+		return eval(session.txn, appliable)
+	}
+
+	txn, err := dm.Begin()
+	if err != nil {
+		return err.Error()
+	}
+
+	result := eval(txn, appliable)
+	if err := txn.Commit(); err != nil {
+		return err.Error()
+	}
+	return result
+}
+
+// Close rolls back whatever the connection left uncommitted.
+func (session *Session) Close() {
+	if session.txn != nil {
+		session.rollback()
+	}
+}
+
+func (session *Session) begin() string {
+	if session.txn != nil {
+		return "There is already a transaction in progress."
+	}
+
+	txn, err := dm.Begin()
+	if err != nil {
+		return err.Error()
+	}
+
+	session.txn = txn
+	return "OK"
+}
+
+func (session *Session) commit() string {
+	if session.txn == nil {
+		return "There is no transaction in progress."
+	}
+
+	txn := session.txn
+	session.txn = nil
+	if err := txn.Commit(); err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+func (session *Session) rollback() string {
+	if session.txn == nil {
+		return "There is no transaction in progress."
+	}
+
+	txn := session.txn
+	session.txn = nil
+	if err := txn.Rollback(); err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+func eval(txn *dm.Txn, appliable statements.Appliable) string {
 	planner := &Planner{}
 	switch appliable.(type) {
 	case statements.CreateStatement:
-		return planner.evalCreate(appliable.(statements.CreateStatement))
+		return planner.evalCreate(txn, appliable.(statements.CreateStatement))
 	case statements.SelectStatement:
-		return planner.evalSelect(appliable.(statements.SelectStatement))
+		return planner.evalSelect(txn, appliable.(statements.SelectStatement))
 	case statements.InsertStatement:
-		return planner.evalInsert(appliable.(statements.InsertStatement))
+		return planner.evalInsert(txn, appliable.(statements.InsertStatement))
 	case statements.UpdateStatement:
-		return planner.evalDelete(appliable.(statements.DeleteStatement))
+		return planner.evalUpdate(txn, appliable.(statements.UpdateStatement))
+	case statements.DeleteStatement:
+		return planner.evalDelete(txn, appliable.(statements.DeleteStatement))
 	case statements.DropStatement:
-		return planner.evalDrop(appliable.(statements.DropStatement))
+		return planner.evalDrop(txn, appliable.(statements.DropStatement))
+	case statements.VerifyStatement:
+		return planner.evalVerify(appliable.(statements.VerifyStatement))
 	}
 
 	return "This kind of Op is not supported now."
 }
 
-func (pl Planner) evalCreate(create statements.CreateStatement) string {
-	return dataStorage.CreateTable(create.TableName,
+func (pl Planner) evalCreate(txn *dm.Txn, create statements.CreateStatement) string {
+	if create.As != nil {
+		from, all, fields := selected(*create.As)
+		return dataStorage.CreateTableAs(txn, create.TableName, from, all, fields, &create.As.Where, create.As.OrderBy)
+	}
+
+	return dataStorage.CreateTable(txn,
+		create.TableName,
 		create.Cols,
 		create.Types,
 		create.Lens,
 		create.Nullable,
-		create.Indexes)
+		create.Defaults,
+		create.Indexes,
+		create.Constraints)
+}
+
+func (pl Planner) evalSelect(txn *dm.Txn, sel statements.SelectStatement) string {
+	from, all, fields := selected(sel)
+	return dataStorage.ReadTable(txn, from, all, fields, &sel.Where, sel.OrderBy)
 }
 
-func (pl Planner) evalSelect(sel statements.SelectStatement) string {
+// selected returns the table a SELECT reads, whether it takes every col and
+// the fields it gives.
+func selected(sel statements.SelectStatement) (string, bool, []statements.Field) {
 	all := sel.All != nil || sel.Star != nil
+	return sel.From.Table.Idf.Value.(string), all, sel.Fields.Idfs
+}
 
-	fields := make([]string, 0)
-	for _, f := range sel.Fields.Idfs {
-		fields = append(fields, f.Token.Value.(string))
+func (pl Planner) evalInsert(txn *dm.Txn, insert statements.InsertStatement) string {
+	if insert.Select != nil {
+		from, all, fields := selected(*insert.Select)
+		return dataStorage.InsertSelect(txn, insert.TableName, insert.Cols,
+			from, all, fields, &insert.Select.Where, insert.Select.OrderBy)
 	}
-
-	return dataStorage.ReadTable(sel.From.Table.Idf.Value.(string), all, fields, &sel.Where)
+	return dataStorage.Insert(txn, insert.TableName, insert.Cols, insert.Rows)
 }
 
-func (pl Planner) evalInsert(insert statements.InsertStatement) string {
-	return dataStorage.Insert(insert.TableName, insert.Values)
+func (pl Planner) evalUpdate(txn *dm.Txn, update statements.UpdateStatement) string {
+	return dataStorage.Update(txn, update.TableName, update.Sets, update.Where)
 }
 
-func (pl Planner) evalUpdate(update statements.UpdateStatement) string {
-	return dataStorage.Update(update.TableName, update.Col, update.Value, update.Where)
+func (pl Planner) evalDelete(txn *dm.Txn, delete statements.DeleteStatement) string {
+	return dataStorage.Delete(txn, delete.TableName, delete.Where)
 }
 
-func (pl Planner) evalDelete(delete statements.DeleteStatement) string {
-	return dataStorage.Delete(delete.TableName, *delete.Where)
+func (pl Planner) evalDrop(txn *dm.Txn, drop statements.DropStatement) string {
+	return dataStorage.DropTable(txn, drop.TableName)
 }
 
-func (pl Planner) evalDrop(drop statements.DropStatement) string {
-	return dataStorage.DropTable(drop.TableName)
+func (pl Planner) evalVerify(verify statements.VerifyStatement) string {
+	return dataStorage.VerifyTable(verify.TableName)
 }